@@ -0,0 +1,330 @@
+package aws_signing_helper
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Signing agent
+//
+// The agent holds a private key and signs digests on behalf of other
+// processes, which connect to it over a Unix domain socket, in the manner of
+// ssh-agent. Clients reference the agent with a private key of the form
+// agent:<socket path>.
+//
+// Wire protocol: every message, in either direction, is framed as
+//
+//	uint32  length of the rest of the message (big-endian)
+//	byte    message type
+//	byte[]  contents
+//
+// A client sends requests on a connection one at a time, and the agent
+// answers each with exactly one response:
+//
+//	AGENT_REQUEST_PUBLIC_KEY   (empty)
+//	  -> AGENT_RESPONSE_PUBLIC_KEY, contents: DER-encoded SubjectPublicKeyInfo
+//	AGENT_REQUEST_SIGN         byte hash (AGENT_HASH_*), followed by the digest
+//	  -> AGENT_RESPONSE_SIGNATURE, contents: the signature (PKCS#1 v1.5 for
+//	     RSA keys, ASN.1 DER for ECDSA keys)
+//	AGENT_REQUEST_SIGN_PSS     same as AGENT_REQUEST_SIGN, RSA keys only
+//	  -> AGENT_RESPONSE_SIGNATURE, contents: the RSASSA-PSS signature, with a
+//	     salt as long as the digest
+//
+// Any request may be answered with AGENT_RESPONSE_FAILURE, whose contents are
+// a UTF-8 error message. Peers that aren't authorized are sent a failure
+// response and disconnected.
+
+// Prefix of private key references to a signing agent, for example
+// agent:/run/rolesanywhere/agent.sock
+const AGENT_KEY_PREFIX = "agent:"
+
+// Message types of the agent protocol
+const (
+	AGENT_REQUEST_PUBLIC_KEY  byte = 1
+	AGENT_RESPONSE_PUBLIC_KEY byte = 2
+	AGENT_REQUEST_SIGN        byte = 3
+	AGENT_RESPONSE_SIGNATURE  byte = 4
+	AGENT_RESPONSE_FAILURE    byte = 5
+	AGENT_REQUEST_SIGN_PSS    byte = 6
+)
+
+// Hash functions that digests sent to the agent can be computed with
+const (
+	AGENT_HASH_SHA256 byte = 1
+	AGENT_HASH_SHA384 byte = 2
+	AGENT_HASH_SHA512 byte = 3
+)
+
+// Upper bound of the size of a message, which is far above what requests
+// and responses need
+const maxAgentMessageSize = 64 * 1024
+
+var agentHashes = map[byte]crypto.Hash{
+	AGENT_HASH_SHA256: crypto.SHA256,
+	AGENT_HASH_SHA384: crypto.SHA384,
+	AGENT_HASH_SHA512: crypto.SHA512,
+}
+
+// Checks whether the private key references a signing agent
+func isAgentKey(privateKey string) bool {
+	return strings.HasPrefix(privateKey, AGENT_KEY_PREFIX)
+}
+
+// Writes a message of the agent protocol
+func writeAgentMessage(w io.Writer, messageType byte, contents []byte) error {
+	message := make([]byte, 5+len(contents))
+	binary.BigEndian.PutUint32(message, uint32(1+len(contents)))
+	message[4] = messageType
+	copy(message[5:], contents)
+	_, err := w.Write(message)
+	return err
+}
+
+// Reads a message of the agent protocol, returning its type and contents
+func readAgentMessage(r io.Reader) (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length == 0 || length > maxAgentMessageSize {
+		return 0, nil, errors.New("invalid agent message length")
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return 0, nil, err
+	}
+	return message[0], message[1:], nil
+}
+
+// Signs digests with a key held by a signing agent. The signer holds a
+// connection to the agent, which has to be released with Close.
+type AgentSigner struct {
+	mutex     sync.Mutex
+	conn      net.Conn
+	publicKey crypto.PublicKey
+}
+
+// Connects to the signing agent listening on the socket referenced by the
+// private key (agent:<socket path>), and obtains the public key it holds
+func GetAgentSigner(privateKey string) (*AgentSigner, error) {
+	socketPath := strings.TrimPrefix(privateKey, AGENT_KEY_PREFIX)
+	if socketPath == "" {
+		return nil, errors.New("missing agent socket path")
+	}
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to agent: %w", err)
+	}
+
+	signer := &AgentSigner{conn: conn}
+	publicKeyDer, err := signer.request(AGENT_REQUEST_PUBLIC_KEY, nil, AGENT_RESPONSE_PUBLIC_KEY)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	signer.publicKey, err = x509.ParsePKIXPublicKey(publicKeyDer)
+	if err != nil {
+		conn.Close()
+		return nil, errors.New("unable to parse public key returned by agent")
+	}
+	return signer, nil
+}
+
+// Sends a request to the agent, and returns the contents of its response,
+// which has to be of the expected type
+func (signer *AgentSigner) request(requestType byte, contents []byte, responseType byte) ([]byte, error) {
+	signer.mutex.Lock()
+	defer signer.mutex.Unlock()
+
+	if err := writeAgentMessage(signer.conn, requestType, contents); err != nil {
+		return nil, fmt.Errorf("unable to send request to agent: %w", err)
+	}
+	messageType, response, err := readAgentMessage(signer.conn)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response from agent: %w", err)
+	}
+	if messageType == AGENT_RESPONSE_FAILURE {
+		return nil, fmt.Errorf("agent failure: %s", response)
+	}
+	if messageType != responseType {
+		return nil, errors.New("unexpected response from agent")
+	}
+	return response, nil
+}
+
+func (signer *AgentSigner) Public() crypto.PublicKey {
+	return signer.publicKey
+}
+
+// Has the agent sign the digest
+func (signer *AgentSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	requestType := AGENT_REQUEST_SIGN
+	if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+		if pssOpts.SaltLength != rsa.PSSSaltLengthEqualsHash && pssOpts.SaltLength != opts.HashFunc().Size() {
+			return nil, errors.New("the agent only signs with a PSS salt as long as the digest")
+		}
+		requestType = AGENT_REQUEST_SIGN_PSS
+	}
+	var hash byte
+	for agentHash, hashFunc := range agentHashes {
+		if hashFunc == opts.HashFunc() {
+			hash = agentHash
+		}
+	}
+	if hash == 0 {
+		return nil, errors.New("unsupported digest")
+	}
+	return signer.request(requestType, append([]byte{hash}, digest...), AGENT_RESPONSE_SIGNATURE)
+}
+
+// Closes the connection to the agent
+func (signer *AgentSigner) Close() error {
+	return signer.conn.Close()
+}
+
+// Serves signing requests for the private key on a Unix domain socket,
+// described by serveOpts (Listen, SocketMode, AllowedUids and AllowedGids).
+// Only peers in the UID and GID allow-lists are served, if either is set.
+func ServeAgent(privateKey crypto.PrivateKey, serveOpts ServeOpts) error {
+	return ServeAgentWithCertificate(privateKey, nil, serveOpts)
+}
+
+// Same as ServeAgent, with the certificate of the private key, whose public
+// key is handed to clients when the signer can't provide it (such as a
+// PKCS#11 token that only holds the private key)
+func ServeAgentWithCertificate(privateKey crypto.PrivateKey, certificate *x509.Certificate, serveOpts ServeOpts) error {
+	if !strings.HasPrefix(serveOpts.Listen, UNIX_LISTEN_PREFIX) {
+		return errors.New("the agent can only listen on a unix socket")
+	}
+	listener, err := CreateListener(&serveOpts)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	log.Println("Agent listening on", serveOpts.Listen)
+	return serveAgent(listener, privateKey, certificate, &serveOpts)
+}
+
+// Serves signing requests for the private key on connections accepted from
+// the listener, until it's closed. The public key comes from the signer, or
+// else from the certificate, if there's one.
+func serveAgent(listener net.Listener, privateKey crypto.PrivateKey, certificate *x509.Certificate, serveOpts *ServeOpts) error {
+	signer, err := getSigner(privateKey)
+	if err != nil {
+		return err
+	}
+	publicKey := signer.Public()
+	if certificate != nil {
+		if publicKey == nil {
+			publicKey = certificate.PublicKey
+		} else if comparablePublicKey, ok := publicKey.(interface {
+			Equal(crypto.PublicKey) bool
+		}); !ok || !comparablePublicKey.Equal(certificate.PublicKey) {
+			return errors.New("signer does not match the certificate's public key")
+		}
+	}
+	if publicKey == nil {
+		return errors.New("unable to find the public key of the private key; provide its certificate")
+	}
+	publicKeyDer, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return fmt.Errorf("unable to encode public key: %w", err)
+	}
+
+	// Keys backed by a token aren't necessarily safe for concurrent use
+	var signMutex sync.Mutex
+	_, isRSAKey := publicKey.(*rsa.PublicKey)
+	sign := func(digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+		if _, ok := opts.(*rsa.PSSOptions); ok && !isRSAKey {
+			return nil, errors.New("PSS padding can only be used with RSA keys")
+		}
+		signMutex.Lock()
+		defer signMutex.Unlock()
+		return signer.Sign(rand.Reader, digest, opts)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := authorizeAgentPeer(conn, serveOpts); err != nil {
+				writeAgentMessage(conn, AGENT_RESPONSE_FAILURE, []byte(err.Error()))
+				return
+			}
+			handleAgentConnection(conn, sign, publicKeyDer)
+		}()
+	}
+}
+
+// Checks whether the peer of an agent connection is in the UID and GID
+// allow-lists. If neither list is set, every peer is allowed.
+func authorizeAgentPeer(conn net.Conn, serveOpts *ServeOpts) error {
+	if len(serveOpts.AllowedUids) == 0 && len(serveOpts.AllowedGids) == 0 {
+		return nil
+	}
+	peerCredentials, err := getPeerCredentials(conn)
+	if err != nil || !isPeerAllowed(peerCredentials, serveOpts) {
+		return errors.New("peer is not authorized")
+	}
+	return nil
+}
+
+// Answers the requests sent on an agent connection until it's closed
+func handleAgentConnection(conn io.ReadWriter, sign func([]byte, crypto.SignerOpts) ([]byte, error), publicKeyDer []byte) {
+	for {
+		messageType, contents, err := readAgentMessage(conn)
+		if err != nil {
+			return
+		}
+
+		var responseType byte
+		var response []byte
+		switch messageType {
+		case AGENT_REQUEST_PUBLIC_KEY:
+			responseType, response = AGENT_RESPONSE_PUBLIC_KEY, publicKeyDer
+		case AGENT_REQUEST_SIGN, AGENT_REQUEST_SIGN_PSS:
+			response, err = handleAgentSignRequest(contents, messageType == AGENT_REQUEST_SIGN_PSS, sign)
+			responseType = AGENT_RESPONSE_SIGNATURE
+		default:
+			err = errors.New("unsupported request")
+		}
+		if err != nil {
+			responseType, response = AGENT_RESPONSE_FAILURE, []byte(err.Error())
+		}
+		if err = writeAgentMessage(conn, responseType, response); err != nil {
+			return
+		}
+	}
+}
+
+// Signs the digest in a sign request, after checking that it matches its hash function
+func handleAgentSignRequest(contents []byte, pss bool, sign func([]byte, crypto.SignerOpts) ([]byte, error)) ([]byte, error) {
+	if len(contents) == 0 {
+		return nil, errors.New("invalid sign request")
+	}
+	hash, ok := agentHashes[contents[0]]
+	if !ok {
+		return nil, errors.New("unsupported digest")
+	}
+	digest := contents[1:]
+	if len(digest) != hash.Size() {
+		return nil, errors.New("digest length doesn't match its hash function")
+	}
+	if pss {
+		return sign(digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash})
+	}
+	return sign(digest, hash)
+}
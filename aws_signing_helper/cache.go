@@ -0,0 +1,289 @@
+package aws_signing_helper
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Credentials cache
+//
+// Each entry of the cache is a JSON file in the cache directory, named after
+// a hash of the fingerprint of the certificate and of the options of the
+// session (see getCredentialsCacheKey). Entries are written with 0600
+// permissions, and a lock file next to each entry serializes the processes
+// that read and refresh it, so that only one of them calls CreateSession at a
+// time.
+//
+// Encrypted entries hold the credentials sealed with AES-256-GCM, under a key
+// derived from the private key with HMAC-SHA256. Only private keys that are
+// read from a file (or a PKCS#12 file) can be used to encrypt the cache.
+
+// Cached credentials are refreshed when they expire within this window,
+// unless CredentialsCacheOpts specifies another one
+const DefaultCacheRefreshWindow = time.Minute * time.Duration(5)
+
+// Label from which the cache encryption key is derived
+const cacheEncryptionKeyLabel = "rolesanywhere-credential-helper credentials cache"
+
+// Options of the on-disk credentials cache
+type CredentialsCacheOpts struct {
+	// Directory holding the cache; the result of DefaultCredentialsCacheDir if empty
+	Dir string
+	// Cached credentials that expire within this window are refreshed;
+	// DefaultCacheRefreshWindow if zero
+	RefreshWindow time.Duration
+	// Whether cached credentials are encrypted with a key derived from the private key
+	Encrypt bool
+}
+
+// Contents of a cache entry, which holds either the credentials or, if it's
+// encrypted, the nonce and the sealed credentials
+type credentialsCacheEntry struct {
+	Credentials *CredentialProcessOutput `json:"Credentials,omitempty"`
+	Nonce       []byte                   `json:"Nonce,omitempty"`
+	Ciphertext  []byte                   `json:"Ciphertext,omitempty"`
+}
+
+// Returns the default directory of the credentials cache, within the user's
+// cache directory
+func DefaultCredentialsCacheDir() (string, error) {
+	userCacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(userCacheDir, "rolesanywhere-credential-helper", "credentials"), nil
+}
+
+// Returns cached credentials for opts if they don't expire within the refresh
+// window. Otherwise, new credentials are obtained through CreateSession and
+// cached. Failing to write the cache doesn't fail the call.
+func GenerateCredentialsWithCache(ctx context.Context, opts *CredentialsOpts, cacheOpts CredentialsCacheOpts) (CredentialProcessOutput, error) {
+	return generateCredentialsWithCache(ctx, opts, cacheOpts, GenerateCredentialsWithContext)
+}
+
+func generateCredentialsWithCache(ctx context.Context, opts *CredentialsOpts, cacheOpts CredentialsCacheOpts, generateCredentials func(context.Context, *CredentialsOpts) (CredentialProcessOutput, error)) (CredentialProcessOutput, error) {
+	cacheDir := cacheOpts.Dir
+	if cacheDir == "" {
+		var err error
+		if cacheDir, err = DefaultCredentialsCacheDir(); err != nil {
+			return CredentialProcessOutput{}, fmt.Errorf("unable to find the cache directory: %w", err)
+		}
+	}
+	refreshWindow := cacheOpts.RefreshWindow
+	if refreshWindow <= 0 {
+		refreshWindow = DefaultCacheRefreshWindow
+	}
+
+	cacheKey, err := getCredentialsCacheKey(opts)
+	if err != nil {
+		return CredentialProcessOutput{}, err
+	}
+	var encryptionKey []byte
+	if cacheOpts.Encrypt {
+		if encryptionKey, err = getCacheEncryptionKey(opts); err != nil {
+			return CredentialProcessOutput{}, err
+		}
+	}
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return CredentialProcessOutput{}, fmt.Errorf("unable to create the cache directory: %w", err)
+	}
+
+	entryPath := filepath.Join(cacheDir, cacheKey+".json")
+	var credentialProcessOutput CredentialProcessOutput
+	err = withFileLock(filepath.Join(cacheDir, cacheKey+".lock"), func() error {
+		cached, err := readCredentialsCacheEntry(entryPath, cacheKey, encryptionKey)
+		if err == nil && expiresAfter(cached, time.Now().Add(refreshWindow)) {
+			credentialProcessOutput = cached
+			return nil
+		}
+
+		credentialProcessOutput, err = generateCredentials(ctx, opts)
+		if err != nil {
+			return err
+		}
+		if err := writeCredentialsCacheEntry(entryPath, cacheKey, encryptionKey, credentialProcessOutput); err != nil {
+			log.Println("unable to cache credentials:", err)
+		}
+		return nil
+	})
+	return credentialProcessOutput, err
+}
+
+// Checks whether the credentials are still valid at the given time
+func expiresAfter(credentialProcessOutput CredentialProcessOutput, t time.Time) bool {
+	expiration, err := time.Parse(time.RFC3339, credentialProcessOutput.Expiration)
+	return err == nil && expiration.After(t)
+}
+
+// Computes the key of the cache entry for opts, from the fingerprint of the
+// certificate and every option that changes the session CreateSession returns:
+// the role, profile, trust anchor, role session name, session duration,
+// instance properties, region and endpoint
+func getCredentialsCacheKey(opts *CredentialsOpts) (string, error) {
+	var certificateDer []byte
+	if opts.Pkcs12Id != "" {
+		_, certificate, _, err := ReadPKCS12Data(opts.Pkcs12Id, opts.Pkcs12Password)
+		if err != nil {
+			return "", err
+		}
+		certificateDer = certificate.Raw
+	} else {
+		var err error
+		if certificateDer, err = readCertificateDER(opts.CertificateId); err != nil {
+			return "", err
+		}
+	}
+	fingerprint := sha256.Sum256(certificateDer)
+
+	fields := []string{
+		opts.RoleArn, opts.ProfileArnStr, opts.TrustAnchorArnStr, opts.RoleSessionName, hex.EncodeToString(fingerprint[:]),
+		strconv.Itoa(opts.SessionDuration), opts.Region, opts.Endpoint,
+	}
+	// Instance properties are hashed as sent, including those read from the system
+	instanceProperties, err := getInstanceProperties(opts)
+	if err != nil {
+		return "", err
+	}
+	var instancePropertyKeys []string
+	for key := range instanceProperties {
+		instancePropertyKeys = append(instancePropertyKeys, key)
+	}
+	sort.Strings(instancePropertyKeys)
+	for _, key := range instancePropertyKeys {
+		fields = append(fields, key+"="+*instanceProperties[key])
+	}
+
+	hash := sha256.New()
+	for _, field := range fields {
+		hash.Write([]byte(field))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Derives the key that cache entries are encrypted with from the private key
+func getCacheEncryptionKey(opts *CredentialsOpts) ([]byte, error) {
+	var privateKey crypto.PrivateKey
+	var err error
+	if opts.Pkcs12Id != "" {
+		privateKey, _, _, err = ReadPKCS12Data(opts.Pkcs12Id, opts.Pkcs12Password)
+	} else {
+		privateKey, err = ReadPrivateKeyDataWithPassphrase(opts.PrivateKeyId, opts.PrivateKeyPassphrase)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := privateKey.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	var privateKeyDer []byte
+	switch key := privateKey.(type) {
+	case rsa.PrivateKey:
+		privateKeyDer, err = x509.MarshalPKCS8PrivateKey(&key)
+	case ecdsa.PrivateKey:
+		privateKeyDer, err = x509.MarshalPKCS8PrivateKey(&key)
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		privateKeyDer, err = x509.MarshalPKCS8PrivateKey(key)
+	default:
+		return nil, errors.New("the cache can only be encrypted with a private key read from a file")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, privateKeyDer)
+	mac.Write([]byte(cacheEncryptionKeyLabel))
+	return mac.Sum(nil), nil
+}
+
+// Reads the credentials of a cache entry, decrypting them if an encryption
+// key is given
+func readCredentialsCacheEntry(entryPath string, cacheKey string, encryptionKey []byte) (CredentialProcessOutput, error) {
+	data, err := ioutil.ReadFile(entryPath)
+	if err != nil {
+		return CredentialProcessOutput{}, err
+	}
+	var entry credentialsCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return CredentialProcessOutput{}, err
+	}
+
+	if encryptionKey == nil {
+		if entry.Credentials == nil {
+			return CredentialProcessOutput{}, errors.New("cache entry isn't in plaintext")
+		}
+		return *entry.Credentials, nil
+	}
+	aead, err := newCacheAEAD(encryptionKey)
+	if err != nil {
+		return CredentialProcessOutput{}, err
+	}
+	if len(entry.Nonce) != aead.NonceSize() {
+		return CredentialProcessOutput{}, errors.New("cache entry isn't encrypted")
+	}
+	plaintext, err := aead.Open(nil, entry.Nonce, entry.Ciphertext, []byte(cacheKey))
+	if err != nil {
+		return CredentialProcessOutput{}, errors.New("unable to decrypt cache entry")
+	}
+	var credentialProcessOutput CredentialProcessOutput
+	err = json.Unmarshal(plaintext, &credentialProcessOutput)
+	return credentialProcessOutput, err
+}
+
+// Writes the credentials to a cache entry, encrypting them if an encryption
+// key is given
+func writeCredentialsCacheEntry(entryPath string, cacheKey string, encryptionKey []byte, credentialProcessOutput CredentialProcessOutput) error {
+	var entry credentialsCacheEntry
+	if encryptionKey == nil {
+		entry.Credentials = &credentialProcessOutput
+	} else {
+		aead, err := newCacheAEAD(encryptionKey)
+		if err != nil {
+			return err
+		}
+		plaintext, err := json.Marshal(credentialProcessOutput)
+		if err != nil {
+			return err
+		}
+		entry.Nonce = make([]byte, aead.NonceSize())
+		if _, err := rand.Read(entry.Nonce); err != nil {
+			return err
+		}
+		entry.Ciphertext = aead.Seal(nil, entry.Nonce, plaintext, []byte(cacheKey))
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(entryPath, data, 0600)
+}
+
+func newCacheAEAD(encryptionKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
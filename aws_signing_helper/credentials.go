@@ -1,12 +1,16 @@
 package aws_signing_helper
 
 import (
+	"context"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"regexp"
 	"runtime"
 	"time"
 
@@ -20,6 +24,16 @@ import (
 
 const opCreateSession = "CreateSession"
 
+// Bounds and default for the duration of sessions vended by CreateSession, in seconds
+const (
+	MinSessionDuration     = 900
+	MaxSessionDuration     = 43200
+	DefaultSessionDuration = 3600
+)
+
+// Role session names may only contain these characters, and must be between 2 and 64 characters long
+var roleSessionNameRegex = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+
 type CredentialsOpts struct {
 	PrivateKeyId        string
 	CertificateId       string
@@ -28,16 +42,100 @@ type CredentialsOpts struct {
 	ProfileArnStr       string
 	TrustAnchorArnStr   string
 	SessionDuration     int
+	RoleSessionName     string
 	Region              string
 	Endpoint            string
 	NoVerifySSL         bool
 	WithProxy           bool
 	Debug               bool
 	Version             string
+	// Instance properties to attach to the session, as key/value pairs
+	InstanceProperties map[string]string
+	// Whether standard instance properties (such as the hostname) should be read from the system
+	WithSystemInstanceProperties bool
+	// Path to a PKCS#12 file holding the private key, the certificate and its
+	// intermediates, used instead of PrivateKeyId and CertificateId.
+	// Intermediates from CertificateBundleId are added to those in the file.
+	Pkcs12Id string
+	// Password of the PKCS#12 file
+	Pkcs12Password string
+	// Passphrase of the private key, if it's an encrypted PKCS#8 key
+	PrivateKeyPassphrase string
+	// Policy for retrying CreateSession after transient failures; fields left
+	// zero take their value from DefaultRetryPolicy
+	RetryPolicy RetryPolicy
+	// Time after which CreateSession (including its retries) is abandoned;
+	// unlimited if zero
+	Timeout time.Duration
 }
 
 // Function to create session and generate credentials
 func GenerateCredentials(opts *CredentialsOpts) (CredentialProcessOutput, error) {
+	return GenerateCredentialsWithContext(context.Background(), opts)
+}
+
+// Function to create session and generate credentials. The call to
+// CreateSession is cancelled when the context is done, or after opts.Timeout.
+func GenerateCredentialsWithContext(ctx context.Context, opts *CredentialsOpts) (CredentialProcessOutput, error) {
+	var privateKey crypto.PrivateKey
+	var certificate *x509.Certificate
+	var certificateChain []*x509.Certificate
+	var err error
+	if opts.Pkcs12Id != "" {
+		privateKey, certificate, certificateChain, err = ReadPKCS12Data(opts.Pkcs12Id, opts.Pkcs12Password)
+		if err != nil {
+			return CredentialProcessOutput{}, err
+		}
+	} else {
+		privateKey, err = ReadPrivateKeyDataWithPassphrase(opts.PrivateKeyId, opts.PrivateKeyPassphrase)
+		if err != nil {
+			return CredentialProcessOutput{}, err
+		}
+		// Keys that are backed by a token hold a session that has to be released
+		if closer, ok := privateKey.(io.Closer); ok {
+			defer closer.Close()
+		}
+		certificateData, err := ReadCertificateData(opts.CertificateId)
+		if err != nil {
+			return CredentialProcessOutput{}, err
+		}
+		certificateDerData, err := base64.StdEncoding.DecodeString(certificateData.CertificateData)
+		if err != nil {
+			return CredentialProcessOutput{}, err
+		}
+		certificate, err = x509.ParseCertificate([]byte(certificateDerData))
+		if err != nil {
+			return CredentialProcessOutput{}, err
+		}
+	}
+	if opts.CertificateBundleId != "" {
+		certificateBundle, err := ReadCertificateBundleData(opts.CertificateBundleId)
+		if err != nil {
+			return CredentialProcessOutput{}, err
+		}
+		certificateChain = append(certificateChain, certificateBundle...)
+	}
+
+	signer, err := getSigner(privateKey)
+	if err != nil {
+		return CredentialProcessOutput{}, err
+	}
+	rolesAnywhereSigner, err := NewRolesAnywhereSigner(signer, certificate, certificateChain)
+	if err != nil {
+		return CredentialProcessOutput{}, err
+	}
+	return GenerateCredentialsWithSignerWithContext(ctx, opts, rolesAnywhereSigner)
+}
+
+// Function to create session and generate credentials, using the provided signer
+// instead of the private key and certificates referenced by opts
+func GenerateCredentialsWithSigner(opts *CredentialsOpts, signer *RolesAnywhereSigner) (CredentialProcessOutput, error) {
+	return GenerateCredentialsWithSignerWithContext(context.Background(), opts, signer)
+}
+
+// Same as GenerateCredentialsWithSigner, with a context that cancels the call
+// to CreateSession when it's done
+func GenerateCredentialsWithSignerWithContext(ctx context.Context, opts *CredentialsOpts, signer *RolesAnywhereSigner) (CredentialProcessOutput, error) {
 	// assign values to region and endpoint if they haven't already been assigned
 	trustAnchorArn, err := arn.Parse(opts.TrustAnchorArnStr)
 	if err != nil {
@@ -56,32 +154,21 @@ func GenerateCredentials(opts *CredentialsOpts) (CredentialProcessOutput, error)
 		opts.Region = trustAnchorArn.Region
 	}
 
-	privateKey, err := ReadPrivateKeyData(opts.PrivateKeyId)
+	durationSeconds, err := getSessionDuration(opts)
 	if err != nil {
 		return CredentialProcessOutput{}, err
 	}
-	certificateData, err := ReadCertificateData(opts.CertificateId)
-	if err != nil {
-		return CredentialProcessOutput{}, err
-	}
-	certificateDerData, err := base64.StdEncoding.DecodeString(certificateData.CertificateData)
-	if err != nil {
-		return CredentialProcessOutput{}, err
+	var sessionName *string
+	if opts.RoleSessionName != "" {
+		if !roleSessionNameRegex.MatchString(opts.RoleSessionName) {
+			return CredentialProcessOutput{}, errors.New("role session name must be 2 to 64 characters long and may only contain alphanumeric characters and the characters _+=,.@-")
+		}
+		sessionName = &opts.RoleSessionName
 	}
-	certificate, err := x509.ParseCertificate([]byte(certificateDerData))
+	instanceProperties, err := getInstanceProperties(opts)
 	if err != nil {
 		return CredentialProcessOutput{}, err
 	}
-	var certificateChain []x509.Certificate
-	if opts.CertificateBundleId != "" {
-		certificateChainPointers, err := ReadCertificateBundleData(opts.CertificateBundleId)
-		if err != nil {
-			return CredentialProcessOutput{}, err
-		}
-		for _, certificate := range certificateChainPointers {
-			certificateChain = append(certificateChain, *certificate)
-		}
-	}
 
 	mySession := session.Must(session.NewSession())
 
@@ -104,7 +191,8 @@ func GenerateCredentials(opts *CredentialsOpts) (CredentialProcessOutput, error)
 		}
 	}
 	client := &http.Client{Transport: tr}
-	config := aws.NewConfig().WithRegion(opts.Region).WithHTTPClient(client).WithLogLevel(logLevel)
+	// Retries are handled by createSessionWithRetries rather than by the SDK
+	config := aws.NewConfig().WithRegion(opts.Region).WithHTTPClient(client).WithLogLevel(logLevel).WithMaxRetries(0)
 	if opts.Endpoint != "" {
 		config.WithEndpoint(opts.Endpoint)
 	}
@@ -112,19 +200,26 @@ func GenerateCredentials(opts *CredentialsOpts) (CredentialProcessOutput, error)
 	rolesAnywhereClient.Handlers.Build.RemoveByName("core.SDKVersionUserAgentHandler")
 	rolesAnywhereClient.Handlers.Build.PushBackNamed(request.NamedHandler{Name: "v4x509.CredHelperUserAgentHandler", Fn: request.MakeAddToUserAgentHandler("CredHelper", opts.Version, runtime.Version(), runtime.GOOS, runtime.GOARCH)})
 	rolesAnywhereClient.Handlers.Sign.Clear()
-	rolesAnywhereClient.Handlers.Sign.PushBackNamed(request.NamedHandler{Name: "v4x509.SignRequestHandler", Fn: CreateSignFunction(privateKey, *certificate, certificateChain)})
+	rolesAnywhereClient.Handlers.Sign.PushBackNamed(request.NamedHandler{Name: "v4x509.SignRequestHandler", Fn: signer.SignFunction()})
 
-	durationSeconds := int64(3600)
+	certificateData := certificateToString(signer.Certificate)
 	createSessionRequest := CreateSessionInput{
-		Cert:               &certificateData.CertificateData,
+		Cert:               &certificateData,
 		ProfileArn:         &opts.ProfileArnStr,
 		TrustAnchorArn:     &opts.TrustAnchorArnStr,
 		DurationSeconds:    &(durationSeconds),
-		InstanceProperties: nil,
+		InstanceProperties: instanceProperties,
 		RoleArn:            &opts.RoleArn,
-		SessionName:        nil,
+		SessionName:        sessionName,
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
 	}
-	output, err := rolesAnywhereClient.CreateSession(&createSessionRequest)
+	output, err := createSessionWithRetries(ctx, opts.RetryPolicy, func() (*CreateSessionOutput, error) {
+		return rolesAnywhereClient.CreateSessionWithContext(ctx, &createSessionRequest)
+	})
 	if err != nil {
 		return CredentialProcessOutput{}, err
 	}
@@ -144,6 +239,18 @@ func GenerateCredentials(opts *CredentialsOpts) (CredentialProcessOutput, error)
 	return credentialProcessOutput, nil
 }
 
+// Obtain the duration of the session to request, validating it against the
+// bounds accepted by CreateSession. A zero duration selects the default.
+func getSessionDuration(opts *CredentialsOpts) (int64, error) {
+	if opts.SessionDuration == 0 {
+		return DefaultSessionDuration, nil
+	}
+	if opts.SessionDuration < MinSessionDuration || opts.SessionDuration > MaxSessionDuration {
+		return 0, fmt.Errorf("session duration must be between %d and %d seconds", MinSessionDuration, MaxSessionDuration)
+	}
+	return int64(opts.SessionDuration), nil
+}
+
 // CreateSessionRequest generates a "aws/request.Request" representing the
 // client's request for the CreateSession operation. The "output" return
 // value will be populated with the request's response once the request completes
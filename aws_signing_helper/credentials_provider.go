@@ -0,0 +1,160 @@
+package aws_signing_helper
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Name of the provider, as reported in the credentials' source
+const RolesAnywhereProviderName = "RolesAnywhereProvider"
+
+// Default amount of time before the credentials expire at which they are
+// considered expired, so that they are refreshed ahead of time
+var DefaultExpiryWindow = time.Minute * time.Duration(5)
+
+// Credentials provider for aws-sdk-go (v1) that obtains temporary credentials
+// from Roles Anywhere. It is safe for concurrent use.
+//
+// Example:
+//
+//	provider := helper.NewRolesAnywhereProvider(opts)
+//	sess := session.Must(session.NewSession(aws.NewConfig().WithCredentials(credentials.NewCredentials(provider))))
+type RolesAnywhereProvider struct {
+	credentials.Expiry
+
+	// Amount of time before the credentials expire at which they are
+	// considered expired
+	ExpiryWindow time.Duration
+
+	opts                CredentialsOpts
+	mutex               sync.Mutex
+	generateCredentials func(context.Context, *CredentialsOpts) (CredentialProcessOutput, error)
+}
+
+// Credentials provider for aws-sdk-go-v2 that obtains temporary credentials
+// from Roles Anywhere. Credentials are cached until they are within the expiry
+// window of expiring. It is safe for concurrent use.
+//
+// Example:
+//
+//	provider := helper.NewRolesAnywhereProviderV2(opts)
+//	cfg, err := config.LoadDefaultConfig(ctx, config.WithCredentialsProvider(provider))
+type RolesAnywhereProviderV2 struct {
+	// Amount of time before the credentials expire at which they are
+	// considered expired
+	ExpiryWindow time.Duration
+
+	opts                CredentialsOpts
+	mutex               sync.Mutex
+	cached              awsv2.Credentials
+	generateCredentials func(context.Context, *CredentialsOpts) (CredentialProcessOutput, error)
+}
+
+// Creates a credentials provider for aws-sdk-go (v1). Options can be used to
+// modify the provider, for example to change its expiry window.
+func NewRolesAnywhereProvider(opts CredentialsOpts, options ...func(*RolesAnywhereProvider)) *RolesAnywhereProvider {
+	provider := &RolesAnywhereProvider{
+		ExpiryWindow:        DefaultExpiryWindow,
+		opts:                opts,
+		generateCredentials: GenerateCredentialsWithContext,
+	}
+	for _, option := range options {
+		option(provider)
+	}
+	return provider
+}
+
+// Creates a credentials provider for aws-sdk-go-v2. Options can be used to
+// modify the provider, for example to change its expiry window.
+func NewRolesAnywhereProviderV2(opts CredentialsOpts, options ...func(*RolesAnywhereProviderV2)) *RolesAnywhereProviderV2 {
+	provider := &RolesAnywhereProviderV2{
+		ExpiryWindow:        DefaultExpiryWindow,
+		opts:                opts,
+		generateCredentials: GenerateCredentialsWithContext,
+	}
+	for _, option := range options {
+		option(provider)
+	}
+	return provider
+}
+
+// Obtains new temporary credentials from Roles Anywhere
+func (p *RolesAnywhereProvider) Retrieve() (credentials.Value, error) {
+	return p.RetrieveWithContext(context.Background())
+}
+
+// Obtains new temporary credentials from Roles Anywhere, giving up when the
+// context is done
+func (p *RolesAnywhereProvider) RetrieveWithContext(ctx credentials.Context) (credentials.Value, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	credentialProcessOutput, err := p.generateCredentials(ctx, &p.opts)
+	if err != nil {
+		return credentials.Value{ProviderName: RolesAnywhereProviderName}, err
+	}
+	expiration, err := time.Parse(time.RFC3339, credentialProcessOutput.Expiration)
+	if err != nil {
+		return credentials.Value{ProviderName: RolesAnywhereProviderName}, err
+	}
+	p.SetExpiration(expiration, p.ExpiryWindow)
+
+	return credentials.Value{
+		AccessKeyID:     credentialProcessOutput.AccessKeyId,
+		SecretAccessKey: credentialProcessOutput.SecretAccessKey,
+		SessionToken:    credentialProcessOutput.SessionToken,
+		ProviderName:    RolesAnywhereProviderName,
+	}, nil
+}
+
+// Checks whether the credentials that were last retrieved have expired
+func (p *RolesAnywhereProvider) IsExpired() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.Expiry.IsExpired()
+}
+
+// Obtains the time at which the credentials that were last retrieved expire
+func (p *RolesAnywhereProvider) ExpiresAt() time.Time {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.Expiry.ExpiresAt()
+}
+
+// Obtains temporary credentials from Roles Anywhere, reusing the cached ones
+// if they aren't within the expiry window of expiring
+func (p *RolesAnywhereProviderV2) Retrieve(ctx context.Context) (awsv2.Credentials, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.cached.HasKeys() && time.Now().Add(p.ExpiryWindow).Before(p.cached.Expires) {
+		return p.cached, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return awsv2.Credentials{}, err
+	}
+
+	credentialProcessOutput, err := p.generateCredentials(ctx, &p.opts)
+	if err != nil {
+		return awsv2.Credentials{}, err
+	}
+	expiration, err := time.Parse(time.RFC3339, credentialProcessOutput.Expiration)
+	if err != nil {
+		return awsv2.Credentials{}, err
+	}
+
+	p.cached = awsv2.Credentials{
+		AccessKeyID:     credentialProcessOutput.AccessKeyId,
+		SecretAccessKey: credentialProcessOutput.SecretAccessKey,
+		SessionToken:    credentialProcessOutput.SessionToken,
+		Source:          RolesAnywhereProviderName,
+		CanExpire:       true,
+		Expires:         expiration,
+	}
+	return p.cached, nil
+}
@@ -0,0 +1,190 @@
+package aws_signing_helper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// Environment variables that point SDKs to credentials, which are removed
+// from the environment of the child, so that they don't take precedence over
+// the credentials it's given
+var credentialsEnvVars = []string{
+	"AWS_ACCESS_KEY_ID",
+	"AWS_SECRET_ACCESS_KEY",
+	"AWS_SESSION_TOKEN",
+	"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI",
+	"AWS_CONTAINER_CREDENTIALS_FULL_URI",
+	"AWS_CONTAINER_AUTHORIZATION_TOKEN",
+	"AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE",
+}
+
+// Environment variables that select a profile of the shared configuration
+// files, which are removed from the environment of a child that's served
+// credentials through an endpoint, since SDKs look at the profile first
+var profileEnvVars = []string{
+	"AWS_PROFILE",
+	"AWS_DEFAULT_PROFILE",
+}
+
+// Options of Exec
+type ExecOpts struct {
+	// Whether the child obtains its credentials from a private endpoint,
+	// which keeps them fresh, rather than from static environment variables
+	WithMetadataEndpoint bool
+}
+
+// Runs a command with credentials for opts, and returns its exit code (or
+// 128 plus the number of the signal that terminated it). By default, the
+// credentials are passed in AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN, and don't outlive the session. With WithMetadataEndpoint,
+// they're instead served to the child (and only the child, which is given a
+// random authorization token) through an ECS-compatible endpoint on the
+// loopback interface, and refreshed ahead of their expiry. Since SDKs look at
+// the shared credentials file before the endpoint, AWS_PROFILE and
+// AWS_DEFAULT_PROFILE are then removed, and AWS_SHARED_CREDENTIALS_FILE points
+// to an empty file, so that a default profile doesn't take precedence over the
+// endpoint. AWS_REGION is set in both cases. Signals received while the command runs are forwarded to it,
+// except for those that the terminal already sends to it (such as SIGINT on
+// Ctrl+C), which are ignored.
+func Exec(ctx context.Context, opts CredentialsOpts, execOpts ExecOpts, command []string) (int, error) {
+	return execWithCredentials(ctx, opts, execOpts, command, GenerateCredentialsWithContext)
+}
+
+func execWithCredentials(ctx context.Context, opts CredentialsOpts, execOpts ExecOpts, command []string, generateCredentials func(context.Context, *CredentialsOpts) (CredentialProcessOutput, error)) (int, error) {
+	if len(command) == 0 {
+		return 0, errors.New("no command to run")
+	}
+
+	env := removeEnvVars(os.Environ(), credentialsEnvVars)
+	if execOpts.WithMetadataEndpoint {
+		refresher := NewCredentialsRefresher(opts)
+		refresher.generateCredentials = generateCredentials
+		if err := refresher.RefreshWithContext(ctx); err != nil {
+			return 0, err
+		}
+		opts.Region = refresher.opts.Region
+		// The endpoint serves the child until it exits, even when the helper
+		// is asked to stop and forwards that to the child
+		endpointCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go refresher.Run(endpointCtx)
+
+		endpointEnv, closeEndpoint, err := startExecEndpoint(refresher, opts.RoleArn)
+		if err != nil {
+			return 0, err
+		}
+		defer closeEndpoint()
+		env = append(env, endpointEnv...)
+
+		credentialsFile, err := ioutil.TempFile("", "rolesanywhere-exec-credentials-*")
+		if err != nil {
+			return 0, err
+		}
+		credentialsFile.Close()
+		defer os.Remove(credentialsFile.Name())
+		env = removeEnvVars(env, append(profileEnvVars, "AWS_SHARED_CREDENTIALS_FILE"))
+		env = append(env, "AWS_SHARED_CREDENTIALS_FILE="+credentialsFile.Name())
+	} else {
+		credentialProcessOutput, err := generateCredentials(ctx, &opts)
+		if err != nil {
+			return 0, err
+		}
+		env = append(env,
+			"AWS_ACCESS_KEY_ID="+credentialProcessOutput.AccessKeyId,
+			"AWS_SECRET_ACCESS_KEY="+credentialProcessOutput.SecretAccessKey,
+			"AWS_SESSION_TOKEN="+credentialProcessOutput.SessionToken)
+	}
+	env = append(removeEnvVars(env, []string{"AWS_REGION"}), "AWS_REGION="+opts.Region)
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+	defer signal.Stop(signals)
+	ignored := make(chan os.Signal, 1)
+	signal.Notify(ignored, ignoredSignals...)
+	defer signal.Stop(ignored)
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				cmd.Process.Signal(sig)
+			case <-ignored:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal()), nil
+		}
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
+
+// Starts the private ECS-compatible endpoint of a child on a random loopback
+// port, and returns the environment variables that point the child to it,
+// along with a function that stops it
+func startExecEndpoint(refresher *CredentialsRefresher, roleArn string) ([]string, func(), error) {
+	token, err := GenerateToken(100)
+	if err != nil {
+		return nil, nil, err
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", LocalHostAddress, 0))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serveOpts := &ServeOpts{Mode: EcsServeMode, AuthorizationToken: token}
+	mux := http.NewServeMux()
+	mux.HandleFunc(ECS_CREDENTIALS_RESOURCE_PATH, EcsCredentialsHandler(refresher, roleArn, serveOpts))
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+
+	env := []string{
+		fmt.Sprintf("AWS_CONTAINER_CREDENTIALS_FULL_URI=http://%s%s", listener.Addr().String(), ECS_CREDENTIALS_RESOURCE_PATH),
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN=" + token,
+	}
+	return env, func() { server.Close() }, nil
+}
+
+// Returns the environment without the given variables
+func removeEnvVars(env []string, names []string) []string {
+	var filtered []string
+	for _, variable := range env {
+		removed := false
+		for _, name := range names {
+			if strings.HasPrefix(variable, name+"=") {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			filtered = append(filtered, variable)
+		}
+	}
+	return filtered
+}
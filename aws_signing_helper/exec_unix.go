@@ -0,0 +1,25 @@
+//go:build !windows
+
+package aws_signing_helper
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signals that Exec forwards to the child
+var forwardedSignals = []os.Signal{
+	syscall.SIGTERM,
+	syscall.SIGHUP,
+	syscall.SIGUSR1,
+	syscall.SIGUSR2,
+	syscall.SIGWINCH,
+}
+
+// Signals that Exec catches without forwarding them. The terminal sends them
+// to the whole foreground process group, which the child is part of, so
+// forwarding them would deliver them to the child twice.
+var ignoredSignals = []os.Signal{
+	os.Interrupt,
+	syscall.SIGQUIT,
+}
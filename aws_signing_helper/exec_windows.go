@@ -0,0 +1,15 @@
+//go:build windows
+
+package aws_signing_helper
+
+import (
+	"os"
+)
+
+// Signals that Exec forwards to the child
+var forwardedSignals = []os.Signal{}
+
+// Signals that Exec catches without forwarding them. Console control events
+// already reach the child, which shares the console, so Ctrl+C is only caught
+// to keep the helper running until the child exits.
+var ignoredSignals = []os.Signal{os.Interrupt}
@@ -0,0 +1,107 @@
+package aws_signing_helper
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Runs fn while holding an exclusive lock on the file at lockPath, which is
+// created if it doesn't exist. The lock is advisory: it only excludes other
+// processes that lock the same file.
+func withFileLock(lockPath string, fn func() error) error {
+	lockFile, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer lockFile.Close()
+
+	if err := lockFileExclusive(lockFile); err != nil {
+		return fmt.Errorf("unable to lock %s: %w", lockPath, err)
+	}
+	defer unlockFile(lockFile)
+	return fn()
+}
+
+// Replaces the contents of the file at path in a single step, by writing them
+// to a temporary file in the same directory and renaming it over the file.
+// Readers see either the previous contents or the new ones, never a partial write.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return writeFileAtomicWith(path, data, func(tmpFile *os.File) error {
+		return tmpFile.Chmod(perm)
+	})
+}
+
+// Same as writeFileAtomic, but an existing file keeps its mode and owner;
+// perm only applies to a new file. Symbolic links are followed, so that the
+// file they point to is replaced rather than the link. If the directory isn't
+// writable, so that no temporary file can be created next to the file, it's
+// rewritten in place instead. Any other error (such as the owner of the file
+// not being able to be kept) is returned, and the file is left as it was.
+func replaceFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if resolvedPath, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolvedPath
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return writeFileAtomic(path, data, perm)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomicWith(path, data, func(tmpFile *os.File) error {
+		if err := tmpFile.Chmod(info.Mode().Perm()); err != nil {
+			return err
+		}
+		return chownLike(tmpFile, info)
+	})
+	if errors.Is(err, os.ErrPermission) && !isDirWritable(filepath.Dir(path)) {
+		log.Printf("unable to replace %s atomically (%s), rewriting it in place", path, err)
+		return ioutil.WriteFile(path, data, perm)
+	}
+	return err
+}
+
+// Checks whether files can be created in the directory, by creating (and
+// removing) an empty temporary file in it
+func isDirWritable(dir string) bool {
+	tmpFile, err := ioutil.TempFile(dir, ".write-test-*")
+	if err != nil {
+		return false
+	}
+	tmpFile.Close()
+	os.Remove(tmpFile.Name())
+	return true
+}
+
+// Writes the data to a temporary file next to path, which prepare can set
+// the mode and owner of, and renames it to path once it's on disk
+func writeFileAtomicWith(path string, data []byte, prepare func(*os.File) error) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
+
+	if err := prepare(tmpFile); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+
+package aws_signing_helper
+
+import (
+	"os"
+	"syscall"
+)
+
+// Blocks until an exclusive lock on the file is acquired
+func lockFileExclusive(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+}
+
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
+
+// Gives the file the owner and group described by info, unless it already has them
+func chownLike(file *os.File, info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if fileStat, ok := fileInfo.Sys().(*syscall.Stat_t); ok && fileStat.Uid == stat.Uid && fileStat.Gid == stat.Gid {
+		return nil
+	}
+	return file.Chown(int(stat.Uid), int(stat.Gid))
+}
@@ -0,0 +1,24 @@
+//go:build windows
+
+package aws_signing_helper
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// Blocks until an exclusive lock on the first byte of the file is acquired
+func lockFileExclusive(file *os.File) error {
+	return windows.LockFileEx(windows.Handle(file.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, &windows.Overlapped{})
+}
+
+func unlockFile(file *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, &windows.Overlapped{})
+}
+
+// Files inherit their access control list from their directory on Windows,
+// so there is no owner to carry over
+func chownLike(file *os.File, info os.FileInfo) error {
+	return nil
+}
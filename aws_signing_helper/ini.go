@@ -0,0 +1,217 @@
+package aws_signing_helper
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+)
+
+// INI files
+//
+// Model of INI files such as the shared credentials and config files, which
+// keeps every line it isn't asked to change as is: comments, blank lines,
+// unknown keys, and the order of sections and keys. Section headers may have
+// whitespace around their name (`[ default ]`), and keys may be written with
+// or without whitespace around the equal sign. Indented lines that follow a
+// key are continuation lines (such as the nested settings of the config file),
+// and are never mistaken for keys of the section. Files with CRLF line endings
+// (as written by Windows editors) keep them.
+
+// An INI file, made of the lines before its first section and its sections
+type IniFile struct {
+	preamble   []iniLine
+	sections   []*IniSection
+	lineEnding string
+}
+
+// A section of an INI file
+type IniSection struct {
+	// Name of the section, without brackets nor surrounding whitespace
+	Name   string
+	header string
+	lines  []iniLine
+}
+
+// A line of an INI file. Comments, blank lines and continuation lines have no key.
+type iniLine struct {
+	raw   string
+	key   string
+	value string
+}
+
+// Parses an INI file
+func ParseIni(r io.Reader) (*IniFile, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Split(scanIniLines)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ParseIniLines(lines), nil
+}
+
+// Split function for a bufio.Scanner that splits an INI file into lines. Unlike
+// bufio.ScanLines, it keeps the carriage return of CRLF line endings, so that
+// ParseIniLines can tell which line endings the file uses.
+func scanIniLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// Parses the lines of an INI file. If the lines end with a carriage return
+// (as CRLF lines split on LF do), the file keeps CRLF line endings.
+func ParseIniLines(lines []string) *IniFile {
+	file := &IniFile{lineEnding: "\n"}
+	for _, raw := range lines {
+		if strings.HasSuffix(raw, "\r") {
+			file.lineEnding = "\r\n"
+			break
+		}
+	}
+
+	var section *IniSection
+	inKey := false
+	for _, raw := range lines {
+		raw = strings.TrimSuffix(raw, "\r")
+		line := iniLine{raw: raw}
+		trimmed := strings.TrimSpace(raw)
+		switch {
+		case trimmed == "" || isIniComment(raw):
+			inKey = false
+		case strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]"):
+			section = &IniSection{
+				Name:   strings.TrimSpace(trimmed[1 : len(trimmed)-1]),
+				header: raw,
+			}
+			file.sections = append(file.sections, section)
+			inKey = false
+			continue
+		case inKey && (strings.HasPrefix(raw, " ") || strings.HasPrefix(raw, "\t")):
+			// Continuation of the previous key
+		default:
+			if parts := strings.SplitN(trimmed, "=", 2); len(parts) == 2 {
+				line.key = strings.TrimSpace(parts[0])
+				line.value = strings.TrimSpace(parts[1])
+				inKey = true
+			}
+		}
+
+		if section == nil {
+			file.preamble = append(file.preamble, line)
+		} else {
+			section.lines = append(section.lines, line)
+		}
+	}
+	return file
+}
+
+// Returns the first section with the given name, or nil if there is none
+func (file *IniFile) Section(name string) *IniSection {
+	for _, section := range file.sections {
+		if section.Name == name {
+			return section
+		}
+	}
+	return nil
+}
+
+// Returns the first section with the given name, adding an empty one at the
+// end of the file if there is none. A new section is separated from the
+// previous contents by a blank line.
+func (file *IniFile) GetOrAddSection(name string) *IniSection {
+	if section := file.Section(name); section != nil {
+		return section
+	}
+	if lines := file.Lines(); len(lines) != 0 && strings.TrimSpace(lines[len(lines)-1]) != "" {
+		if len(file.sections) == 0 {
+			file.preamble = append(file.preamble, iniLine{})
+		} else {
+			lastSection := file.sections[len(file.sections)-1]
+			lastSection.lines = append(lastSection.lines, iniLine{})
+		}
+	}
+	section := &IniSection{Name: name, header: "[" + name + "]"}
+	file.sections = append(file.sections, section)
+	return section
+}
+
+// Returns the line ending of the file: "\r\n" if it was read with CRLF line
+// endings, and "\n" otherwise
+func (file *IniFile) LineEnding() string {
+	if file.lineEnding == "" {
+		return "\n"
+	}
+	return file.lineEnding
+}
+
+// Returns the lines of the file, without their line endings
+func (file *IniFile) Lines() []string {
+	var lines []string
+	for _, line := range file.preamble {
+		lines = append(lines, line.raw)
+	}
+	for _, section := range file.sections {
+		lines = append(lines, section.header)
+		for _, line := range section.lines {
+			lines = append(lines, line.raw)
+		}
+	}
+	return lines
+}
+
+// Returns the value of the key in the section. If the key occurs more than
+// once, the last occurrence wins, as it does for SDKs.
+func (section *IniSection) Get(key string) (string, bool) {
+	for i := len(section.lines) - 1; i >= 0; i-- {
+		if section.lines[i].key == key {
+			return section.lines[i].value, true
+		}
+	}
+	return "", false
+}
+
+// Sets the value of the key. Every occurrence of the key is replaced in
+// place, so that a duplicate key can't shadow the new value; a new key is
+// added after the last key of the section, so that comments and blank lines
+// that precede the next section stay with it.
+func (section *IniSection) Set(key string, value string) {
+	line := iniLine{raw: key + " = " + value, key: key, value: value}
+	found := false
+	for i := range section.lines {
+		if section.lines[i].key == key {
+			section.lines[i] = line
+			found = true
+		}
+	}
+	if found {
+		return
+	}
+
+	insertAt := 0
+	for i, existing := range section.lines {
+		if strings.TrimSpace(existing.raw) != "" && !isIniComment(existing.raw) {
+			insertAt = i + 1
+		}
+	}
+	section.lines = append(section.lines, iniLine{})
+	copy(section.lines[insertAt+1:], section.lines[insertAt:])
+	section.lines[insertAt] = line
+}
+
+// Checks whether a line is a comment
+func isIniComment(raw string) bool {
+	trimmed := strings.TrimSpace(raw)
+	return strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, ";")
+}
@@ -0,0 +1,55 @@
+package aws_signing_helper
+
+import (
+	"errors"
+	"os"
+	"runtime"
+)
+
+// Names of the instance properties that are filled in from the local system
+const (
+	HostnameInstanceProperty     = "hostname"
+	OSInstanceProperty           = "os"
+	ArchitectureInstanceProperty = "arch"
+)
+
+// Obtains the standard instance properties describing the local system
+func GetSystemInstanceProperties() (map[string]string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, errors.New("unable to determine the hostname")
+	}
+	return map[string]string{
+		HostnameInstanceProperty:     hostname,
+		OSInstanceProperty:           runtime.GOOS,
+		ArchitectureInstanceProperty: runtime.GOARCH,
+	}, nil
+}
+
+// Builds the instance properties to send in the CreateSession request. Properties
+// that are explicitly provided take precedence over those read from the system.
+func getInstanceProperties(opts *CredentialsOpts) (map[string]*string, error) {
+	instanceProperties := make(map[string]*string)
+	if opts.WithSystemInstanceProperties {
+		systemInstanceProperties, err := GetSystemInstanceProperties()
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range systemInstanceProperties {
+			value := value
+			instanceProperties[key] = &value
+		}
+	}
+	for key, value := range opts.InstanceProperties {
+		if key == "" {
+			return nil, errors.New("instance property keys must not be empty")
+		}
+		value := value
+		instanceProperties[key] = &value
+	}
+
+	if len(instanceProperties) == 0 {
+		return nil, nil
+	}
+	return instanceProperties, nil
+}
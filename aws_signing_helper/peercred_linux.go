@@ -0,0 +1,35 @@
+//go:build linux
+
+package aws_signing_helper
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Obtains the credentials of the process on the other end of a Unix domain
+// socket connection through SO_PEERCRED
+func getPeerCredentials(conn net.Conn) (PeerCredentials, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return PeerCredentials{}, errors.New("peer credentials are only available for unix socket connections")
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return PeerCredentials{}, err
+	}
+
+	var ucred *syscall.Ucred
+	var ucredErr error
+	err = rawConn.Control(func(fd uintptr) {
+		ucred, ucredErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return PeerCredentials{}, err
+	}
+	if ucredErr != nil {
+		return PeerCredentials{}, ucredErr
+	}
+	return PeerCredentials{Pid: ucred.Pid, Uid: ucred.Uid, Gid: ucred.Gid}, nil
+}
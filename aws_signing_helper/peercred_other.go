@@ -0,0 +1,13 @@
+//go:build !linux
+
+package aws_signing_helper
+
+import (
+	"errors"
+	"net"
+)
+
+// SO_PEERCRED is only available on Linux
+func getPeerCredentials(conn net.Conn) (PeerCredentials, error) {
+	return PeerCredentials{}, errors.New("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,39 @@
+//go:build !cgo
+
+package aws_signing_helper
+
+import (
+	"crypto"
+	"errors"
+	"io"
+)
+
+// The PKCS#11 module is loaded through cgo, so PKCS#11 URIs can't be used in
+// builds without it
+var errPKCS11RequiresCgo = errors.New("PKCS#11 support requires cgo")
+
+// Signer that delegates signing operations to a private key that is stored
+// on a PKCS#11 token. It can't be created in builds without cgo.
+type PKCS11Signer struct{}
+
+// Creates a signer for the private key referenced by the PKCS#11 URI
+func GetPKCS11Signer(privateKeyURI string) (*PKCS11Signer, error) {
+	return nil, errPKCS11RequiresCgo
+}
+
+// Reads the DER-encoded certificate referenced by the PKCS#11 URI
+func readPKCS11CertificateDER(certificateURI string) ([]byte, error) {
+	return nil, errPKCS11RequiresCgo
+}
+
+func (signer *PKCS11Signer) Public() crypto.PublicKey {
+	return nil
+}
+
+func (signer *PKCS11Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return nil, errPKCS11RequiresCgo
+}
+
+func (signer *PKCS11Signer) Close() error {
+	return nil
+}
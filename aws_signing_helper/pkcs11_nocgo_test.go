@@ -0,0 +1,17 @@
+//go:build !cgo
+
+package aws_signing_helper
+
+import "testing"
+
+func TestPKCS11RequiresCgo(t *testing.T) {
+	uri := "pkcs11:token=roles-anywhere;object=rsa-2048?module-path=/usr/lib/softhsm/libsofthsm2.so"
+	if _, err := ReadPrivateKeyData(uri); err != errPKCS11RequiresCgo {
+		t.Logf("expected %q reading a private key, got %v", errPKCS11RequiresCgo, err)
+		t.Fail()
+	}
+	if _, err := ReadCertificateData(uri); err != errPKCS11RequiresCgo {
+		t.Logf("expected %q reading a certificate, got %v", errPKCS11RequiresCgo, err)
+		t.Fail()
+	}
+}
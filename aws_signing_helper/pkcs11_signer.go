@@ -0,0 +1,567 @@
+//go:build cgo
+
+package aws_signing_helper
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/miekg/pkcs11"
+)
+
+// DigestInfo prefixes that have to be prepended to the digest when signing
+// with CKM_RSA_PKCS, since that mechanism doesn't hash the input itself.
+var pkcs11RSADigestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// Hash mechanisms and mask generation functions of CKM_RSA_PKCS_PSS, for each digest
+var pkcs11PSSHashes = map[crypto.Hash][2]uint{
+	crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256},
+	crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384},
+	crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512},
+}
+
+// PKCS#11 modules that are in use, by path. C_Finalize tears down every
+// session of the process on a module, and C_Logout logs out every session on
+// a token, so a module is shared by all the sessions opened on it, and is
+// only finalized (and a token only logged out of) once the last of them is
+// closed, by the opener that initialized it (or logged in).
+var pkcs11Modules = struct {
+	sync.Mutex
+	byPath map[string]*sharedPKCS11Module
+	byCtx  map[*pkcs11.Ctx]*sharedPKCS11Module
+}{
+	byPath: make(map[string]*sharedPKCS11Module),
+	byCtx:  make(map[*pkcs11.Ctx]*sharedPKCS11Module),
+}
+
+// A PKCS#11 module shared by the sessions opened on it
+type sharedPKCS11Module struct {
+	path string
+	ctx  *pkcs11.Ctx
+	refs int
+	// Whether the module was initialized here, rather than by another
+	// library of the process, and so has to be finalized here
+	initialized bool
+	// Number of open sessions on each slot, and the slots that were logged in to here
+	slotSessions map[uint]int
+	loggedIn     map[uint]bool
+}
+
+// Signer that delegates signing operations to a private key that is stored
+// on a PKCS#11 token, such as an HSM or a smart card. The private key never
+// leaves the token.
+type PKCS11Signer struct {
+	module           *pkcs11.Ctx
+	session          pkcs11.SessionHandle
+	privateKeyHandle pkcs11.ObjectHandle
+	keyType          uint
+	publicKey        crypto.PublicKey
+	// Whether the key's allowed mechanisms restrict it to RSASSA-PSS signatures
+	pssOnlyKey bool
+}
+
+// Checks whether the token in the given slot matches the token attributes in the URI
+func (uri *pkcs11URI) matchesToken(module *pkcs11.Ctx, slot uint) (bool, error) {
+	if slotId, ok := uri.pathAttributes["slot-id"]; ok {
+		if strconv.FormatUint(uint64(slot), 10) != slotId {
+			return false, nil
+		}
+	}
+
+	tokenInfo, err := module.GetTokenInfo(slot)
+	if err != nil {
+		return false, err
+	}
+	tokenAttributes := map[string]string{
+		"token":        tokenInfo.Label,
+		"manufacturer": tokenInfo.ManufacturerID,
+		"serial":       tokenInfo.SerialNumber,
+		"model":        tokenInfo.Model,
+	}
+	for name, value := range tokenAttributes {
+		if expected, ok := uri.pathAttributes[name]; ok && expected != strings.TrimRight(value, " ") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Builds the template used to find objects of the given class on the token
+func (uri *pkcs11URI) objectTemplate(class uint) []*pkcs11.Attribute {
+	template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)}
+	if id, ok := uri.pathAttributes["id"]; ok {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(id)))
+	}
+	if label, ok := uri.pathAttributes["object"]; ok {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, label))
+	}
+	return template
+}
+
+// Loads the PKCS#11 module, or takes another reference to it if it's
+// already in use. Must be called with pkcs11Modules locked.
+func acquirePKCS11Module(modulePath string) (*sharedPKCS11Module, error) {
+	if shared, ok := pkcs11Modules.byPath[modulePath]; ok {
+		shared.refs++
+		return shared, nil
+	}
+
+	module := pkcs11.New(modulePath)
+	if module == nil {
+		return nil, fmt.Errorf("unable to load PKCS#11 module: %s", modulePath)
+	}
+	initialized := true
+	if err := module.Initialize(); err != nil {
+		if err != pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+			module.Destroy()
+			return nil, fmt.Errorf("unable to initialize PKCS#11 module: %w", err)
+		}
+		initialized = false
+	}
+	shared := &sharedPKCS11Module{
+		path:         modulePath,
+		ctx:          module,
+		refs:         1,
+		initialized:  initialized,
+		slotSessions: make(map[uint]int),
+		loggedIn:     make(map[uint]bool),
+	}
+	pkcs11Modules.byPath[modulePath] = shared
+	pkcs11Modules.byCtx[module] = shared
+	return shared, nil
+}
+
+// Drops a reference to the module, finalizing and unloading it when it was
+// the last one. Must be called with pkcs11Modules locked.
+func (shared *sharedPKCS11Module) release() {
+	shared.refs--
+	if shared.refs > 0 {
+		return
+	}
+	if shared.initialized {
+		shared.ctx.Finalize()
+	}
+	shared.ctx.Destroy()
+	delete(pkcs11Modules.byPath, shared.path)
+	delete(pkcs11Modules.byCtx, shared.ctx)
+}
+
+// Loads the PKCS#11 module referenced by the URI and opens a session on the
+// matching token, logging in if a PIN was provided
+func openPKCS11Session(uri *pkcs11URI) (*pkcs11.Ctx, pkcs11.SessionHandle, error) {
+	modulePath, ok := uri.queryAttributes["module-path"]
+	if !ok {
+		modulePath = defaultPKCS11Module
+	}
+	pkcs11Modules.Lock()
+	defer pkcs11Modules.Unlock()
+	shared, err := acquirePKCS11Module(modulePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	module := shared.ctx
+
+	slots, err := module.GetSlotList(true)
+	if err != nil {
+		shared.release()
+		return nil, 0, fmt.Errorf("unable to list PKCS#11 slots: %w", err)
+	}
+	var matchingSlots []uint
+	for _, slot := range slots {
+		matches, err := uri.matchesToken(module, slot)
+		if err != nil {
+			shared.release()
+			return nil, 0, fmt.Errorf("unable to read PKCS#11 token info: %w", err)
+		}
+		if matches {
+			matchingSlots = append(matchingSlots, slot)
+		}
+	}
+	if len(matchingSlots) == 0 {
+		shared.release()
+		return nil, 0, errors.New("no PKCS#11 token matches the provided URI")
+	}
+	if len(matchingSlots) > 1 {
+		shared.release()
+		return nil, 0, errors.New("PKCS#11 URI matches more than one token")
+	}
+	slot := matchingSlots[0]
+
+	session, err := module.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		shared.release()
+		return nil, 0, fmt.Errorf("unable to open PKCS#11 session: %w", err)
+	}
+
+	pin, hasPin, err := uri.pin()
+	if err != nil {
+		module.CloseSession(session)
+		shared.release()
+		return nil, 0, err
+	}
+	if hasPin {
+		err = module.Login(session, pkcs11.CKU_USER, pin)
+		if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+			module.CloseSession(session)
+			shared.release()
+			return nil, 0, fmt.Errorf("unable to log in to PKCS#11 token: %w", err)
+		}
+		if err == nil {
+			shared.loggedIn[slot] = true
+		}
+	}
+	shared.slotSessions[slot]++
+
+	return module, session, nil
+}
+
+// Finds the single object of the given class that matches the URI
+func findPKCS11Object(module *pkcs11.Ctx, session pkcs11.SessionHandle, uri *pkcs11URI, class uint) (pkcs11.ObjectHandle, error) {
+	if err := module.FindObjectsInit(session, uri.objectTemplate(class)); err != nil {
+		return 0, fmt.Errorf("unable to search PKCS#11 token: %w", err)
+	}
+	objects, _, err := module.FindObjects(session, 2)
+	module.FindObjectsFinal(session)
+	if err != nil {
+		return 0, fmt.Errorf("unable to search PKCS#11 token: %w", err)
+	}
+	if len(objects) == 0 {
+		return 0, errors.New("no PKCS#11 object matches the provided URI")
+	}
+	if len(objects) > 1 {
+		return 0, errors.New("PKCS#11 URI matches more than one object")
+	}
+	return objects[0], nil
+}
+
+// Reads the DER-encoded certificate referenced by the PKCS#11 URI
+func readPKCS11CertificateDER(certificateURI string) ([]byte, error) {
+	uri, err := parsePKCS11URI(certificateURI)
+	if err != nil {
+		return nil, err
+	}
+	module, session, err := openPKCS11Session(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer closePKCS11Session(module, session)
+
+	return findPKCS11CertificateDER(module, session, uri)
+}
+
+// Finds the DER-encoded certificate that matches the URI on an open session
+func findPKCS11CertificateDER(module *pkcs11.Ctx, session pkcs11.SessionHandle, uri *pkcs11URI) ([]byte, error) {
+	certificateHandle, err := findPKCS11Object(module, session, uri, pkcs11.CKO_CERTIFICATE)
+	if err != nil {
+		return nil, err
+	}
+	attributes, err := module.GetAttributeValue(session, certificateHandle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+	})
+	if err != nil || len(attributes) == 0 {
+		return nil, errors.New("unable to read certificate from PKCS#11 token")
+	}
+	return attributes[0].Value, nil
+}
+
+// Creates a signer for the private key referenced by the PKCS#11 URI
+func GetPKCS11Signer(privateKeyURI string) (*PKCS11Signer, error) {
+	uri, err := parsePKCS11URI(privateKeyURI)
+	if err != nil {
+		return nil, err
+	}
+	module, session, err := openPKCS11Session(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKeyHandle, err := findPKCS11Object(module, session, uri, pkcs11.CKO_PRIVATE_KEY)
+	if err != nil {
+		closePKCS11Session(module, session)
+		return nil, err
+	}
+	attributes, err := module.GetAttributeValue(session, privateKeyHandle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+	})
+	if err != nil || len(attributes) == 0 {
+		closePKCS11Session(module, session)
+		return nil, errors.New("unable to read private key type from PKCS#11 token")
+	}
+	keyType := pkcs11AttributeToUint(attributes[0].Value)
+	if keyType != pkcs11.CKK_RSA && keyType != pkcs11.CKK_EC {
+		closePKCS11Session(module, session)
+		return nil, errors.New("unsupported PKCS#11 private key type")
+	}
+
+	signer := &PKCS11Signer{
+		module:           module,
+		session:          session,
+		privateKeyHandle: privateKeyHandle,
+		keyType:          keyType,
+	}
+	if keyType == pkcs11.CKK_RSA {
+		attributes, err = module.GetAttributeValue(session, privateKeyHandle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_ALLOWED_MECHANISMS, nil),
+		})
+		// Tokens that don't support the attribute don't restrict the key
+		if err == nil && len(attributes) == 1 {
+			signer.pssOnlyKey = pkcs11MechanismsArePSSOnly(attributes[0].Value)
+		}
+	}
+	// A token that holds neither the certificate nor the public key isn't an
+	// error, since the certificate can also be provided separately.
+	signer.publicKey = findPKCS11PublicKey(module, session, uri, keyType)
+	return signer, nil
+}
+
+// Finds the public key that matches the URI on an open session, in the
+// certificate if the token holds one, or else in the public key object.
+// Returns nil if neither is on the token.
+func findPKCS11PublicKey(module *pkcs11.Ctx, session pkcs11.SessionHandle, uri *pkcs11URI, keyType uint) crypto.PublicKey {
+	if certificateDer, err := findPKCS11CertificateDER(module, session, uri); err == nil {
+		if certificate, err := x509.ParseCertificate(certificateDer); err == nil {
+			return certificate.PublicKey
+		}
+	}
+
+	publicKeyHandle, err := findPKCS11Object(module, session, uri, pkcs11.CKO_PUBLIC_KEY)
+	if err != nil {
+		return nil
+	}
+	switch keyType {
+	case pkcs11.CKK_RSA:
+		attributes, err := module.GetAttributeValue(session, publicKeyHandle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil || len(attributes) != 2 {
+			return nil
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attributes[0].Value),
+			E: int(new(big.Int).SetBytes(attributes[1].Value).Int64()),
+		}
+	case pkcs11.CKK_EC:
+		attributes, err := module.GetAttributeValue(session, publicKeyHandle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil || len(attributes) != 2 {
+			return nil
+		}
+		publicKey, err := parsePKCS11ECPublicKey(attributes[0].Value, attributes[1].Value)
+		if err != nil {
+			return nil
+		}
+		return publicKey
+	}
+	return nil
+}
+
+// Curves of EC keys, by the OID that CKA_EC_PARAMS holds
+var pkcs11Curves = map[string]elliptic.Curve{
+	"1.2.840.10045.3.1.7": elliptic.P256(),
+	"1.3.132.0.34":        elliptic.P384(),
+	"1.3.132.0.35":        elliptic.P521(),
+}
+
+// Builds an EC public key from its CKA_EC_PARAMS (the DER-encoded OID of the
+// curve) and CKA_EC_POINT attributes. CKA_EC_POINT is a DER-encoded OCTET
+// STRING that holds the uncompressed point, although some tokens return the
+// point itself.
+func parsePKCS11ECPublicKey(params []byte, point []byte) (*ecdsa.PublicKey, error) {
+	var curveOID asn1.ObjectIdentifier
+	if rest, err := asn1.Unmarshal(params, &curveOID); err != nil || len(rest) != 0 {
+		return nil, errors.New("unable to parse PKCS#11 EC parameters")
+	}
+	curve, ok := pkcs11Curves[curveOID.String()]
+	if !ok {
+		return nil, errors.New("unsupported PKCS#11 EC curve")
+	}
+
+	var encodedPoint []byte
+	if rest, err := asn1.Unmarshal(point, &encodedPoint); err == nil && len(rest) == 0 {
+		if x, y := elliptic.Unmarshal(curve, encodedPoint); x != nil {
+			return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+		}
+	}
+	if x, y := elliptic.Unmarshal(curve, point); x != nil {
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.New("unable to parse PKCS#11 EC point")
+}
+
+// Whether the host is little-endian, which is the byte order CK_ULONG
+// attribute values are returned in
+var pkcs11HostLittleEndian = func() bool {
+	value := uint16(1)
+	return *(*byte)(unsafe.Pointer(&value)) == 1
+}()
+
+// Size of a CK_ULONG, which is a C unsigned long: 32 bits long on Windows, and
+// as long as a pointer elsewhere
+var pkcs11ULongSize = func() int {
+	if runtime.GOOS == "windows" {
+		return 4
+	}
+	return int(unsafe.Sizeof(uintptr(0)))
+}()
+
+// Mechanisms that make RSASSA-PSS signatures
+var pkcs11PSSMechanisms = map[uint]bool{
+	pkcs11.CKM_RSA_PKCS_PSS:        true,
+	pkcs11.CKM_SHA1_RSA_PKCS_PSS:   true,
+	pkcs11.CKM_SHA224_RSA_PKCS_PSS: true,
+	pkcs11.CKM_SHA256_RSA_PKCS_PSS: true,
+	pkcs11.CKM_SHA384_RSA_PKCS_PSS: true,
+	pkcs11.CKM_SHA512_RSA_PKCS_PSS: true,
+}
+
+// Checks whether the value of a CKA_ALLOWED_MECHANISMS attribute (an array of
+// CK_MECHANISM_TYPE) allows PSS signatures, but not CKM_RSA_PKCS. An empty
+// array doesn't restrict the key.
+func pkcs11MechanismsArePSSOnly(value []byte) bool {
+	allowsPSS := false
+	for i := 0; i+pkcs11ULongSize <= len(value); i += pkcs11ULongSize {
+		mechanism := pkcs11AttributeToUint(value[i : i+pkcs11ULongSize])
+		if mechanism == pkcs11.CKM_RSA_PKCS {
+			return false
+		}
+		allowsPSS = allowsPSS || pkcs11PSSMechanisms[mechanism]
+	}
+	return allowsPSS
+}
+
+// Decodes a CK_ULONG attribute value, which the module returns in the host's
+// byte order. CK_ULONG is 32 bits long on some platforms (such as Windows),
+// so the value can be shorter than a uint.
+func pkcs11AttributeToUint(value []byte) uint {
+	var result uint
+	for i := range value {
+		if pkcs11HostLittleEndian {
+			result = result<<8 | uint(value[len(value)-1-i])
+		} else {
+			result = result<<8 | uint(value[i])
+		}
+	}
+	return result
+}
+
+// Closes the session, logging out of the token if it's the last session on
+// it and the token was logged in to here, and releases the module
+func closePKCS11Session(module *pkcs11.Ctx, session pkcs11.SessionHandle) {
+	pkcs11Modules.Lock()
+	defer pkcs11Modules.Unlock()
+	shared, ok := pkcs11Modules.byCtx[module]
+	if !ok {
+		return
+	}
+
+	if sessionInfo, err := module.GetSessionInfo(session); err == nil {
+		slot := sessionInfo.SlotID
+		shared.slotSessions[slot]--
+		if shared.slotSessions[slot] <= 0 {
+			delete(shared.slotSessions, slot)
+			if shared.loggedIn[slot] {
+				module.Logout(session)
+				delete(shared.loggedIn, slot)
+			}
+		}
+	}
+	module.CloseSession(session)
+	shared.release()
+}
+
+// Returns the public key corresponding to the private key on the token, from
+// the certificate or the public key object on the token, or nil if neither
+// could be found
+func (signer *PKCS11Signer) Public() crypto.PublicKey {
+	return signer.publicKey
+}
+
+func (signer *PKCS11Signer) pssOnly() bool {
+	return signer.pssOnlyKey
+}
+
+// Signs the digest with the private key on the token
+func (signer *PKCS11Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var mechanism *pkcs11.Mechanism
+	var message []byte
+	switch signer.keyType {
+	case pkcs11.CKK_RSA:
+		if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+			pssHash, ok := pkcs11PSSHashes[opts.HashFunc()]
+			if !ok {
+				return nil, errors.New("unsupported digest")
+			}
+			saltLength := pssOpts.SaltLength
+			if saltLength == rsa.PSSSaltLengthEqualsHash || saltLength == rsa.PSSSaltLengthAuto {
+				saltLength = opts.HashFunc().Size()
+			}
+			mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, pkcs11.NewPSSParams(pssHash[0], pssHash[1], uint(saltLength)))
+			message = digest
+			break
+		}
+		prefix, ok := pkcs11RSADigestInfoPrefixes[opts.HashFunc()]
+		if !ok {
+			return nil, errors.New("unsupported digest")
+		}
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+		message = append(append([]byte{}, prefix...), digest...)
+	case pkcs11.CKK_EC:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return nil, errors.New("PSS padding can only be used with RSA keys")
+		}
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)
+		message = digest
+	default:
+		return nil, errors.New("unsupported algorithm")
+	}
+
+	err := signer.module.SignInit(signer.session, []*pkcs11.Mechanism{mechanism}, signer.privateKeyHandle)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize PKCS#11 signing operation: %w", err)
+	}
+	sig, err := signer.module.Sign(signer.session, message)
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign with PKCS#11 token: %w", err)
+	}
+
+	if signer.keyType == pkcs11.CKK_EC {
+		// CKM_ECDSA returns r || s, whereas SigV4-X509 expects an ASN.1 signature
+		if len(sig)%2 != 0 {
+			return nil, errors.New("invalid ECDSA signature returned by PKCS#11 token")
+		}
+		half := len(sig) / 2
+		return asn1.Marshal(struct {
+			R, S *big.Int
+		}{
+			new(big.Int).SetBytes(sig[:half]),
+			new(big.Int).SetBytes(sig[half:]),
+		})
+	}
+	return sig, nil
+}
+
+// Releases the session on the token
+func (signer *PKCS11Signer) Close() error {
+	closePKCS11Session(signer.module, signer.session)
+	return nil
+}
@@ -0,0 +1,359 @@
+//go:build cgo
+
+package aws_signing_helper
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Finds the SoftHSM module, so that PKCS#11 tests can be run against it
+func findSoftHSMModule() string {
+	modulePaths := []string{
+		"/usr/lib/softhsm/libsofthsm2.so",
+		"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+		"/usr/lib/aarch64-linux-gnu/softhsm/libsofthsm2.so",
+		"/usr/lib64/pkcs11/libsofthsm2.so",
+		"/usr/local/lib/softhsm/libsofthsm2.so",
+		"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+	}
+	for _, modulePath := range modulePaths {
+		if _, err := os.Stat(modulePath); err == nil {
+			return modulePath
+		}
+	}
+	return ""
+}
+
+// Initializes a SoftHSM token labelled roles-anywhere, with PIN 1234, and
+// returns the path of the SoftHSM module. Tests that need it are skipped if
+// softhsm2-util and the SoftHSM module aren't installed.
+func setupSoftHSMToken(t *testing.T) string {
+	modulePath := findSoftHSMModule()
+	if _, err := exec.LookPath("softhsm2-util"); err != nil || modulePath == "" {
+		t.Skip("SoftHSM is not installed")
+	}
+
+	tokenDir := t.TempDir()
+	softHSMConf := tokenDir + "/softhsm2.conf"
+	ioutil.WriteFile(softHSMConf, []byte("directories.tokendir = "+tokenDir+"\nobjectstore.backend = file\n"), 0600)
+	t.Setenv("SOFTHSM2_CONF", softHSMConf)
+
+	initToken := exec.Command("softhsm2-util", "--init-token", "--free", "--label", "roles-anywhere", "--pin", "1234", "--so-pin", "12345")
+	if output, err := initToken.CombinedOutput(); err != nil {
+		t.Log(string(output))
+		t.Fatal("unable to initialize SoftHSM token")
+	}
+	return modulePath
+}
+
+// Imports a private key and its certificate into the SoftHSM token, both
+// under the same label and ID
+func importSoftHSMKeyAndCertificate(t *testing.T, modulePath string, keyPath string, certPath string, label string, id string) {
+	importKey := exec.Command("softhsm2-util", "--import", keyPath, "--token", "roles-anywhere", "--label", label, "--id", id, "--pin", "1234")
+	if output, err := importKey.CombinedOutput(); err != nil {
+		t.Log(string(output))
+		t.Fatal("unable to import private key into SoftHSM token")
+	}
+
+	// softhsm2-util can't import certificates, so it's done through the module
+	certificatePem, _ := ioutil.ReadFile(certPath)
+	block, _ := pem.Decode(certificatePem)
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idBytes, _ := hex.DecodeString(id)
+	module := pkcs11.New(modulePath)
+	if err := module.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer module.Destroy()
+	defer module.Finalize()
+	slots, err := module.GetSlotList(true)
+	if err != nil || len(slots) == 0 {
+		t.Fatal("unable to find SoftHSM token")
+	}
+	session, err := module.OpenSession(slots[0], pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer module.CloseSession(session)
+	if err := module.Login(session, pkcs11.CKU_USER, "1234"); err != nil {
+		t.Fatal(err)
+	}
+	defer module.Logout(session)
+	_, err = module.CreateObject(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+		pkcs11.NewAttribute(pkcs11.CKA_CERTIFICATE_TYPE, pkcs11.CKC_X_509),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, idBytes),
+		pkcs11.NewAttribute(pkcs11.CKA_SUBJECT, certificate.RawSubject),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, certificate.Raw),
+	})
+	if err != nil {
+		t.Fatal("unable to import certificate into SoftHSM token:", err)
+	}
+}
+
+// Signing through SoftHSM requires softhsm2-util and the SoftHSM module to be
+// installed; the test is skipped otherwise.
+func TestPKCS11Sign(t *testing.T) {
+	modulePath := setupSoftHSMToken(t)
+
+	fixtures := []struct {
+		KeyPath  string
+		CertPath string
+		Label    string
+		Id       string
+	}{
+		{"../tst/certs/rsa-2048-key-pkcs8.pem", "../tst/certs/rsa-2048-sha256-cert.pem", "rsa-2048", "01"},
+		{"../tst/certs/ec-prime256v1-key-pkcs8.pem", "../tst/certs/ec-prime256v1-sha256-cert.pem", "ec-prime256v1", "02"},
+	}
+	for _, fixture := range fixtures {
+		importKey := exec.Command("softhsm2-util", "--import", fixture.KeyPath, "--token", "roles-anywhere", "--label", fixture.Label, "--id", fixture.Id, "--pin", "1234")
+		if output, err := importKey.CombinedOutput(); err != nil {
+			t.Log(string(output))
+			t.Fatal("unable to import private key into SoftHSM token")
+		}
+
+		privateKeyURI := "pkcs11:token=roles-anywhere;object=" + fixture.Label + "?module-path=" + modulePath + "&pin-value=1234"
+		privateKey, err := ReadPrivateKeyData(privateKeyURI)
+		if err != nil {
+			t.Log(err)
+			t.Fatal("unable to read private key from SoftHSM token")
+		}
+		pkcs11Signer := privateKey.(*PKCS11Signer)
+
+		certificatePem, _ := ioutil.ReadFile(fixture.CertPath)
+		certificateData, _ := ReadCertificateData(string(certificatePem))
+		certificateDerData, _ := base64.StdEncoding.DecodeString(certificateData.CertificateData)
+		certificate, _ := x509.ParseCertificate(certificateDerData)
+
+		msg := []byte("test message")
+		for _, digest := range []crypto.Hash{crypto.SHA256, crypto.SHA384, crypto.SHA512} {
+			signingResult, err := Sign(msg, SigningOpts{PrivateKey: privateKey, Digest: digest})
+			if err != nil {
+				t.Log(err)
+				t.Log("Failed to sign the input message with the SoftHSM token")
+				t.Fail()
+				continue
+			}
+
+			sig, _ := hex.DecodeString(signingResult.Signature)
+			hash := digest.New()
+			hash.Write(msg)
+			switch publicKey := certificate.PublicKey.(type) {
+			case *rsa.PublicKey:
+				if rsa.VerifyPKCS1v15(publicKey, digest, hash.Sum(nil), sig) != nil {
+					t.Log("Failed to verify the RSA signature from the SoftHSM token")
+					t.Fail()
+				}
+			case *ecdsa.PublicKey:
+				if !ecdsa.VerifyASN1(publicKey, hash.Sum(nil), sig) {
+					t.Log("Failed to verify the ECDSA signature from the SoftHSM token")
+					t.Fail()
+				}
+			}
+		}
+		pkcs11Signer.Close()
+	}
+}
+
+// Credentials can be obtained with both the certificate and the private key
+// on the token, which share the session of the module
+func TestPKCS11CertificateAndKeyOnToken(t *testing.T) {
+	modulePath := setupSoftHSMToken(t)
+	importSoftHSMKeyAndCertificate(t, modulePath, "../tst/certs/rsa-2048-key-pkcs8.pem", "../tst/certs/rsa-2048-sha256-cert.pem", "rsa-2048", "01")
+
+	server := GetMockedCreateSessionResponseServer()
+	defer server.Close()
+	objectURI := "pkcs11:token=roles-anywhere;object=rsa-2048?module-path=" + modulePath + "&pin-value=1234"
+	credentialsOpts := CredentialsOpts{
+		PrivateKeyId:      objectURI,
+		CertificateId:     objectURI,
+		RoleArn:           "arn:aws:iam::000000000000:role/ExampleS3WriteRole",
+		ProfileArnStr:     "arn:aws:rolesanywhere:us-east-1:000000000000:profile/41cl0bae-6783-40d4-ab20-65dc5d922e45",
+		TrustAnchorArnStr: "arn:aws:rolesanywhere:us-east-1:000000000000:trust-anchor/41cl0bae-6783-40d4-ab20-65dc5d922e45",
+		Endpoint:          server.URL,
+		SessionDuration:   900,
+	}
+	// The module is released after each call, and loaded again by the next one
+	for i := 0; i < 2; i++ {
+		resp, err := GenerateCredentials(&credentialsOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.AccessKeyId != "accessKeyId" {
+			t.Log("Incorrect access key id")
+			t.Fail()
+		}
+	}
+	if len(pkcs11Modules.byPath) != 0 {
+		t.Log("expected the module to be released")
+		t.Fail()
+	}
+}
+
+// Profiles whose keys are on the same PKCS#11 module are refreshed
+// concurrently, without one of them tearing down the sessions of the others
+func TestUpdateProfilesOnSamePKCS11Module(t *testing.T) {
+	modulePath := setupSoftHSMToken(t)
+	importSoftHSMKeyAndCertificate(t, modulePath, "../tst/certs/rsa-2048-key-pkcs8.pem", "../tst/certs/rsa-2048-sha256-cert.pem", "rsa-2048", "01")
+	importSoftHSMKeyAndCertificate(t, modulePath, "../tst/certs/ec-prime256v1-key-pkcs8.pem", "../tst/certs/ec-prime256v1-sha256-cert.pem", "ec-prime256v1", "02")
+	credentialsPath := filepath.Join(t.TempDir(), "credentials")
+	os.Setenv(AwsSharedCredentialsFileEnvVarName, credentialsPath)
+	defer os.Unsetenv(AwsSharedCredentialsFileEnvVarName)
+
+	server := GetMockedCreateSessionResponseServer()
+	defer server.Close()
+	var profiles []UpdateProfileOpts
+	for _, label := range []string{"rsa-2048", "ec-prime256v1"} {
+		objectURI := "pkcs11:token=roles-anywhere;object=" + label + "?module-path=" + modulePath + "&pin-value=1234"
+		profiles = append(profiles, UpdateProfileOpts{
+			Profile: label,
+			CredentialsOpts: CredentialsOpts{
+				PrivateKeyId:      objectURI,
+				CertificateId:     objectURI,
+				RoleArn:           "arn:aws:iam::000000000000:role/ExampleS3WriteRole",
+				ProfileArnStr:     "arn:aws:rolesanywhere:us-east-1:000000000000:profile/41cl0bae-6783-40d4-ab20-65dc5d922e45",
+				TrustAnchorArnStr: "arn:aws:rolesanywhere:us-east-1:000000000000:trust-anchor/41cl0bae-6783-40d4-ab20-65dc5d922e45",
+				Endpoint:          server.URL,
+				SessionDuration:   900,
+			},
+		})
+	}
+
+	// A failure would exit the process
+	updateProfiles(context.Background(), profiles, UpdateOpts{Once: true}, GenerateCredentialsWithContext)
+
+	contents, _ := ioutil.ReadFile(credentialsPath)
+	for _, profile := range profiles {
+		if !strings.Contains(string(contents), "["+profile.Profile+"]\naws_access_key_id = accessKeyId\n") {
+			t.Logf("missing profile %s in credentials file", profile.Profile)
+			t.Fail()
+		}
+	}
+}
+
+func TestPKCS11AttributeToUint(t *testing.T) {
+	// Attribute values are CK_ULONGs in the host's byte order, either 64 or 32 bits long
+	keyType := uint(pkcs11.CKK_EC)
+	value := (*[unsafe.Sizeof(keyType)]byte)(unsafe.Pointer(&keyType))[:]
+	if decoded := pkcs11AttributeToUint(value); decoded != keyType {
+		t.Logf("expected %d, got %d", keyType, decoded)
+		t.Fail()
+	}
+	class := uint32(pkcs11.CKO_PRIVATE_KEY)
+	value = (*[unsafe.Sizeof(class)]byte)(unsafe.Pointer(&class))[:]
+	if decoded := pkcs11AttributeToUint(value); decoded != uint(class) {
+		t.Logf("expected %d, got %d", class, decoded)
+		t.Fail()
+	}
+}
+
+func TestPKCS11MechanismsArePSSOnly(t *testing.T) {
+	// CKA_ALLOWED_MECHANISMS is an array of CK_ULONGs in the host's byte order
+	encode := func(mechanisms ...uint) []byte {
+		var value []byte
+		for _, mechanism := range mechanisms {
+			value = append(value, (*[unsafe.Sizeof(mechanism)]byte)(unsafe.Pointer(&mechanism))[:pkcs11ULongSize]...)
+		}
+		return value
+	}
+	fixtures := []struct {
+		mechanisms []uint
+		pssOnly    bool
+	}{
+		{nil, false},
+		{[]uint{pkcs11.CKM_RSA_PKCS_PSS}, true},
+		{[]uint{pkcs11.CKM_SHA256_RSA_PKCS_PSS, pkcs11.CKM_SHA384_RSA_PKCS_PSS}, true},
+		{[]uint{pkcs11.CKM_RSA_PKCS_PSS, pkcs11.CKM_RSA_PKCS}, false},
+		{[]uint{pkcs11.CKM_RSA_PKCS}, false},
+	}
+	for _, fixture := range fixtures {
+		if pssOnly := pkcs11MechanismsArePSSOnly(encode(fixture.mechanisms...)); pssOnly != fixture.pssOnly {
+			t.Logf("%v: expected %t, got %t", fixture.mechanisms, fixture.pssOnly, pssOnly)
+			t.Fail()
+		}
+	}
+}
+
+func TestParsePKCS11ECPublicKey(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	params, _ := asn1.Marshal(asn1.ObjectIdentifier{1, 3, 132, 0, 34})
+	point := elliptic.Marshal(elliptic.P384(), key.X, key.Y)
+	derPoint, _ := asn1.Marshal(point)
+
+	// CKA_EC_POINT is normally DER-encoded, but some tokens return the raw point
+	for _, ecPoint := range [][]byte{derPoint, point} {
+		publicKey, err := parsePKCS11ECPublicKey(params, ecPoint)
+		if err != nil || !key.PublicKey.Equal(publicKey) {
+			t.Logf("unexpected public key (%v)", err)
+			t.Fail()
+		}
+	}
+	unknownCurve, _ := asn1.Marshal(asn1.ObjectIdentifier{1, 3, 132, 0, 10})
+	if _, err := parsePKCS11ECPublicKey(unknownCurve, derPoint); err == nil {
+		t.Log("expected an unsupported curve to be refused")
+		t.Fail()
+	}
+}
+
+// Tokens that only hold the key pair, without a certificate, still provide
+// the public key, from the public key object
+func TestPKCS11PublicKeyWithoutCertificate(t *testing.T) {
+	modulePath := setupSoftHSMToken(t)
+	fixtures := []struct {
+		KeyPath  string
+		CertPath string
+		Label    string
+		Id       string
+	}{
+		{"../tst/certs/rsa-2048-key-pkcs8.pem", "../tst/certs/rsa-2048-sha256-cert.pem", "rsa-2048", "01"},
+		{"../tst/certs/ec-prime256v1-key-pkcs8.pem", "../tst/certs/ec-prime256v1-sha256-cert.pem", "ec-prime256v1", "02"},
+	}
+	for _, fixture := range fixtures {
+		importKey := exec.Command("softhsm2-util", "--import", fixture.KeyPath, "--token", "roles-anywhere", "--label", fixture.Label, "--id", fixture.Id, "--pin", "1234")
+		if output, err := importKey.CombinedOutput(); err != nil {
+			t.Log(string(output))
+			t.Fatal("unable to import private key into SoftHSM token")
+		}
+
+		privateKeyURI := "pkcs11:token=roles-anywhere;object=" + fixture.Label + "?module-path=" + modulePath + "&pin-value=1234"
+		privateKey, err := ReadPrivateKeyData(privateKeyURI)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkcs11Signer := privateKey.(*PKCS11Signer)
+
+		certificatePem, _ := ioutil.ReadFile(fixture.CertPath)
+		certificateDer, _ := readCertificateDER(string(certificatePem))
+		certificate, _ := x509.ParseCertificate(certificateDer)
+		publicKey, ok := pkcs11Signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+		if !ok || !publicKey.Equal(certificate.PublicKey) {
+			t.Logf("expected the public key of %s to be read from the token", fixture.Label)
+			t.Fail()
+		}
+		pkcs11Signer.Close()
+	}
+}
@@ -0,0 +1,94 @@
+package aws_signing_helper
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+const pkcs11URIScheme = "pkcs11:"
+
+// Module used when the PKCS#11 URI doesn't specify a module-path. p11-kit's
+// proxy module exposes every module that is registered with p11-kit.
+const defaultPKCS11Module = "p11-kit-proxy.so"
+
+// Parsed representation of a PKCS#11 URI, as specified by RFC 7512
+type pkcs11URI struct {
+	// Attributes found in the path component, which identify the
+	// token and the object on it (for example, "token" and "object")
+	pathAttributes map[string]string
+	// Attributes found in the query component, which control how the
+	// token is accessed (for example, "module-path" and "pin-value")
+	queryAttributes map[string]string
+}
+
+// Checks whether the given private key or certificate identifier is a PKCS#11 URI
+func isPKCS11URI(id string) bool {
+	return strings.HasPrefix(id, pkcs11URIScheme)
+}
+
+// Parses a PKCS#11 URI into its path and query attributes
+func parsePKCS11URI(uri string) (*pkcs11URI, error) {
+	if !isPKCS11URI(uri) {
+		return nil, errors.New("invalid PKCS#11 URI")
+	}
+	uri = strings.TrimPrefix(uri, pkcs11URIScheme)
+
+	var path, query string
+	if i := strings.Index(uri, "?"); i >= 0 {
+		path, query = uri[:i], uri[i+1:]
+	} else {
+		path = uri
+	}
+
+	parsedURI := pkcs11URI{
+		pathAttributes:  make(map[string]string),
+		queryAttributes: make(map[string]string),
+	}
+	if err := parsePKCS11URIAttributes(path, ";", parsedURI.pathAttributes); err != nil {
+		return nil, err
+	}
+	if err := parsePKCS11URIAttributes(query, "&", parsedURI.queryAttributes); err != nil {
+		return nil, err
+	}
+	return &parsedURI, nil
+}
+
+// Parses the attributes in one of the components of a PKCS#11 URI
+func parsePKCS11URIAttributes(component string, separator string, attributes map[string]string) error {
+	if component == "" {
+		return nil
+	}
+	for _, attribute := range strings.Split(component, separator) {
+		parts := strings.SplitN(attribute, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("invalid PKCS#11 URI attribute: %s", attribute)
+		}
+		value, err := url.PathUnescape(parts[1])
+		if err != nil {
+			return fmt.Errorf("invalid PKCS#11 URI attribute value: %s", attribute)
+		}
+		if _, ok := attributes[parts[0]]; ok {
+			return fmt.Errorf("duplicate PKCS#11 URI attribute: %s", parts[0])
+		}
+		attributes[parts[0]] = value
+	}
+	return nil
+}
+
+// Obtains the PIN to log in to the token with, if one was specified
+func (uri *pkcs11URI) pin() (string, bool, error) {
+	if pin, ok := uri.queryAttributes["pin-value"]; ok {
+		return pin, true, nil
+	}
+	if pinSource, ok := uri.queryAttributes["pin-source"]; ok {
+		pinBytes, err := ioutil.ReadFile(strings.TrimPrefix(pinSource, "file:"))
+		if err != nil {
+			return "", false, errors.New("unable to read PKCS#11 PIN from pin-source")
+		}
+		return strings.TrimRight(string(pinBytes), "\r\n"), true, nil
+	}
+	return "", false, nil
+}
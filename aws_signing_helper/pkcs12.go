@@ -0,0 +1,42 @@
+package aws_signing_helper
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Returned when a PKCS#12 file can't be decrypted with the provided password
+var ErrIncorrectPKCS12Password = errors.New("incorrect PKCS#12 password")
+
+// Reads the private key, the leaf certificate and any intermediate
+// certificates from a PKCS#12 (PFX) file, decrypting it with the password
+func ReadPKCS12Data(pkcs12File string, password string) (crypto.PrivateKey, *x509.Certificate, []*x509.Certificate, error) {
+	pfxData, err := ioutil.ReadFile(pkcs12File)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	privateKey, certificate, certificateChain, err := pkcs12.DecodeChain(pfxData, password)
+	if err == pkcs12.ErrIncorrectPassword {
+		return nil, nil, nil, ErrIncorrectPKCS12Password
+	}
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("unable to parse PKCS#12 file: %w", err)
+	}
+	return privateKey, certificate, certificateChain, nil
+}
+
+// Load the leaf certificate from a PKCS#12 file and extract details required
+// by the SDK to construct the StringToSign
+func ReadPKCS12CertificateData(pkcs12File string, password string) (CertificateData, error) {
+	_, certificate, _, err := ReadPKCS12Data(pkcs12File, password)
+	if err != nil {
+		return CertificateData{}, err
+	}
+	return getCertificateData(certificate.Raw)
+}
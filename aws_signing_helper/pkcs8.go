@@ -0,0 +1,221 @@
+package aws_signing_helper
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Returned when an encrypted private key can't be decrypted with the provided
+// passphrase (or no passphrase was provided)
+var ErrIncorrectPrivateKeyPassphrase = errors.New("incorrect private key passphrase")
+
+// Object identifiers of the algorithms that can be used to encrypt PKCS#8 keys (RFC 8018 and RFC 7914)
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA224 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 8}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+type encryptedPrivateKeyInfo struct {
+	EncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedData       []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type scryptParams struct {
+	Salt                     []byte
+	CostParameter            int
+	BlockSize                int
+	ParallelizationParameter int
+	KeyLength                int `asn1:"optional"`
+}
+
+// Checks whether the PEM data holds an encrypted PKCS#8 private key
+func IsEncryptedPrivateKey(privateKey string) bool {
+	_, err := parseDERFromPEM(privateKey, "ENCRYPTED PRIVATE KEY")
+	return err == nil
+}
+
+// Reads an encrypted PKCS#8 private key, decrypting it with the passphrase.
+// Only PBES2 is supported, with PBKDF2 or scrypt as the key derivation
+// function, and AES-CBC or 3DES-CBC as the cipher.
+func readEncryptedPKCS8PrivateKey(privateKey string, passphrase string) (crypto.PrivateKey, error) {
+	block, err := parseDERFromPEM(privateKey, "ENCRYPTED PRIVATE KEY")
+	if err != nil {
+		return nil, errors.New("could not parse PEM data")
+	}
+
+	der, err := decryptPKCS8PrivateKey(block.Bytes, []byte(passphrase))
+	if err != nil {
+		return nil, err
+	}
+	// A wrong passphrase can result in valid padding by chance, but not in a valid key
+	key, err := parsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, ErrIncorrectPrivateKeyPassphrase
+	}
+	return key, nil
+}
+
+// Decrypts DER-encoded EncryptedPrivateKeyInfo, and returns the DER-encoded PrivateKeyInfo
+func decryptPKCS8PrivateKey(der []byte, passphrase []byte) ([]byte, error) {
+	var keyInfo encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &keyInfo); err != nil {
+		return nil, errors.New("could not parse encrypted private key")
+	}
+	if !keyInfo.EncryptionAlgorithm.Algorithm.Equal(oidPBES2) {
+		return nil, errors.New("unsupported private key encryption algorithm, only PBES2 is supported")
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(keyInfo.EncryptionAlgorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, errors.New("could not parse PBES2 parameters")
+	}
+
+	newCipher, keyLength, err := getPBES2Cipher(params.EncryptionScheme.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, errors.New("could not parse cipher parameters")
+	}
+	key, err := derivePBES2Key(params.KeyDerivationFunc, passphrase, keyLength)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	blockSize := block.BlockSize()
+	ciphertext := keyInfo.EncryptedData
+	if len(iv) != blockSize || len(ciphertext) == 0 || len(ciphertext)%blockSize != 0 {
+		return nil, errors.New("invalid encrypted private key")
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+	// Remove the PKCS#7 padding, which doesn't check out if the passphrase is wrong
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > blockSize {
+		return nil, ErrIncorrectPrivateKeyPassphrase
+	}
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding {
+			return nil, ErrIncorrectPrivateKeyPassphrase
+		}
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+// Finds the block cipher and key length for a PBES2 encryption scheme
+func getPBES2Cipher(algorithm asn1.ObjectIdentifier) (func([]byte) (cipher.Block, error), int, error) {
+	switch {
+	case algorithm.Equal(oidAES128CBC):
+		return aes.NewCipher, 16, nil
+	case algorithm.Equal(oidAES192CBC):
+		return aes.NewCipher, 24, nil
+	case algorithm.Equal(oidAES256CBC):
+		return aes.NewCipher, 32, nil
+	case algorithm.Equal(oidDESEDE3CBC):
+		return des.NewTripleDESCipher, 24, nil
+	}
+	return nil, 0, errors.New("unsupported private key encryption cipher")
+}
+
+// Derives the encryption key from the passphrase with PBKDF2 or scrypt
+func derivePBES2Key(kdf pkix.AlgorithmIdentifier, passphrase []byte, keyLength int) ([]byte, error) {
+	switch {
+	case kdf.Algorithm.Equal(oidPBKDF2):
+		var params pbkdf2Params
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, errors.New("could not parse PBKDF2 parameters")
+		}
+		var hashFunc func() hash.Hash
+		switch {
+		// HMAC-SHA1 is the default when no PRF is specified
+		case len(params.PRF.Algorithm) == 0 || params.PRF.Algorithm.Equal(oidHMACWithSHA1):
+			hashFunc = sha1.New
+		case params.PRF.Algorithm.Equal(oidHMACWithSHA224):
+			hashFunc = sha256.New224
+		case params.PRF.Algorithm.Equal(oidHMACWithSHA256):
+			hashFunc = sha256.New
+		case params.PRF.Algorithm.Equal(oidHMACWithSHA384):
+			hashFunc = sha512.New384
+		case params.PRF.Algorithm.Equal(oidHMACWithSHA512):
+			hashFunc = sha512.New
+		default:
+			return nil, errors.New("unsupported PBKDF2 pseudorandom function")
+		}
+		if params.KeyLength != 0 && params.KeyLength != keyLength {
+			return nil, errors.New("invalid PBKDF2 key length")
+		}
+		return pbkdf2.Key(passphrase, params.Salt, params.IterationCount, keyLength, hashFunc), nil
+	case kdf.Algorithm.Equal(oidScrypt):
+		var params scryptParams
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, errors.New("could not parse scrypt parameters")
+		}
+		if params.KeyLength != 0 && params.KeyLength != keyLength {
+			return nil, errors.New("invalid scrypt key length")
+		}
+		return scrypt.Key(passphrase, params.Salt, params.CostParameter, params.BlockSize, params.ParallelizationParameter, keyLength)
+	}
+	return nil, errors.New("unsupported private key derivation function")
+}
+
+// Parses a DER-encoded PKCS#8 private key, returning RSA and EC keys by value
+func parsePKCS8PrivateKey(der []byte) (crypto.PrivateKey, error) {
+	privKey, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, errors.New("could not parse private key")
+	}
+
+	rsaPrivateKey, ok := privKey.(*rsa.PrivateKey)
+	if ok {
+		return *rsaPrivateKey, nil
+	}
+
+	ecPrivateKey, ok := privKey.(*ecdsa.PrivateKey)
+	if ok {
+		return *ecPrivateKey, nil
+	}
+
+	return nil, errors.New("could not parse PKCS8 private key")
+}
@@ -0,0 +1,145 @@
+package aws_signing_helper
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bound of the random delay subtracted from the refresh time, so that
+// several processes sharing a role don't all refresh at the same moment
+var RefreshJitter = time.Minute
+
+// Bounds of the backoff between retries after a failed refresh
+var RefreshRetryInitialBackoff = time.Second * time.Duration(5)
+var RefreshRetryMaxBackoff = time.Minute * time.Duration(2)
+
+// Minimum time between two successful refreshes, which guards against
+// refreshing in a tight loop when the returned credentials are short-lived
+var MinRefreshInterval = time.Second * time.Duration(30)
+
+// Refreshes credentials in the background ahead of their expiry, and hands out
+// the most recent credentials as immutable snapshots. It is safe for concurrent use.
+type CredentialsRefresher struct {
+	opts                CredentialsOpts
+	cred                atomic.Value
+	generateCredentials func(context.Context, *CredentialsOpts) (CredentialProcessOutput, error)
+}
+
+// Creates a refresher for the credentials described by opts. Refresh has to
+// be called (or Run started) before any credentials are available.
+func NewCredentialsRefresher(opts CredentialsOpts) *CredentialsRefresher {
+	return &CredentialsRefresher{
+		opts:                opts,
+		generateCredentials: GenerateCredentialsWithContext,
+	}
+}
+
+// Obtains new credentials through a call to CreateSession and swaps them in.
+// If the call fails, the previous credentials are kept.
+func (refresher *CredentialsRefresher) Refresh() error {
+	return refresher.RefreshWithContext(context.Background())
+}
+
+// Same as Refresh, but the call to CreateSession is cancelled when the
+// context is done
+func (refresher *CredentialsRefresher) RefreshWithContext(ctx context.Context) error {
+	credentialProcessOutput, err := refresher.generateCredentials(ctx, &refresher.opts)
+	if err != nil {
+		return err
+	}
+	expiration, err := time.Parse(time.RFC3339, credentialProcessOutput.Expiration)
+	if err != nil {
+		return err
+	}
+
+	refresher.cred.Store(&RefreshableCred{
+		AccessKeyId:     credentialProcessOutput.AccessKeyId,
+		SecretAccessKey: credentialProcessOutput.SecretAccessKey,
+		Token:           credentialProcessOutput.SessionToken,
+		Code:            REFRESHABLE_CRED_CODE,
+		Type:            REFRESHABLE_CRED_TYPE,
+		Expiration:      expiration,
+		LastUpdated:     time.Now(),
+	})
+	return nil
+}
+
+// Returns a snapshot of the most recent credentials, as long as they haven't expired
+func (refresher *CredentialsRefresher) Credentials() (RefreshableCred, error) {
+	cred, ok := refresher.cred.Load().(*RefreshableCred)
+	if !ok {
+		return RefreshableCred{}, errors.New("no credentials available")
+	}
+	if !time.Now().Before(cred.Expiration) {
+		return RefreshableCred{}, errors.New("credentials have expired")
+	}
+	return *cred, nil
+}
+
+// Finds how long to wait until the next refresh: RefreshTime ahead of the
+// expiry of the current credentials, minus some jitter
+func (refresher *CredentialsRefresher) nextRefreshDelay() time.Duration {
+	cred, ok := refresher.cred.Load().(*RefreshableCred)
+	if !ok {
+		return 0
+	}
+	refreshTime := cred.Expiration.Add(-RefreshTime).Add(-randomDuration(RefreshJitter))
+	delay := time.Until(refreshTime)
+	if delay < MinRefreshInterval {
+		delay = MinRefreshInterval
+	}
+	return delay
+}
+
+// Refreshes credentials ahead of their expiry until the context is cancelled,
+// which also cancels a refresh that is in flight. Failed refreshes are retried
+// with exponential backoff, while the previous credentials keep being served
+// until they expire.
+func (refresher *CredentialsRefresher) Run(ctx context.Context) {
+	var retryBackoff time.Duration
+	for {
+		delay := refresher.nextRefreshDelay()
+		if retryBackoff > 0 {
+			delay = retryBackoff + randomDuration(retryBackoff/2)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		err := refresher.RefreshWithContext(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if retryBackoff == 0 {
+				retryBackoff = RefreshRetryInitialBackoff
+			} else if retryBackoff *= 2; retryBackoff > RefreshRetryMaxBackoff {
+				retryBackoff = RefreshRetryMaxBackoff
+			}
+			log.Printf("unable to refresh credentials, retrying in %s: %s", retryBackoff, err)
+			continue
+		}
+		retryBackoff = 0
+		if cred, err := refresher.Credentials(); err == nil {
+			log.Println("Credentials refreshed, they expire at", cred.Expiration.String())
+		}
+	}
+}
+
+// Returns a random duration in [0, max). The jitter doesn't need to be
+// unpredictable, so math/rand is sufficient.
+func randomDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max))) // nosemgrep
+}
@@ -0,0 +1,184 @@
+package aws_signing_helper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// Policy for retrying CreateSession after transient failures (throttling,
+// server errors and network errors). Zero fields take their value from
+// DefaultRetryPolicy.
+type RetryPolicy struct {
+	// Maximum number of attempts, including the first one; 1 disables retries
+	MaxAttempts int
+	// Upper bound of the backoff before the first retry. The backoff doubles
+	// with every retry, and the actual delay is picked at random below it.
+	InitialBackoff time.Duration
+	// Upper bound of the backoff between two attempts
+	MaxBackoff time.Duration
+	// Time after the first attempt past which no retry is started; unlimited
+	// if zero
+	MaxElapsedTime time.Duration
+}
+
+// Policy used when CredentialsOpts doesn't specify one
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: time.Millisecond * time.Duration(200),
+	MaxBackoff:     time.Second * time.Duration(5),
+}
+
+// Categories of CreateSession failures. Errors returned by GenerateCredentials
+// for a failed CreateSession call match one of them with errors.Is.
+var (
+	// The request was rejected as invalid (for example, an out-of-range session duration)
+	ErrValidation = errors.New("invalid CreateSession request")
+	// The certificate isn't trusted, or isn't allowed to assume the role
+	ErrAccessDenied = errors.New("access denied")
+	// The profile, trust anchor or role doesn't exist
+	ErrResourceNotFound = errors.New("resource not found")
+	// The request was throttled
+	ErrThrottled = errors.New("request throttled")
+	// The service failed to process the request (5xx)
+	ErrServiceFailure = errors.New("service failure")
+	// The service couldn't be reached, or the connection failed
+	ErrNetwork = errors.New("network failure")
+)
+
+// Error returned when CreateSession fails. It matches the category of the
+// failure with errors.Is, and unwraps to the error returned by the SDK (so
+// that, for example, errors.As can extract an *AccessDeniedException).
+type CreateSessionError struct {
+	// Category of the failure; one of the Err* variables above, or nil if the
+	// failure couldn't be categorized
+	Kind error
+	// Number of attempts that were made
+	Attempts int
+	// Error returned by the SDK for the last attempt
+	Err error
+}
+
+func (e *CreateSessionError) Error() string {
+	return fmt.Sprintf("CreateSession failed after %d attempt(s): %s", e.Attempts, e.Err)
+}
+
+func (e *CreateSessionError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CreateSessionError) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+// Whether the failure is transient, so that CreateSession can be retried
+func (e *CreateSessionError) Retryable() bool {
+	return e.Kind == ErrThrottled || e.Kind == ErrServiceFailure || e.Kind == ErrNetwork
+}
+
+// Fills the zero fields of the policy from DefaultRetryPolicy
+func (policy RetryPolicy) withDefaults() RetryPolicy {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = DefaultRetryPolicy.InitialBackoff
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = DefaultRetryPolicy.MaxBackoff
+	}
+	return policy
+}
+
+// Finds the category of an error returned by the SDK for CreateSession
+func classifyCreateSessionError(err error) error {
+	var accessDenied *AccessDeniedException
+	var validation *ValidationException
+	var resourceNotFound *ResourceNotFoundException
+	switch {
+	case errors.As(err, &accessDenied):
+		return ErrAccessDenied
+	case errors.As(err, &validation):
+		return ErrValidation
+	case errors.As(err, &resourceNotFound):
+		return ErrResourceNotFound
+	}
+
+	var requestFailure awserr.RequestFailure
+	if errors.As(err, &requestFailure) {
+		switch statusCode := requestFailure.StatusCode(); {
+		case statusCode >= 500:
+			return ErrServiceFailure
+		case statusCode == 429 || request.IsErrorThrottle(err):
+			return ErrThrottled
+		case statusCode == 403:
+			return ErrAccessDenied
+		case statusCode == 404:
+			return ErrResourceNotFound
+		case statusCode >= 400:
+			return ErrValidation
+		}
+	}
+	if request.IsErrorThrottle(err) {
+		return ErrThrottled
+	}
+
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case request.ErrCodeRequestError, request.ErrCodeResponseTimeout:
+			return ErrNetwork
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || request.IsErrorRetryable(err) {
+		return ErrNetwork
+	}
+	return nil
+}
+
+// Calls createSession until it succeeds, fails with an error that isn't
+// transient, or the policy allows no further attempt. Retries are delayed by
+// an exponential backoff with full jitter. If the context is done, the error
+// unwraps to the context's error.
+func createSessionWithRetries(ctx context.Context, policy RetryPolicy, createSession func() (*CreateSessionOutput, error)) (*CreateSessionOutput, error) {
+	policy = policy.withDefaults()
+	start := time.Now()
+	backoff := policy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		output, err := createSession()
+		if err == nil {
+			return output, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, &CreateSessionError{Attempts: attempt, Err: ctx.Err()}
+		}
+		sessionErr := &CreateSessionError{Kind: classifyCreateSessionError(err), Attempts: attempt, Err: err}
+		if !sessionErr.Retryable() || attempt >= policy.MaxAttempts {
+			return nil, sessionErr
+		}
+		delay := randomDuration(backoff)
+		if policy.MaxElapsedTime > 0 && time.Since(start)+delay > policy.MaxElapsedTime {
+			return nil, sessionErr
+		}
+		log.Printf("CreateSession failed (%s), retrying in %s", err, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, &CreateSessionError{Attempts: attempt, Err: ctx.Err()}
+		case <-timer.C:
+		}
+
+		if backoff *= 2; backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
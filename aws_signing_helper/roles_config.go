@@ -0,0 +1,198 @@
+package aws_signing_helper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Roles configuration file, listing the roles served by the local endpoint, or
+// the profiles of the credentials file kept up to date by the update command.
+// The file is read as YAML or TOML if its extension says so, as the
+// configuration file of the command line is, and as JSON otherwise. Other
+// top-level keys are ignored, so the roles can be listed in the configuration
+// file of the command line, next to its profiles.
+//
+// Example:
+//
+//	{
+//	  "roles": [
+//	    {
+//	      "name": "build",
+//	      "roleArn": "arn:aws:iam::000000000000:role/BuildRole",
+//	      "profileArn": "arn:aws:rolesanywhere:us-east-1:000000000000:profile/...",
+//	      "trustAnchorArn": "arn:aws:rolesanywhere:us-east-1:000000000000:trust-anchor/...",
+//	      "certificate": "/etc/pki/build.pem",
+//	      "privateKey": "/etc/pki/build.key"
+//	    }
+//	  ]
+//	}
+//
+// YAML example:
+//
+//	roles:
+//	  - name: build
+//	    roleArn: arn:aws:iam::000000000000:role/BuildRole
+//	    certificate: /etc/pki/build.pem
+//	    privateKey: /etc/pki/build.key
+type RolesConfig struct {
+	Roles []RoleConfig `json:"roles" yaml:"roles" toml:"roles"`
+}
+
+// One of the roles in a roles configuration file. Fields that are left empty
+// take their value from the command line.
+type RoleConfig struct {
+	// Name under which the credentials are served; defaults to the name of the role
+	Name string `json:"name" yaml:"name" toml:"name"`
+	// Profile of the credentials file that update writes the credentials to;
+	// defaults to the name under which they would be served
+	Profile         string `json:"profile" yaml:"profile" toml:"profile"`
+	RoleArn         string `json:"roleArn" yaml:"roleArn" toml:"roleArn"`
+	ProfileArn      string `json:"profileArn" yaml:"profileArn" toml:"profileArn"`
+	TrustAnchorArn  string `json:"trustAnchorArn" yaml:"trustAnchorArn" toml:"trustAnchorArn"`
+	Certificate     string `json:"certificate" yaml:"certificate" toml:"certificate"`
+	PrivateKey      string `json:"privateKey" yaml:"privateKey" toml:"privateKey"`
+	Intermediates   string `json:"intermediates" yaml:"intermediates" toml:"intermediates"`
+	Pkcs12          string `json:"pkcs12" yaml:"pkcs12" toml:"pkcs12"`
+	SessionDuration int    `json:"sessionDuration" yaml:"sessionDuration" toml:"sessionDuration"`
+	RoleSessionName string `json:"roleSessionName" yaml:"roleSessionName" toml:"roleSessionName"`
+	Region          string `json:"region" yaml:"region" toml:"region"`
+	Endpoint        string `json:"endpoint" yaml:"endpoint" toml:"endpoint"`
+	// Instance properties attached to sessions for this role, in addition to
+	// those given on the command line
+	InstanceProperties map[string]string `json:"instanceProperties" yaml:"instanceProperties" toml:"instanceProperties"`
+}
+
+// Reads a roles configuration file, and returns the options of each role in
+// it. Options that a role doesn't set are taken from defaults.
+func ReadRolesConfig(path string, defaults CredentialsOpts) ([]RoleServeOpts, error) {
+	roleConfigs, err := readRolesConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var roles []RoleServeOpts
+	for i, roleConfig := range roleConfigs {
+		opts, err := roleConfig.checkedCredentialsOpts(i, defaults)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, RoleServeOpts{Name: roleConfig.Name, CredentialsOpts: opts})
+	}
+	return roles, nil
+}
+
+// Reads a roles configuration file for the update command, and returns the
+// options of each role along with the profile of the credentials file that
+// its credentials are written to. Options that a role doesn't set are taken
+// from defaults.
+func ReadUpdateProfilesConfig(path string, defaults CredentialsOpts) ([]UpdateProfileOpts, error) {
+	roleConfigs, err := readRolesConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var profiles []UpdateProfileOpts
+	for i, roleConfig := range roleConfigs {
+		opts, err := roleConfig.checkedCredentialsOpts(i, defaults)
+		if err != nil {
+			return nil, err
+		}
+		profileName := roleConfig.Profile
+		if profileName == "" {
+			if profileName, err = getServedRoleName(RoleServeOpts{Name: roleConfig.Name, CredentialsOpts: opts}); err != nil {
+				return nil, err
+			}
+		}
+		for _, profile := range profiles {
+			if profile.Profile == profileName {
+				return nil, fmt.Errorf("duplicate profile %s in roles configuration", profileName)
+			}
+		}
+		profiles = append(profiles, UpdateProfileOpts{Profile: profileName, CredentialsOpts: opts})
+	}
+	return profiles, nil
+}
+
+// Reads the roles of a roles configuration file, which has to list at least
+// one, picking the format from the extension of the file
+func readRolesConfig(path string) ([]RoleConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rolesConfig RolesConfig
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &rolesConfig)
+	case ".toml":
+		err = toml.Unmarshal(data, &rolesConfig)
+	default:
+		err = json.Unmarshal(data, &rolesConfig)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse roles configuration: %w", err)
+	}
+	if len(rolesConfig.Roles) == 0 {
+		return nil, errors.New("no roles in roles configuration")
+	}
+	return rolesConfig.Roles, nil
+}
+
+// Merges the options of the i-th role into defaults, and checks that the
+// result has everything CreateSession needs
+func (roleConfig RoleConfig) checkedCredentialsOpts(i int, defaults CredentialsOpts) (CredentialsOpts, error) {
+	opts := roleConfig.credentialsOpts(defaults)
+	if opts.RoleArn == "" || opts.ProfileArnStr == "" || opts.TrustAnchorArnStr == "" ||
+		(opts.Pkcs12Id == "" && (opts.CertificateId == "" || opts.PrivateKeyId == "")) {
+		return CredentialsOpts{}, fmt.Errorf("role %d in roles configuration is missing a role, profile or trust anchor ARN, or a certificate and private key (or PKCS#12 file)", i)
+	}
+	return opts, nil
+}
+
+// Merges the options of a role into defaults
+func (roleConfig RoleConfig) credentialsOpts(defaults CredentialsOpts) CredentialsOpts {
+	opts := defaults
+	setIfNotEmpty := func(field *string, value string) {
+		if value != "" {
+			*field = value
+		}
+	}
+	setIfNotEmpty(&opts.RoleArn, roleConfig.RoleArn)
+	setIfNotEmpty(&opts.ProfileArnStr, roleConfig.ProfileArn)
+	setIfNotEmpty(&opts.TrustAnchorArnStr, roleConfig.TrustAnchorArn)
+	setIfNotEmpty(&opts.CertificateId, roleConfig.Certificate)
+	setIfNotEmpty(&opts.PrivateKeyId, roleConfig.PrivateKey)
+	setIfNotEmpty(&opts.CertificateBundleId, roleConfig.Intermediates)
+	// A role's own credentials replace those from the command line, whatever their form
+	if roleConfig.Pkcs12 != "" {
+		opts.Pkcs12Id = roleConfig.Pkcs12
+		opts.CertificateId, opts.PrivateKeyId = "", ""
+	} else if roleConfig.Certificate != "" || roleConfig.PrivateKey != "" {
+		opts.Pkcs12Id = ""
+	}
+	setIfNotEmpty(&opts.RoleSessionName, roleConfig.RoleSessionName)
+	setIfNotEmpty(&opts.Region, roleConfig.Region)
+	setIfNotEmpty(&opts.Endpoint, roleConfig.Endpoint)
+	if roleConfig.SessionDuration != 0 {
+		opts.SessionDuration = roleConfig.SessionDuration
+	}
+
+	if len(roleConfig.InstanceProperties) != 0 {
+		instanceProperties := make(map[string]string)
+		for key, value := range defaults.InstanceProperties {
+			instanceProperties[key] = value
+		}
+		for key, value := range roleConfig.InstanceProperties {
+			instanceProperties[key] = value
+		}
+		opts.InstanceProperties = instanceProperties
+	}
+	return opts
+}
@@ -1,12 +1,15 @@
 package aws_signing_helper
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -37,7 +40,28 @@ type RefreshableCred struct {
 type Endpoint struct {
 	PortNum int
 	Server  *http.Server
+	// Credentials of the first role, as obtained when the endpoint started.
+	//
+	// Deprecated: credentials are refreshed by the refresher of each role in
+	// Roles, which holds the current ones.
 	TmpCred RefreshableCred
+	Roles   []*ServedRole
+}
+
+// A role whose credentials are served by the local endpoint
+type ServedRole struct {
+	// Name under which the credentials are served
+	Name      string
+	RoleArn   string
+	Refresher *CredentialsRefresher
+}
+
+// Options for one of the roles served by the local endpoint
+type RoleServeOpts struct {
+	// Name under which the credentials are served; defaults to the name of the
+	// role (without its path) if empty
+	Name            string
+	CredentialsOpts CredentialsOpts
 }
 
 type SessionToken struct {
@@ -58,6 +82,70 @@ const REFRESHABLE_CRED_CODE = "Success"
 
 const MAX_TOKENS = 256
 
+const ECS_CREDENTIALS_RESOURCE_PATH = "/role-credentials"
+const ECS_AUTHORIZATION_HEADER = "Authorization"
+
+const UNIX_LISTEN_PREFIX = "unix:"
+
+// Time that requests being served are given to complete when the local
+// endpoint shuts down
+var ShutdownTimeout = time.Second * time.Duration(5)
+
+// Only the owner of the socket can connect to it by default
+const DefaultSocketMode os.FileMode = 0600
+
+// Protocols that the local endpoint can speak
+const (
+	// Emulates IMDSv2, for use with AWS_EC2_METADATA_SERVICE_ENDPOINT
+	ImdsServeMode = "imds"
+	// Emulates the ECS container credentials endpoint, for use with
+	// AWS_CONTAINER_CREDENTIALS_FULL_URI
+	EcsServeMode = "ecs"
+)
+
+// Options for the local credentials endpoint
+type ServeOpts struct {
+	// Port on the loopback interface to listen on
+	Port int
+	// Protocol spoken by the endpoint; one of ImdsServeMode (the default) and EcsServeMode
+	Mode string
+	// Token that clients have to present in the Authorization header in ECS mode
+	AuthorizationToken string
+	// Path to a file containing the token that clients have to present in the
+	// Authorization header in ECS mode. The file is read on every request, so
+	// that the token can be rotated.
+	AuthorizationTokenFile string
+	// Address to listen on instead of the loopback port, in the form
+	// unix:<path> for a Unix domain socket
+	Listen string
+	// Permissions of the Unix domain socket; DefaultSocketMode if unset
+	SocketMode os.FileMode
+	// If non-empty, only peers running as one of these user IDs are served.
+	// Peers are identified through SO_PEERCRED, which requires a Unix domain
+	// socket on Linux.
+	AllowedUids []uint32
+	// If non-empty, only peers running with one of these primary group IDs are served
+	AllowedGids []uint32
+}
+
+// Credentials of the process on the other end of a Unix domain socket connection
+type PeerCredentials struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+type peerCredentialsContextKey struct{}
+
+// Container for credentials returned by the ECS container credentials endpoint
+type EcsCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      string
+	RoleArn         string
+}
+
 var mutex sync.Mutex
 var tokenMap = make(map[string]time.Time)
 
@@ -147,7 +235,131 @@ func FindTokenTTLSeconds(r *http.Request) (string, error) {
 	}
 }
 
+// Helper function that checks whether the Authorization header in the request
+// matches the token the endpoint was configured with
+func CheckValidAuthorizationToken(w http.ResponseWriter, r *http.Request, serveOpts *ServeOpts) error {
+	expectedToken := serveOpts.AuthorizationToken
+	if serveOpts.AuthorizationTokenFile != "" {
+		tokenBytes, err := ioutil.ReadFile(serveOpts.AuthorizationTokenFile)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			msg := "unable to read authorization token file"
+			io.WriteString(w, msg)
+			return errors.New(msg)
+		}
+		expectedToken = strings.TrimSpace(string(tokenBytes))
+	}
+
+	token := r.Header.Get(ECS_AUTHORIZATION_HEADER)
+	if token == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		msg := "no authorization token provided"
+		io.WriteString(w, msg)
+		return errors.New(msg)
+	}
+	if expectedToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expectedToken)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		msg := "invalid authorization token provided"
+		io.WriteString(w, msg)
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// Handles GET requests to the ECS container credentials endpoint
+func EcsCredentialsHandler(refresher *CredentialsRefresher, roleArn string, serveOpts *ServeOpts) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		xForwardedForHeader := r.Header.Get(X_FORWARDED_FOR_HEADER)
+		if xForwardedForHeader != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "unable to process requests with X-Forwarded-For header")
+			return
+		}
+
+		err := CheckValidAuthorizationToken(w, r, serveOpts)
+		if err != nil {
+			return
+		}
+
+		cred, err := refresher.Credentials()
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, "credentials are unavailable")
+			return
+		}
+		ecsCredentials := EcsCredentials{
+			AccessKeyId:     cred.AccessKeyId,
+			SecretAccessKey: cred.SecretAccessKey,
+			Token:           cred.Token,
+			Expiration:      cred.Expiration.UTC().Format(time.RFC3339),
+			RoleArn:         roleArn,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(ecsCredentials)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, "failed to encode credentials")
+			return
+		}
+	}
+}
+
+// Creates the handlers of the IMDSv2-compatible endpoint for a single role,
+// serving cred under roleName. As before roles were refreshed in the
+// background, credentials that are about to expire are refreshed through opts
+// by the request that finds them so, and cred is updated with them. Use
+// AllRolesHandlers to serve several roles.
 func AllIssuesHandlers(cred *RefreshableCred, roleName string, opts *CredentialsOpts) (http.HandlerFunc, http.HandlerFunc, http.HandlerFunc) {
+	return allIssuesHandlers(cred, roleName, opts, GenerateCredentialsWithContext)
+}
+
+func allIssuesHandlers(cred *RefreshableCred, roleName string, opts *CredentialsOpts, generateCredentials func(context.Context, *CredentialsOpts) (CredentialProcessOutput, error)) (http.HandlerFunc, http.HandlerFunc, http.HandlerFunc) {
+	refresher := NewCredentialsRefresher(*opts)
+	refresher.generateCredentials = generateCredentials
+	initialCred := *cred
+	refresher.cred.Store(&initialCred)
+	putTokenHandler, getRoleNameHandler, getCredentialsHandler := AllRolesHandlers([]*ServedRole{{
+		Name:      roleName,
+		RoleArn:   opts.RoleArn,
+		Refresher: refresher,
+	}})
+
+	var refreshMutex sync.Mutex
+	refreshingCredentialsHandler := func(w http.ResponseWriter, r *http.Request) {
+		// Only requests with a valid token get to refresh the credentials
+		mutex.Lock()
+		expiration, ok := tokenMap[r.Header.Get(EC2_METADATA_TOKEN_HEADER)]
+		mutex.Unlock()
+		if ok && time.Now().Before(expiration) {
+			refreshMutex.Lock()
+			if time.Until(cred.Expiration.Add(-RefreshTime)) < RefreshTime {
+				if err := refresher.RefreshWithContext(r.Context()); err == nil {
+					*cred, _ = refresher.Credentials()
+				}
+			}
+			refreshMutex.Unlock()
+		}
+		getCredentialsHandler(w, r)
+	}
+	return putTokenHandler, getRoleNameHandler, refreshingCredentialsHandler
+}
+
+// Creates the handlers of the IMDSv2-compatible endpoint for several roles,
+// whose credentials are refreshed by their own refreshers. The credentials
+// handler serves the role whose name is the last element of the request path.
+func AllRolesHandlers(roles []*ServedRole) (http.HandlerFunc, http.HandlerFunc, http.HandlerFunc) {
+	rolesByName := make(map[string]*ServedRole)
+	var roleNames []string
+	for _, role := range roles {
+		rolesByName[role.Name] = role
+		roleNames = append(roleNames, role.Name)
+	}
+
 	// Handles PUT requests to /latest/api/token/
 	putTokenHandler := func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "PUT" {
@@ -207,7 +419,7 @@ func AllIssuesHandlers(cred *RefreshableCred, roleName string, opts *Credentials
 			return
 		}
 		w.Header().Set(EC2_METADATA_TOKEN_TTL_HEADER, tokenTTL)
-		io.WriteString(w, roleName) // nosemgrep
+		io.WriteString(w, strings.Join(roleNames, "\n")) // nosemgrep
 	}
 
 	// Handles GET requests to /latest/meta-data/iam/security-credentials/<ROLE_NAME>
@@ -222,30 +434,25 @@ func AllIssuesHandlers(cred *RefreshableCred, roleName string, opts *Credentials
 			return
 		}
 
-		var nextRefreshTime = cred.Expiration.Add(-RefreshTime)
-		if time.Until(nextRefreshTime) < RefreshTime {
-			credentialProcessOutput, _ := GenerateCredentials(opts)
-			cred.AccessKeyId = credentialProcessOutput.AccessKeyId
-			cred.SecretAccessKey = credentialProcessOutput.SecretAccessKey
-			cred.Token = credentialProcessOutput.SessionToken
-			cred.Expiration, _ = time.Parse(time.RFC3339, credentialProcessOutput.Expiration)
-			cred.Code = REFRESHABLE_CRED_CODE
-			cred.LastUpdated = time.Now()
-			cred.Type = REFRESHABLE_CRED_TYPE
-			err := json.NewEncoder(w).Encode(cred)
-
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				io.WriteString(w, "failed to encode credentials")
-				return
-			}
-		} else {
-			err := json.NewEncoder(w).Encode(cred)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				io.WriteString(w, "failed to encode credentials")
-				return
-			}
+		role, ok := rolesByName[strings.TrimPrefix(r.URL.Path, SECURITY_CREDENTIALS_RESOURCE_PATH)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// Credentials are refreshed in the background, so that requests
+		// only ever see a complete snapshot of valid credentials
+		cred, err := role.Refresher.Credentials()
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, "credentials are unavailable")
+			return
+		}
+		err = json.NewEncoder(w).Encode(cred)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, "failed to encode credentials")
+			return
 		}
 
 		tokenTTL, err := FindTokenTTLSeconds(r)
@@ -259,61 +466,267 @@ func AllIssuesHandlers(cred *RefreshableCred, roleName string, opts *Credentials
 	return putTokenHandler, getRoleNameHandler, getCredentialsHandler
 }
 
+// Creates the listener for the local endpoint: a Unix domain socket if one is
+// given in serveOpts, and a port on the loopback interface otherwise
+func CreateListener(serveOpts *ServeOpts) (net.Listener, error) {
+	if !strings.HasPrefix(serveOpts.Listen, UNIX_LISTEN_PREFIX) {
+		if serveOpts.Listen != "" {
+			return nil, errors.New("invalid listen address, expected unix:<path>")
+		}
+		if len(serveOpts.AllowedUids) != 0 || len(serveOpts.AllowedGids) != 0 {
+			return nil, errors.New("peers can only be restricted to UIDs or GIDs on a unix socket")
+		}
+		return net.Listen("tcp", fmt.Sprintf("%s:%d", LocalHostAddress, serveOpts.Port))
+	}
+
+	socketPath := strings.TrimPrefix(serveOpts.Listen, UNIX_LISTEN_PREFIX)
+	if socketPath == "" {
+		return nil, errors.New("missing unix socket path")
+	}
+	// Remove a socket left behind by a previous instance, but nothing else
+	if fileInfo, err := os.Lstat(socketPath); err == nil {
+		if fileInfo.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New("listen path exists and is not a socket")
+		}
+		if err = os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	socketMode := serveOpts.SocketMode
+	if socketMode == 0 {
+		socketMode = DefaultSocketMode
+	}
+	if err = os.Chmod(socketPath, socketMode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Attaches the credentials of the peer to the context of a new connection, so
+// that AuthorizePeerHandler can check them. Connections for which they can't
+// be obtained (e.g. TCP connections) are left as is.
+func PeerCredentialsConnContext(ctx context.Context, conn net.Conn) context.Context {
+	peerCredentials, err := getPeerCredentials(conn)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredentialsContextKey{}, peerCredentials)
+}
+
+// Checks whether a peer is in the UID and GID allow-lists. A peer is allowed
+// if it matches either list.
+func isPeerAllowed(peerCredentials PeerCredentials, serveOpts *ServeOpts) bool {
+	for _, uid := range serveOpts.AllowedUids {
+		if peerCredentials.Uid == uid {
+			return true
+		}
+	}
+	for _, gid := range serveOpts.AllowedGids {
+		if peerCredentials.Gid == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// Wraps a handler so that requests from peers that aren't in the UID and GID
+// allow-lists are rejected before they reach it. If neither list is set, every
+// peer is allowed.
+func AuthorizePeerHandler(handler http.Handler, serveOpts *ServeOpts) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(serveOpts.AllowedUids) == 0 && len(serveOpts.AllowedGids) == 0 {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		peerCredentials, ok := r.Context().Value(peerCredentialsContextKey{}).(PeerCredentials)
+		if !ok || !isPeerAllowed(peerCredentials, serveOpts) {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, "peer is not authorized")
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Serves credentials through an IMDSv2-compatible endpoint on the given port
 func Serve(port int, credentialsOptions CredentialsOpts) {
-	var refreshableCred = RefreshableCred{}
+	ServeWithOpts(ServeOpts{Port: port, Mode: ImdsServeMode}, credentialsOptions)
+}
+
+// Serves credentials through a local endpoint, speaking the protocol selected in serveOpts
+func ServeWithOpts(serveOpts ServeOpts, credentialsOptions CredentialsOpts) {
+	ServeRolesWithOpts(serveOpts, []RoleServeOpts{{CredentialsOpts: credentialsOptions}})
+}
 
-	roleArn, err := arn.Parse(credentialsOptions.RoleArn)
+// Finds the name under which a role is served, and checks that it can be used in a path
+func getServedRoleName(roleServeOpts RoleServeOpts) (string, error) {
+	roleArn, err := arn.Parse(roleServeOpts.CredentialsOpts.RoleArn)
 	if err != nil {
-		log.Println("invalid role ARN")
+		return "", errors.New("invalid role ARN")
+	}
+	name := roleServeOpts.Name
+	if name == "" {
+		roleResourceParts := strings.Split(roleArn.Resource, "/")
+		name = roleResourceParts[len(roleResourceParts)-1] // Find role name without path
+	}
+	if name == "" || strings.Contains(name, "/") {
+		return "", fmt.Errorf("invalid role name: %s", name)
+	}
+	return name, nil
+}
+
+// Serves credentials for several roles through a local endpoint, speaking the
+// protocol selected in serveOpts. Each role has its own refresh cycle.
+func ServeRolesWithOpts(serveOpts ServeOpts, roles []RoleServeOpts) {
+	ServeRolesWithContext(context.Background(), serveOpts, roles)
+}
+
+// Same as ServeRolesWithOpts, until the context is done: the endpoint is then
+// shut down, letting requests that are being served complete, and refreshes
+// that are in flight are cancelled
+func ServeRolesWithContext(ctx context.Context, serveOpts ServeOpts, roles []RoleServeOpts) {
+	if serveOpts.Mode == "" {
+		serveOpts.Mode = ImdsServeMode
+	}
+	if serveOpts.Mode != ImdsServeMode && serveOpts.Mode != EcsServeMode {
+		log.Println("invalid serve mode")
+		os.Exit(1)
+	}
+	if serveOpts.Mode == EcsServeMode && serveOpts.AuthorizationToken == "" && serveOpts.AuthorizationTokenFile == "" {
+		log.Println("an authorization token or token file is required in ECS mode")
 		os.Exit(1)
 	}
 
-	credentialProcessOutput, _ := GenerateCredentials(&credentialsOptions)
-	refreshableCred.AccessKeyId = credentialProcessOutput.AccessKeyId
-	refreshableCred.SecretAccessKey = credentialProcessOutput.SecretAccessKey
-	refreshableCred.Token = credentialProcessOutput.SessionToken
-	refreshableCred.Expiration, _ = time.Parse(time.RFC3339, credentialProcessOutput.Expiration)
-	refreshableCred.Code = REFRESHABLE_CRED_CODE
-	refreshableCred.LastUpdated = time.Now()
-	refreshableCred.Type = REFRESHABLE_CRED_TYPE
-	endpoint := &Endpoint{PortNum: port, TmpCred: refreshableCred}
-	endpoint.Server = &http.Server{}
-	roleResourceParts := strings.Split(roleArn.Resource, "/")
-	roleName := roleResourceParts[len(roleResourceParts)-1] // Find role name without path
-	putTokenHandler, getRoleNameHandler, getCredentialsHandler := AllIssuesHandlers(&endpoint.TmpCred, roleName, &credentialsOptions)
-
-	http.HandleFunc(TOKEN_RESOURCE_PATH, putTokenHandler)
-	http.HandleFunc(SECURITY_CREDENTIALS_RESOURCE_PATH, getRoleNameHandler)
-	http.HandleFunc(SECURITY_CREDENTIALS_RESOURCE_PATH+roleName, getCredentialsHandler)
-
-	// Background thread that cleans up expired tokens
-	ticker := time.NewTicker(5 * time.Second)
-	go func() {
-		for range ticker.C {
-			curTime := time.Now()
-			mutex.Lock()
-			for key, value := range tokenMap {
-				if curTime.After(value) {
-					delete(tokenMap, key)
-					log.Printf("removed expired token: %s", key)
-				}
+	if len(roles) == 0 {
+		log.Println("no roles to serve")
+		os.Exit(1)
+	}
+
+	endpoint := &Endpoint{PortNum: serveOpts.Port}
+	for _, roleServeOpts := range roles {
+		name, err := getServedRoleName(roleServeOpts)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		for _, servedRole := range endpoint.Roles {
+			if servedRole.Name == name {
+				log.Println("duplicate role name:", name)
+				os.Exit(1)
 			}
-			mutex.Unlock()
 		}
-	}()
+
+		refresher := NewCredentialsRefresher(roleServeOpts.CredentialsOpts)
+		err = refresher.RefreshWithContext(ctx)
+		if err != nil {
+			log.Printf("unable to obtain credentials for role %s: %s", name, err)
+			os.Exit(1)
+		}
+		endpoint.Roles = append(endpoint.Roles, &ServedRole{
+			Name:      name,
+			RoleArn:   roleServeOpts.CredentialsOpts.RoleArn,
+			Refresher: refresher,
+		})
+	}
+	endpoint.TmpCred, _ = endpoint.Roles[0].Refresher.Credentials()
+	// Background threads that refresh credentials ahead of their expiry
+	for _, servedRole := range endpoint.Roles {
+		go servedRole.Refresher.Run(ctx)
+	}
+
+	mux := http.NewServeMux()
+	endpoint.Server = &http.Server{
+		Handler:     AuthorizePeerHandler(mux, &serveOpts),
+		ConnContext: PeerCredentialsConnContext,
+	}
+
+	if serveOpts.Mode == EcsServeMode {
+		for _, servedRole := range endpoint.Roles {
+			mux.HandleFunc(ECS_CREDENTIALS_RESOURCE_PATH+"/"+servedRole.Name, EcsCredentialsHandler(servedRole.Refresher, servedRole.RoleArn, &serveOpts))
+		}
+		// A single role is also served without its name, as before
+		if len(endpoint.Roles) == 1 {
+			mux.HandleFunc(ECS_CREDENTIALS_RESOURCE_PATH, EcsCredentialsHandler(endpoint.Roles[0].Refresher, endpoint.Roles[0].RoleArn, &serveOpts))
+		}
+	} else {
+		putTokenHandler, getRoleNameHandler, getCredentialsHandler := AllRolesHandlers(endpoint.Roles)
+
+		mux.HandleFunc(TOKEN_RESOURCE_PATH, putTokenHandler)
+		mux.HandleFunc(SECURITY_CREDENTIALS_RESOURCE_PATH, getRoleNameHandler)
+		for _, servedRole := range endpoint.Roles {
+			mux.HandleFunc(SECURITY_CREDENTIALS_RESOURCE_PATH+servedRole.Name, getCredentialsHandler)
+		}
+
+		// Background thread that cleans up expired tokens
+		ticker := time.NewTicker(5 * time.Second)
+		go func() {
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				curTime := time.Now()
+				mutex.Lock()
+				for key, value := range tokenMap {
+					if curTime.After(value) {
+						delete(tokenMap, key)
+						log.Printf("removed expired token: %s", key)
+					}
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
 
 	// Start the credentials endpoint
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", LocalHostAddress, endpoint.PortNum))
+	listener, err := CreateListener(&serveOpts)
 	if err != nil {
-		log.Println("failed to create listener")
+		log.Println("failed to create listener:", err)
 		os.Exit(1)
 	}
-	endpoint.PortNum = listener.Addr().(*net.TCPAddr).Port
-	log.Println("Local server started on port:", endpoint.PortNum)
-	log.Println("Make it available to the sdk by running:")
-	log.Printf("export AWS_EC2_METADATA_SERVICE_ENDPOINT=http://%s:%d/", LocalHostAddress, endpoint.PortNum)
-	if err := endpoint.Server.Serve(listener); err != nil {
+	if tcpAddr, ok := listener.Addr().(*net.TCPAddr); ok {
+		endpoint.PortNum = tcpAddr.Port
+		log.Println("Local server started on port:", endpoint.PortNum)
+		log.Println("Make it available to the sdk by running:")
+		if serveOpts.Mode == EcsServeMode {
+			if len(endpoint.Roles) == 1 {
+				log.Printf("export AWS_CONTAINER_CREDENTIALS_FULL_URI=http://%s:%d%s", LocalHostAddress, endpoint.PortNum, ECS_CREDENTIALS_RESOURCE_PATH)
+			} else {
+				log.Printf("export AWS_CONTAINER_CREDENTIALS_FULL_URI=http://%s:%d%s/<role name>", LocalHostAddress, endpoint.PortNum, ECS_CREDENTIALS_RESOURCE_PATH)
+			}
+			if serveOpts.AuthorizationTokenFile != "" {
+				log.Printf("export AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE=%s", serveOpts.AuthorizationTokenFile)
+			} else {
+				log.Println("export AWS_CONTAINER_AUTHORIZATION_TOKEN=<authorization token>")
+			}
+		} else {
+			log.Printf("export AWS_EC2_METADATA_SERVICE_ENDPOINT=http://%s:%d/", LocalHostAddress, endpoint.PortNum)
+		}
+	} else {
+		log.Println("Local server started on unix socket:", listener.Addr().String())
+	}
+	var roleNames []string
+	for _, servedRole := range endpoint.Roles {
+		roleNames = append(roleNames, servedRole.Name)
+	}
+	log.Println("Serving credentials for roles:", strings.Join(roleNames, ", "))
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		endpoint.Server.Shutdown(shutdownCtx)
+	}()
+	if err := endpoint.Server.Serve(listener); err != http.ErrServerClosed {
 		log.Println("Httpserver: ListenAndServe() error")
 		os.Exit(1)
 	}
+	log.Println("Local server shut down")
 }
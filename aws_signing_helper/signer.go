@@ -26,12 +26,23 @@ import (
 )
 
 type SigningOpts struct {
-	// Private key to use for the signing operation.
+	// Private key to use for the signing operation. Either an rsa.PrivateKey
+	// or ecdsa.PrivateKey value, or any crypto.Signer.
 	PrivateKey crypto.PrivateKey
 	// Digest to use in the signing operation. For example, SHA256
 	Digest crypto.Hash
+	// Padding of RSA signatures; one of PaddingPKCS1v15 (the default) and
+	// PaddingPSS. Only PaddingPKCS1v15 applies to ECDSA keys.
+	Padding string
 }
 
+// Padding schemes of RSA signatures
+const (
+	PaddingPKCS1v15 = "pkcs1v15"
+	// RSASSA-PSS, with MGF1 over the signing digest and a salt as long as the digest
+	PaddingPSS = "pss"
+)
+
 // Container for data that will be sent in a request to CreateSession.
 type RequestOpts struct {
 	// ARN of the Role to assume in the CreateSession call.
@@ -100,7 +111,10 @@ type CredentialProcessOutput struct {
 	Expiration string `json:"Expiration"`
 }
 
+// Signs requests to Roles Anywhere with SigV4-X509. Use NewRolesAnywhereSigner
+// to create one from an arbitrary crypto.Signer.
 type RolesAnywhereSigner struct {
+	// Either an rsa.PrivateKey or ecdsa.PrivateKey value, or any crypto.Signer
 	PrivateKey       crypto.PrivateKey
 	Certificate      x509.Certificate
 	CertificateChain []x509.Certificate
@@ -168,31 +182,108 @@ func certificateChainToString(certificateChain []x509.Certificate) string {
 	return x509ChainString.String()
 }
 
+// Creates a RolesAnywhereSigner from any crypto.Signer (for example, a key held in
+// an HSM, a KMS stand-in or a remote agent), the signing certificate and an optional
+// certificate chain. The signing algorithm is derived from the signer's public key.
+func NewRolesAnywhereSigner(signer crypto.Signer, certificate *x509.Certificate, certificateChain []*x509.Certificate) (*RolesAnywhereSigner, error) {
+	if signer == nil {
+		return nil, errors.New("no signer provided")
+	}
+	if certificate == nil {
+		return nil, errors.New("no certificate provided")
+	}
+
+	publicKey := signer.Public()
+	if publicKey != nil {
+		comparablePublicKey, ok := publicKey.(interface {
+			Equal(crypto.PublicKey) bool
+		})
+		if !ok || !comparablePublicKey.Equal(certificate.PublicKey) {
+			return nil, errors.New("signer does not match the certificate's public key")
+		}
+	}
+	if _, err := getSigningAlgorithm(publicKey, certificate); err != nil {
+		return nil, err
+	}
+	if err := checkPSSOnlySigner(signer); err != nil {
+		return nil, err
+	}
+
+	var chain []x509.Certificate
+	for _, chainCertificate := range certificateChain {
+		chain = append(chain, *chainCertificate)
+	}
+	return &RolesAnywhereSigner{PrivateKey: signer, Certificate: *certificate, CertificateChain: chain}, nil
+}
+
+// Obtain a crypto.Signer for the private key. Private keys may be provided either
+// as rsa.PrivateKey and ecdsa.PrivateKey values, or as any crypto.Signer.
+func getSigner(privateKey crypto.PrivateKey) (crypto.Signer, error) {
+	switch key := privateKey.(type) {
+	case rsa.PrivateKey:
+		return &key, nil
+	case ecdsa.PrivateKey:
+		return &key, nil
+	case crypto.Signer:
+		return key, nil
+	}
+	return nil, errors.New("unsupported algorithm")
+}
+
+// Returned for RSA keys that can only make RSASSA-PSS signatures (such as keys
+// on a PKCS#11 token or a TPM that are restricted to PSS by policy), since
+// Roles Anywhere only accepts RSASSA-PKCS1-v1_5 signatures from RSA keys
+var ErrPSSOnlyPrivateKey = errors.New("private key only allows RSASSA-PSS signatures, but Roles Anywhere requires RSASSA-PKCS1-v1_5 (AWS4-X509-RSA-SHA256)")
+
+// Implemented by signers whose keys can be restricted to RSASSA-PSS
+type pssOnlySigner interface {
+	pssOnly() bool
+}
+
+// Checks that the signer can make the signatures Roles Anywhere accepts, so
+// that keys restricted to RSASSA-PSS are refused before anything is sent
+func checkPSSOnlySigner(signer crypto.Signer) error {
+	if key, ok := signer.(pssOnlySigner); ok && key.pssOnly() {
+		return ErrPSSOnlyPrivateKey
+	}
+	return nil
+}
+
+// Find the signing algorithm from the public key. Roles Anywhere only accepts
+// AWS4-X509-RSA-SHA256 and AWS4-X509-ECDSA-SHA256, so requests are always
+// signed with a SHA256 digest (and PKCS#1 v1.5 padding for RSA keys). Signers
+// that can't expose their public key (such as some tokens) fall back to the
+// certificate's key.
+func getSigningAlgorithm(publicKey crypto.PublicKey, certificate *x509.Certificate) (string, error) {
+	if publicKey == nil && certificate != nil {
+		publicKey = certificate.PublicKey
+	}
+	switch publicKey.(type) {
+	case *rsa.PublicKey:
+		return aws4_x509_rsa_sha256, nil
+	case *ecdsa.PublicKey:
+		return aws4_x509_ecdsa_sha256, nil
+	}
+	return "", errors.New("unsupported algorithm")
+}
+
 // Create a function that will sign requests, given the signing certificate, optional certificate chain, and the private key
 func CreateSignFunction(privateKey crypto.PrivateKey, certificate x509.Certificate, certificateChain []x509.Certificate) func(*request.Request) {
-	v4x509 := RolesAnywhereSigner{privateKey, certificate, certificateChain}
+	v4x509 := RolesAnywhereSigner{PrivateKey: privateKey, Certificate: certificate, CertificateChain: certificateChain}
+	return v4x509.SignFunction()
+}
+
+// Obtain a function that signs requests with this signer, to be used as a request handler
+func (v4x509 RolesAnywhereSigner) SignFunction() func(*request.Request) {
 	return func(r *request.Request) {
-		v4x509.SignWithCurrTime(r)
+		if err := v4x509.SignWithCurrTime(r); err != nil {
+			r.Error = err
+		}
 	}
 }
 
 // Sign the request using the current time
 func (v4x509 RolesAnywhereSigner) SignWithCurrTime(req *request.Request) error {
-	// Find the signing algorithm
-	var signingAlgorithm string
-	_, isRsaKey := v4x509.PrivateKey.(rsa.PrivateKey)
-	if isRsaKey {
-		signingAlgorithm = aws4_x509_rsa_sha256
-	}
-	_, isEcKey := v4x509.PrivateKey.(ecdsa.PrivateKey)
-	if isEcKey {
-		signingAlgorithm = aws4_x509_ecdsa_sha256
-	}
-	if signingAlgorithm == "" {
-		log.Println("unsupported algorithm")
-		return errors.New("unsupported algorithm")
-	}
-
 	region := req.ClientInfo.SigningRegion
 	if region == "" {
 		region = aws.StringValue(req.Config.Region)
@@ -203,29 +294,64 @@ func (v4x509 RolesAnywhereSigner) SignWithCurrTime(req *request.Request) error {
 		name = req.ClientInfo.ServiceName
 	}
 
-	signerParams := SignerParams{time.Now(), region, name, signingAlgorithm}
+	err := v4x509.SignHTTPRequest(req.HTTPRequest, req.Body, region, name, time.Now())
+	if err != nil {
+		return err
+	}
+	req.SignedHeaderVals = req.HTTPRequest.Header
+	return nil
+}
+
+// Sign an arbitrary HTTP request with SigV4-X509, for the given region and
+// service. The body is read to compute its hash (unless the
+// X-Amz-Content-Sha256 header is already set), and then rewound; it may be nil
+// for requests without a body.
+func (v4x509 RolesAnywhereSigner) SignHTTPRequest(req *http.Request, body io.ReadSeeker, region string, service string, signTime time.Time) error {
+	// Find the signing algorithm
+	signer, err := getSigner(v4x509.PrivateKey)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	signingAlgorithm, err := getSigningAlgorithm(signer.Public(), &v4x509.Certificate)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if err = checkPSSOnlySigner(signer); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	signerParams := SignerParams{signTime, region, service, signingAlgorithm}
 
 	// Set headers that are necessary for signing
-	req.HTTPRequest.Header.Set(host, req.HTTPRequest.URL.Host)
-	req.HTTPRequest.Header.Set(x_amz_date, signerParams.GetFormattedSigningDateTime())
-	req.HTTPRequest.Header.Set(x_amz_x509, certificateToString(v4x509.Certificate))
+	requestHost := req.Host
+	if requestHost == "" {
+		requestHost = req.URL.Host
+	}
+	req.Header.Set(host, requestHost)
+	req.Header.Set(x_amz_date, signerParams.GetFormattedSigningDateTime())
+	req.Header.Set(x_amz_x509, certificateToString(v4x509.Certificate))
 	if v4x509.CertificateChain != nil {
-		req.HTTPRequest.Header.Set(x_amz_x509_chain, certificateChainToString(v4x509.CertificateChain))
+		req.Header.Set(x_amz_x509_chain, certificateChainToString(v4x509.CertificateChain))
 	}
 
-	contentSha256 := calculateContentHash(req.HTTPRequest, req.Body)
-	if req.HTTPRequest.Header.Get(x_amz_content_sha256) == "required" {
-		req.HTTPRequest.Header.Set(x_amz_content_sha256, contentSha256)
+	contentSha256 := calculateContentHash(req, body)
+	if req.Header.Get(x_amz_content_sha256) == "required" {
+		req.Header.Set(x_amz_content_sha256, contentSha256)
 	}
 
-	canonicalRequest, signedHeadersString := createCanonicalRequest(req.HTTPRequest, req.Body, contentSha256)
+	canonicalRequest, signedHeadersString := createCanonicalRequest(req, body, contentSha256)
 
 	stringToSign := CreateStringToSign(canonicalRequest, signerParams)
 
-	signingResult, _ := Sign([]byte(stringToSign), SigningOpts{v4x509.PrivateKey, crypto.SHA256})
+	signingResult, err := Sign([]byte(stringToSign), SigningOpts{PrivateKey: signer, Digest: crypto.SHA256})
+	if err != nil {
+		return err
+	}
 
-	req.HTTPRequest.Header.Set(authorization, BuildAuthorizationHeader(req.HTTPRequest, req.Body, signedHeadersString, signingResult.Signature, v4x509.Certificate, signerParams))
-	req.SignedHeaderVals = req.HTTPRequest.Header
+	req.Header.Set(authorization, BuildAuthorizationHeader(req, body, signedHeadersString, signingResult.Signature, v4x509.Certificate, signerParams))
 	return nil
 }
 
@@ -260,6 +386,35 @@ func createCanonicalQueryString(r *http.Request, body io.ReadSeeker) string {
 	return rawQuery
 }
 
+// Create the canonical URI: the URI-encoded path of the request. As for
+// SigV4, the path is encoded once more on top of the escaping of the URL.
+func createCanonicalURI(r *http.Request) string {
+	path := r.URL.EscapedPath()
+	if r.URL.Opaque != "" {
+		// An opaque URL is of the form //host/path
+		path = "/" + strings.Join(strings.SplitN(r.URL.Opaque, "/", 4)[3:], "/")
+	}
+	if path == "" {
+		return "/"
+	}
+	return escapePath(path)
+}
+
+// URI-encode every byte of the path except unreserved characters and slashes
+func escapePath(path string) string {
+	var buf strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
 // Create the canonical header string.
 func createCanonicalHeaderString(r *http.Request) (string, string) {
 	var headers []string
@@ -338,9 +493,9 @@ func stripExcessSpaces(vals []string) {
 func createCanonicalRequest(r *http.Request, body io.ReadSeeker, contentSha256 string) (string, string) {
 	var canonicalRequestStrBuilder strings.Builder
 	canonicalHeaderString, signedHeadersString := createCanonicalHeaderString(r)
-	canonicalRequestStrBuilder.WriteString("POST")
+	canonicalRequestStrBuilder.WriteString(r.Method)
 	canonicalRequestStrBuilder.WriteString("\n")
-	canonicalRequestStrBuilder.WriteString("/sessions")
+	canonicalRequestStrBuilder.WriteString(createCanonicalURI(r))
 	canonicalRequestStrBuilder.WriteString("\n")
 	canonicalRequestStrBuilder.WriteString(createCanonicalQueryString(r, body))
 	canonicalRequestStrBuilder.WriteString("\n")
@@ -405,24 +560,31 @@ func Sign(payload []byte, opts SigningOpts) (SigningResult, error) {
 		return SigningResult{}, errors.New("unsupported digest")
 	}
 
-	ecdsaPrivateKey, ok := opts.PrivateKey.(ecdsa.PrivateKey)
-	if ok {
-		sig, err := ecdsa.SignASN1(rand.Reader, &ecdsaPrivateKey, hash[:])
-		if err == nil {
-			return SigningResult{hex.EncodeToString(sig)}, nil
-		}
+	signer, err := getSigner(opts.PrivateKey)
+	if err != nil {
+		log.Println(err)
+		return SigningResult{}, err
 	}
 
-	rsaPrivateKey, ok := opts.PrivateKey.(rsa.PrivateKey)
-	if ok {
-		sig, err := rsa.SignPKCS1v15(rand.Reader, &rsaPrivateKey, opts.Digest, hash[:])
-		if err == nil {
-			return SigningResult{hex.EncodeToString(sig)}, nil
+	var signerOpts crypto.SignerOpts = opts.Digest
+	switch opts.Padding {
+	case "", PaddingPKCS1v15:
+	case PaddingPSS:
+		// Signers that can't expose their public key are left to reject PSS themselves
+		if _, ok := signer.Public().(*ecdsa.PublicKey); ok {
+			return SigningResult{}, errors.New("PSS padding can only be used with RSA keys")
 		}
+		signerOpts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: opts.Digest}
+	default:
+		return SigningResult{}, errors.New("unsupported padding")
 	}
 
-	log.Println("unsupported algorithm")
-	return SigningResult{}, errors.New("unsupported algorithm")
+	sig, err := signer.Sign(rand.Reader, hash[:], signerOpts)
+	if err != nil {
+		log.Println(err)
+		return SigningResult{}, err
+	}
+	return SigningResult{hex.EncodeToString(sig)}, nil
 }
 
 func encodeDer(der []byte) (string, error) {
@@ -502,26 +664,35 @@ func readPKCS8PrivateKey(privateKey string) (crypto.PrivateKey, error) {
 		return nil, errors.New("could not parse PEM data")
 	}
 
-	privKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
-	if err != nil {
-		return nil, errors.New("could not parse private key")
+	return parsePKCS8PrivateKey(block.Bytes)
+}
+
+// Load the private key. If a PKCS#11 URI is provided instead of PEM data,
+// a signer backed by the key on the token is returned.
+func ReadPrivateKeyData(privateKey string) (crypto.PrivateKey, error) {
+	return ReadPrivateKeyDataWithPassphrase(privateKey, "")
+}
+
+// Load the private key, decrypting it with the passphrase if it's an
+// encrypted PKCS#8 key. For keys held by a TPM, the passphrase is the
+// authorization value of the key.
+func ReadPrivateKeyDataWithPassphrase(privateKey string, passphrase string) (crypto.PrivateKey, error) {
+	if isPKCS11URI(privateKey) {
+		return GetPKCS11Signer(privateKey)
 	}
 
-	rsaPrivateKey, ok := privKey.(*rsa.PrivateKey)
-	if ok {
-		return *rsaPrivateKey, nil
+	if isTPMKey(privateKey) {
+		return GetTPMSigner(privateKey, passphrase)
 	}
 
-	ecPrivateKey, ok := privKey.(*ecdsa.PrivateKey)
-	if ok {
-		return *ecPrivateKey, nil
+	if isAgentKey(privateKey) {
+		return GetAgentSigner(privateKey)
 	}
 
-	return nil, errors.New("could not parse PKCS8 private key")
-}
+	if IsEncryptedPrivateKey(privateKey) {
+		return readEncryptedPKCS8PrivateKey(privateKey, passphrase)
+	}
 
-// Load the private key
-func ReadPrivateKeyData(privateKey string) (crypto.PrivateKey, error) {
 	if key, err := readPKCS8PrivateKey(privateKey); err == nil {
 		return key, nil
 	}
@@ -537,14 +708,31 @@ func ReadPrivateKeyData(privateKey string) (crypto.PrivateKey, error) {
 	return nil, errors.New("unable to parse private key")
 }
 
+// Obtain the DER-encoded certificate, either from PEM data or from a PKCS#11 token
+func readCertificateDER(certificate string) ([]byte, error) {
+	if isPKCS11URI(certificate) {
+		return readPKCS11CertificateDER(certificate)
+	}
+
+	block, err := parseDERFromPEM(certificate, "CERTIFICATE")
+	if err != nil {
+		return nil, errors.New("could not parse PEM data")
+	}
+	return block.Bytes, nil
+}
+
 // Load the certificate and extract details required by the SDK to construct the StringToSign.
 func ReadCertificateData(certificate string) (CertificateData, error) {
-	block, err := parseDERFromPEM(certificate, "CERTIFICATE")
+	certificateDer, err := readCertificateDER(certificate)
 	if err != nil {
-		return CertificateData{}, errors.New("could not parse PEM data")
+		return CertificateData{}, err
 	}
+	return getCertificateData(certificateDer)
+}
 
-	cert, err := x509.ParseCertificate(block.Bytes)
+// Extract the details required by the SDK from a DER-encoded certificate
+func getCertificateData(certificateDer []byte) (CertificateData, error) {
+	cert, err := x509.ParseCertificate(certificateDer)
 	if err != nil {
 		log.Println("could not parse certificate", err)
 		return CertificateData{}, errors.New("could not parse certificate")
@@ -554,7 +742,7 @@ func ReadCertificateData(certificate string) (CertificateData, error) {
 	serialNumber := cert.SerialNumber.String()
 
 	//encode certificate
-	encodedDer, _ := encodeDer(block.Bytes)
+	encodedDer, _ := encodeDer(certificateDer)
 
 	//extract key type
 	var keyType string
@@ -1,6 +1,7 @@
 package aws_signing_helper
 
 import (
+	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
@@ -9,21 +10,38 @@ import (
 	"crypto/sha256"
 	"crypto/sha512"
 	"crypto/x509"
+	"encoding/asn1"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 	"unicode/utf8"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/private/protocol"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
 )
 
 const TestCredentialsFilePath = "/tmp/credentials"
@@ -146,6 +164,660 @@ func TestBuildAuthorizationHeader(t *testing.T) {
 	}
 }
 
+func TestSignHTTPRequest(t *testing.T) {
+	privateKeyPem, _ := ioutil.ReadFile("../tst/certs/ec-prime256v1-key-pkcs8.pem")
+	certificatePem, _ := ioutil.ReadFile("../tst/certs/ec-prime256v1-sha256-cert.pem")
+	privateKey, err := ReadPrivateKeyData(string(privateKeyPem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificateDer, err := readCertificateDER(string(certificatePem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, _ := x509.ParseCertificate(certificateDer)
+	signer, _ := getSigner(privateKey)
+	v4x509, err := NewRolesAnywhereSigner(signer, certificate, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := strings.NewReader("hello")
+	testRequest, _ := http.NewRequest("PUT", "https://api.example.com/prod/items/a%20b?b=2&a=1", body)
+	signTime := time.Date(2022, 7, 27, 4, 36, 55, 0, time.UTC)
+	err = v4x509.SignHTTPRequest(testRequest, body, "us-east-1", "execute-api", signTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset, _ := body.Seek(0, io.SeekCurrent); offset != 0 {
+		t.Log("expected the body to be rewound after signing")
+		t.Fail()
+	}
+
+	// Rebuild the string to sign independently, and check the signature against it
+	bodyHash := sha256.Sum256([]byte("hello"))
+	canonicalRequest := strings.Join([]string{
+		"PUT",
+		"/prod/items/a%2520b",
+		"a=1&b=2",
+		"host:api.example.com",
+		"x-amz-date:20220727T043655Z",
+		"x-amz-x509:" + base64.StdEncoding.EncodeToString(certificateDer),
+		"",
+		"host;x-amz-date;x-amz-x509",
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := "20220727/us-east-1/execute-api/aws4_request"
+	stringToSign := strings.Join([]string{
+		aws4_x509_ecdsa_sha256,
+		"20220727T043655Z",
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	authorizationHeader := testRequest.Header.Get(authorization)
+	expectedPrefix := aws4_x509_ecdsa_sha256 + " Credential=" + certificate.SerialNumber.String() + "/" + scope +
+		", SignedHeaders=host;x-amz-date;x-amz-x509, Signature="
+	if !strings.HasPrefix(authorizationHeader, expectedPrefix) {
+		t.Fatalf("unexpected authorization header %s", authorizationHeader)
+	}
+	signature, err := hex.DecodeString(strings.TrimPrefix(authorizationHeader, expectedPrefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stringToSignHash := sha256.Sum256([]byte(stringToSign))
+	if !ecdsa.VerifyASN1(certificate.PublicKey.(*ecdsa.PublicKey), stringToSignHash[:], signature) {
+		t.Log("signature doesn't match the canonical request")
+		t.Fail()
+	}
+}
+
+func TestReadPKCS12Data(t *testing.T) {
+	privateKey, certificate, certificateChain, err := ReadPKCS12Data("../tst/certs/rsa-2048-sha256.p12", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := privateKey.(*rsa.PrivateKey); !ok {
+		t.Log("expected an RSA private key")
+		t.Fail()
+	}
+	if certificate.Subject.CommonName != "roles-anywhere-rsa-2048" {
+		t.Logf("unexpected leaf certificate %s", certificate.Subject.CommonName)
+		t.Fail()
+	}
+	if len(certificateChain) != 1 || certificateChain[0].Subject.CommonName != "roles-anywhere-prime256v1-sha256" {
+		t.Log("expected the intermediate certificate to be read")
+		t.Fail()
+	}
+	signer, _ := getSigner(privateKey)
+	if _, err = NewRolesAnywhereSigner(signer, certificate, certificateChain); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+
+	_, _, _, err = ReadPKCS12Data("../tst/certs/rsa-2048-sha256.p12", "wrong-password")
+	if err != ErrIncorrectPKCS12Password {
+		t.Logf("expected an incorrect password error, got %v", err)
+		t.Fail()
+	}
+
+	// The certificate data has to match that of the PEM certificate
+	certificateData, err := ReadPKCS12CertificateData("../tst/certs/ec-prime256v1-sha256-nopass.p12", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificatePem, _ := ioutil.ReadFile("../tst/certs/ec-prime256v1-sha256-cert.pem")
+	expectedCertificateData, _ := ReadCertificateData(string(certificatePem))
+	if certificateData.CertificateData != expectedCertificateData.CertificateData || certificateData.KeyType != "EC" {
+		t.Log("unexpected certificate data read from PKCS#12 file")
+		t.Fail()
+	}
+}
+
+func TestReadEncryptedPrivateKeyData(t *testing.T) {
+	fixtures := []struct {
+		EncryptedKeyPath string
+		KeyPath          string
+	}{
+		{"../tst/certs/rsa-2048-key-pkcs8-aes256.pem", "../tst/certs/rsa-2048-key-pkcs8.pem"},
+		{"../tst/certs/ec-prime256v1-key-pkcs8-des3.pem", "../tst/certs/ec-prime256v1-key-pkcs8.pem"},
+		{"../tst/certs/ec-prime256v1-key-pkcs8-scrypt.pem", "../tst/certs/ec-prime256v1-key-pkcs8.pem"},
+	}
+	for _, fixture := range fixtures {
+		encryptedKeyPem, _ := ioutil.ReadFile(fixture.EncryptedKeyPath)
+		keyPem, _ := ioutil.ReadFile(fixture.KeyPath)
+		if !IsEncryptedPrivateKey(string(encryptedKeyPem)) || IsEncryptedPrivateKey(string(keyPem)) {
+			t.Logf("unable to tell whether %s is encrypted", fixture.EncryptedKeyPath)
+			t.Fail()
+		}
+
+		privateKey, err := ReadPrivateKeyDataWithPassphrase(string(encryptedKeyPem), "passphrase")
+		if err != nil {
+			t.Logf("unable to read %s: %s", fixture.EncryptedKeyPath, err)
+			t.Fail()
+			continue
+		}
+		expectedPrivateKey, _ := ReadPrivateKeyData(string(keyPem))
+		signer, _ := getSigner(privateKey)
+		expectedSigner, _ := getSigner(expectedPrivateKey)
+		if !signer.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(expectedSigner.Public()) {
+			t.Logf("unexpected key decrypted from %s", fixture.EncryptedKeyPath)
+			t.Fail()
+		}
+
+		for _, passphrase := range []string{"wrong-passphrase", ""} {
+			_, err = ReadPrivateKeyDataWithPassphrase(string(encryptedKeyPem), passphrase)
+			if err != ErrIncorrectPrivateKeyPassphrase {
+				t.Logf("expected an incorrect passphrase error for %s, got %v", fixture.EncryptedKeyPath, err)
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestSigningAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rolesanywhere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "agent.sock")
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	uid := uint32(os.Getuid())
+	fixtures := []struct {
+		privateKey  crypto.PrivateKey
+		allowedUids []uint32
+		authorized  bool
+	}{
+		{*rsaKey, nil, true},
+		{*ecKey, nil, true},
+		{*ecKey, []uint32{uid}, true},
+		{*ecKey, []uint32{uid + 1}, false},
+	}
+	for _, fixture := range fixtures {
+		if fixture.allowedUids != nil && runtime.GOOS != "linux" {
+			continue
+		}
+		serveOpts := ServeOpts{
+			Listen:      UNIX_LISTEN_PREFIX + socketPath,
+			AllowedUids: fixture.allowedUids,
+		}
+		listener, err := CreateListener(&serveOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go serveAgent(listener, fixture.privateKey, nil, &serveOpts)
+
+		privateKey, err := ReadPrivateKeyData(AGENT_KEY_PREFIX + socketPath)
+		if !fixture.authorized {
+			if err == nil || !strings.Contains(err.Error(), "peer is not authorized") {
+				t.Log("expected unauthorized peer to be rejected")
+				t.Fail()
+			}
+			listener.Close()
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer := privateKey.(*AgentSigner)
+
+		for _, digest := range []crypto.Hash{crypto.SHA256, crypto.SHA384, crypto.SHA512} {
+			payload := []byte("payload")
+			signingResult, err := Sign(payload, SigningOpts{PrivateKey: signer, Digest: digest})
+			if err != nil {
+				t.Fatal(err)
+			}
+			signature, _ := hex.DecodeString(signingResult.Signature)
+			hash := digest.New()
+			hash.Write(payload)
+			switch publicKey := signer.Public().(type) {
+			case *rsa.PublicKey:
+				err = rsa.VerifyPKCS1v15(publicKey, digest, hash.Sum(nil), signature)
+			case *ecdsa.PublicKey:
+				if !ecdsa.VerifyASN1(publicKey, hash.Sum(nil), signature) {
+					err = errors.New("invalid ECDSA signature")
+				}
+			}
+			if err != nil {
+				t.Log(err)
+				t.Fail()
+			}
+		}
+
+		// PSS signatures are only produced for RSA keys
+		digest := sha256.Sum256([]byte("payload"))
+		signature, err := signer.Sign(rand.Reader, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256})
+		if publicKey, ok := signer.Public().(*rsa.PublicKey); ok {
+			if err == nil {
+				err = rsa.VerifyPSS(publicKey, crypto.SHA256, digest[:], signature, nil)
+			}
+			if err != nil {
+				t.Log(err)
+				t.Fail()
+			}
+		} else if err == nil {
+			t.Log("expected agent to refuse PSS padding for an EC key")
+			t.Fail()
+		}
+
+		// Digests that don't match their hash function are refused
+		if _, err = signer.Sign(rand.Reader, []byte("digest"), crypto.SHA256); err == nil {
+			t.Log("expected agent to refuse a digest of the wrong length")
+			t.Fail()
+		}
+		signer.Close()
+		listener.Close()
+	}
+}
+
+func TestSigningAgentPublicKeyFromCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rolesanywhere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "agent.sock")
+
+	privateKeyPem, _ := ioutil.ReadFile("../tst/certs/ec-prime256v1-key-pkcs8.pem")
+	certificatePem, _ := ioutil.ReadFile("../tst/certs/ec-prime256v1-sha256-cert.pem")
+	privateKey, err := ReadPrivateKeyData(string(privateKeyPem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificateDer, err := readCertificateDER(string(certificatePem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, _ := x509.ParseCertificate(certificateDer)
+	signer, _ := getSigner(privateKey)
+	keylessSigner := publicKeylessSigner{opaqueSigner{signer}}
+	serveOpts := ServeOpts{Listen: UNIX_LISTEN_PREFIX + socketPath}
+
+	// Without a certificate, a signer without a public key can't be served
+	listener, err := CreateListener(&serveOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := serveAgent(listener, keylessSigner, nil, &serveOpts); err == nil || !strings.Contains(err.Error(), "unable to find the public key") {
+		t.Logf("expected a missing public key error, got %v", err)
+		t.Fail()
+	}
+
+	// A certificate for another key is refused
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := serveAgent(listener, *otherKey, certificate, &serveOpts); err == nil {
+		t.Log("expected a certificate that doesn't match the key to be refused")
+		t.Fail()
+	}
+
+	// With the certificate, its public key is handed to clients
+	go serveAgent(listener, keylessSigner, certificate, &serveOpts)
+	defer listener.Close()
+	agentKey, err := ReadPrivateKeyData(AGENT_KEY_PREFIX + socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentSigner := agentKey.(*AgentSigner)
+	defer agentSigner.Close()
+	if !certificate.PublicKey.(*ecdsa.PublicKey).Equal(agentSigner.Public()) {
+		t.Log("expected the agent to hand out the certificate's public key")
+		t.Fail()
+	}
+}
+
+// Connection to the data port of swtpm, on which every read returns a whole
+// TPM response, as reads from a TPM device do
+type swtpmConn struct {
+	net.Conn
+}
+
+func (c swtpmConn) Read(b []byte) (int, error) {
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint32(header[2:6]))
+	if size < len(header) || size > len(b) {
+		return 0, errors.New("invalid TPM response size")
+	}
+	copy(b, header)
+	if _, err := io.ReadFull(c.Conn, b[len(header):size]); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// Starts the swtpm simulator, and makes TPM signers use it. Tests that need a
+// TPM are skipped if swtpm isn't installed.
+func startSwtpm(t *testing.T) {
+	swtpmPath, err := exec.LookPath("swtpm")
+	if err != nil {
+		t.Skip("swtpm isn't installed")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	swtpm := exec.Command(swtpmPath, "socket", "--tpm2",
+		"--tpmstate", "dir="+t.TempDir(),
+		"--server", fmt.Sprintf("type=tcp,port=%d", port),
+		"--ctrl", fmt.Sprintf("type=tcp,port=%d", port+1),
+		"--flags", "not-need-init,startup-clear")
+	if err = swtpm.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		swtpm.Process.Kill()
+		swtpm.Wait()
+	})
+
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	openTPM = func() (io.ReadWriteCloser, error) {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		return swtpmConn{conn}, nil
+	}
+	t.Cleanup(func() {
+		openTPM = openTPMDevice
+	})
+	for i := 0; i < 50; i++ {
+		if conn, err := openTPM(); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("swtpm didn't start")
+}
+
+func TestTPMSign(t *testing.T) {
+	startSwtpm(t)
+	rw, err := openTPM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+
+	signingTemplates := map[string]tpm2.Public{
+		"rsa": {
+			Type:       tpm2.AlgRSA,
+			NameAlg:    tpm2.AlgSHA256,
+			Attributes: tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth,
+			RSAParameters: &tpm2.RSAParams{
+				KeyBits: 2048,
+			},
+		},
+		"ecdsa": {
+			Type:       tpm2.AlgECC,
+			NameAlg:    tpm2.AlgSHA256,
+			Attributes: tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth,
+			ECCParameters: &tpm2.ECCParams{
+				CurveID: tpm2.CurveNISTP256,
+			},
+		},
+	}
+
+	persistentHandle := tpmutil.Handle(0x81000010)
+	for name, template := range signingTemplates {
+		// A key persisted under a handle
+		handle, _, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "key-password", template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tpm2.EvictControl(rw, "", tpm2.HandleOwner, handle, persistentHandle)
+		tpm2.FlushContext(rw, handle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkTPMSigner(t, name+"-handle", fmt.Sprintf("handle:0x%x", persistentHandle), "key-password")
+		tpm2.EvictControl(rw, "", tpm2.HandleOwner, persistentHandle, persistentHandle)
+
+		// A key in a TSS2 PEM file, created under the storage root key
+		srk, _, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", srkTemplate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		privateBlob, publicBlob, _, _, _, err := tpm2.CreateKey(rw, srk, tpm2.PCRSelection{}, "", "", template)
+		tpm2.FlushContext(rw, srk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizePrefixed := func(b []byte) []byte {
+			return append([]byte{byte(len(b) >> 8), byte(len(b))}, b...)
+		}
+		der, _ := asn1.Marshal(tss2PrivateKey{
+			Type:       oidLoadableKey,
+			EmptyAuth:  true,
+			Parent:     int64(tpm2.HandleOwner),
+			PublicKey:  sizePrefixed(publicBlob),
+			PrivateKey: sizePrefixed(privateBlob),
+		})
+		tss2Pem := string(pem.EncodeToMemory(&pem.Block{Type: "TSS2 PRIVATE KEY", Bytes: der}))
+		if IsTPMKeyWithAuth(tss2Pem) {
+			t.Log("expected TSS2 key not to require a password")
+			t.Fail()
+		}
+		checkTPMSigner(t, name+"-tss2", tss2Pem, "")
+	}
+}
+
+func TestTPMPSSOnlyKey(t *testing.T) {
+	startSwtpm(t)
+	rw, err := openTPM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+
+	template := tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth,
+		RSAParameters: &tpm2.RSAParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgRSAPSS, Hash: tpm2.AlgSHA256},
+			KeyBits: 2048,
+		},
+	}
+	persistentHandle := tpmutil.Handle(0x81000011)
+	handle, _, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tpm2.EvictControl(rw, "", tpm2.HandleOwner, handle, persistentHandle)
+	tpm2.FlushContext(rw, handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm2.EvictControl(rw, "", tpm2.HandleOwner, persistentHandle, persistentHandle)
+
+	key, err := ReadPrivateKeyDataWithPassphrase(fmt.Sprintf("handle:0x%x", persistentHandle), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := key.(*TPMSigner)
+	defer signer.Close()
+	if err := checkPSSOnlySigner(signer); err != ErrPSSOnlyPrivateKey {
+		t.Logf("expected ErrPSSOnlyPrivateKey, got %v", err)
+		t.Fail()
+	}
+}
+
+// Signs with a TPM key through ReadPrivateKeyDataWithPassphrase, and checks the signature
+func checkTPMSigner(t *testing.T, name string, privateKey string, password string) {
+	key, err := ReadPrivateKeyDataWithPassphrase(privateKey, password)
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	signer := key.(*TPMSigner)
+	defer signer.Close()
+
+	for _, digest := range []crypto.Hash{crypto.SHA256, crypto.SHA384, crypto.SHA512} {
+		payload := []byte("payload")
+		signingResult, err := Sign(payload, SigningOpts{PrivateKey: signer, Digest: digest})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		signature, _ := hex.DecodeString(signingResult.Signature)
+		hash := digest.New()
+		hash.Write(payload)
+		switch publicKey := signer.Public().(type) {
+		case *rsa.PublicKey:
+			err = rsa.VerifyPKCS1v15(publicKey, digest, hash.Sum(nil), signature)
+		case *ecdsa.PublicKey:
+			if !ecdsa.VerifyASN1(publicKey, hash.Sum(nil), signature) {
+				err = errors.New("invalid ECDSA signature")
+			}
+		}
+		if err != nil {
+			t.Logf("%s: %s", name, err)
+			t.Fail()
+		}
+	}
+
+	// PSS signatures are only returned if the TPM used a salt as long as the digest
+	if publicKey, ok := signer.Public().(*rsa.PublicKey); ok {
+		payload := []byte("payload")
+		signingResult, err := Sign(payload, SigningOpts{PrivateKey: signer, Digest: crypto.SHA256, Padding: PaddingPSS})
+		if err == nil {
+			signature, _ := hex.DecodeString(signingResult.Signature)
+			hash := sha256.Sum256(payload)
+			if err = rsa.VerifyPSS(publicKey, crypto.SHA256, hash[:], signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}); err != nil {
+				t.Logf("%s: %s", name, err)
+				t.Fail()
+			}
+		} else if !strings.Contains(err.Error(), "salt length") {
+			t.Logf("%s: %s", name, err)
+			t.Fail()
+		}
+	}
+}
+
+// Wraps a private key so that it's only visible as an opaque crypto.Signer,
+// the way a key held by an HSM or a remote agent would be.
+type opaqueSigner struct {
+	signer crypto.Signer
+}
+
+func (o opaqueSigner) Public() crypto.PublicKey {
+	return o.signer.Public()
+}
+
+func (o opaqueSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return o.signer.Sign(rand, digest, opts)
+}
+
+// Same as opaqueSigner, for a key whose public key isn't known, the way a
+// PKCS#11 token that only holds the private key would be.
+type publicKeylessSigner struct {
+	opaqueSigner
+}
+
+func (o publicKeylessSigner) Public() crypto.PublicKey {
+	return nil
+}
+
+// Same as opaqueSigner, for an RSA key that a token restricts to RSASSA-PSS.
+type pssOnlyTestSigner struct {
+	opaqueSigner
+}
+
+func (o pssOnlyTestSigner) pssOnly() bool {
+	return true
+}
+
+func TestNewRolesAnywhereSigner(t *testing.T) {
+	fixtures := []struct {
+		KeyPath  string
+		CertPath string
+	}{
+		{"../tst/certs/rsa-2048-key-pkcs8.pem", "../tst/certs/rsa-2048-sha256-cert.pem"},
+		{"../tst/certs/ec-prime256v1-key-pkcs8.pem", "../tst/certs/ec-prime256v1-sha256-cert.pem"},
+	}
+	var certificates []*x509.Certificate
+	for _, fixture := range fixtures {
+		privateKeyPem, _ := ioutil.ReadFile(fixture.KeyPath)
+		certificatePem, _ := ioutil.ReadFile(fixture.CertPath)
+		privateKey, err := ReadPrivateKeyData(string(privateKeyPem))
+		if err != nil {
+			t.Log(err)
+			t.Fatal("unable to read private key")
+		}
+		certificateData, _ := ReadCertificateData(string(certificatePem))
+		certificateDerData, _ := base64.StdEncoding.DecodeString(certificateData.CertificateData)
+		certificate, _ := x509.ParseCertificate(certificateDerData)
+		certificates = append(certificates, certificate)
+
+		signer, _ := getSigner(privateKey)
+		v4x509, err := NewRolesAnywhereSigner(opaqueSigner{signer}, certificate, nil)
+		if err != nil {
+			t.Log(err)
+			t.Fail()
+			continue
+		}
+
+		testRequest, _ := http.NewRequest("POST", "https://rolesanywhere.us-west-2.amazonaws.com", nil)
+		awsRequest := request.Request{HTTPRequest: testRequest}
+		if err := v4x509.SignWithCurrTime(&awsRequest); err != nil {
+			t.Log(err)
+			t.Fail()
+		}
+		if testRequest.Header.Get(authorization) == "" {
+			t.Log("expected the request to be signed")
+			t.Fail()
+		}
+	}
+
+	// The signer has to match the certificate
+	rsaPrivateKeyPem, _ := ioutil.ReadFile(fixtures[0].KeyPath)
+	rsaPrivateKey, _ := ReadPrivateKeyData(string(rsaPrivateKeyPem))
+	rsaSigner, _ := getSigner(rsaPrivateKey)
+	if _, err := NewRolesAnywhereSigner(rsaSigner, certificates[1], nil); err == nil {
+		t.Log("expected a mismatched signer and certificate to be rejected")
+		t.Fail()
+	}
+}
+
+func TestPSSOnlySignerIsRejected(t *testing.T) {
+	privateKeyPem, _ := ioutil.ReadFile("../tst/certs/rsa-2048-key-pkcs8.pem")
+	certificatePem, _ := ioutil.ReadFile("../tst/certs/rsa-2048-sha256-cert.pem")
+	privateKey, err := ReadPrivateKeyData(string(privateKeyPem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificateData, _ := ReadCertificateData(string(certificatePem))
+	certificateDerData, _ := base64.StdEncoding.DecodeString(certificateData.CertificateData)
+	certificate, _ := x509.ParseCertificate(certificateDerData)
+	signer, _ := getSigner(privateKey)
+	pssOnlySigner := pssOnlyTestSigner{opaqueSigner{signer}}
+
+	if _, err := NewRolesAnywhereSigner(pssOnlySigner, certificate, nil); err != ErrPSSOnlyPrivateKey {
+		t.Logf("expected ErrPSSOnlyPrivateKey, got %v", err)
+		t.Fail()
+	}
+
+	// Signers that weren't created through NewRolesAnywhereSigner are checked
+	// before signing
+	v4x509 := RolesAnywhereSigner{PrivateKey: pssOnlySigner, Certificate: *certificate}
+	testRequest, _ := http.NewRequest("POST", "https://rolesanywhere.us-west-2.amazonaws.com", nil)
+	if err := v4x509.SignHTTPRequest(testRequest, nil, "us-west-2", "rolesanywhere", time.Now()); err != ErrPSSOnlyPrivateKey {
+		t.Logf("expected ErrPSSOnlyPrivateKey, got %v", err)
+		t.Fail()
+	}
+	if testRequest.Header.Get(authorization) != "" {
+		t.Log("expected the request not to be signed")
+		t.Fail()
+	}
+}
+
 // Verify that the provided payload was signed correctly with the provided options.
 // This function is specifically used for unit testing.
 func Verify(payload []byte, opts SigningOpts, sig []byte) (bool, error) {
@@ -178,7 +850,12 @@ func Verify(payload []byte, opts SigningOpts, sig []byte) (bool, error) {
 	{
 		privateKey, ok := opts.PrivateKey.(rsa.PrivateKey)
 		if ok {
-			err := rsa.VerifyPKCS1v15(&privateKey.PublicKey, opts.Digest, hash, sig)
+			var err error
+			if opts.Padding == PaddingPSS {
+				err = rsa.VerifyPSS(&privateKey.PublicKey, opts.Digest, hash, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+			} else {
+				err = rsa.VerifyPKCS1v15(&privateKey.PublicKey, opts.Digest, hash, sig)
+			}
 			if err == nil {
 				return true, nil
 			}
@@ -204,7 +881,7 @@ func TestSign(t *testing.T) {
 
 	for _, privateKey := range privateKeyList {
 		for _, digest := range digestList {
-			signingResult, err := Sign([]byte(msg), SigningOpts{privateKey, digest})
+			signingResult, err := Sign([]byte(msg), SigningOpts{PrivateKey: privateKey, Digest: digest})
 			if err != nil {
 				t.Log("Failed to sign the input message")
 				t.Fail()
@@ -215,7 +892,7 @@ func TestSign(t *testing.T) {
 				t.Log("Failed to decode the hex-encoded signature")
 				t.Fail()
 			}
-			valid, _ := Verify([]byte(msg), SigningOpts{privateKey, digest}, sig)
+			valid, _ := Verify([]byte(msg), SigningOpts{PrivateKey: privateKey, Digest: digest}, sig)
 			if !valid {
 				t.Log("Failed to verify the signature")
 				t.Fail()
@@ -224,6 +901,148 @@ func TestSign(t *testing.T) {
 	}
 }
 
+func TestSignPSS(t *testing.T) {
+	msg := []byte("test message")
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	for _, digest := range []crypto.Hash{crypto.SHA256, crypto.SHA384, crypto.SHA512} {
+		opts := SigningOpts{PrivateKey: *rsaKey, Digest: digest, Padding: PaddingPSS}
+		signingResult, err := Sign(msg, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, _ := hex.DecodeString(signingResult.Signature)
+		if valid, _ := Verify(msg, opts, sig); !valid {
+			t.Log("Failed to verify the PSS signature")
+			t.Fail()
+		}
+		// A PSS signature isn't a valid PKCS#1 v1.5 signature
+		if valid, _ := Verify(msg, SigningOpts{PrivateKey: *rsaKey, Digest: digest}, sig); valid {
+			t.Log("PSS signature unexpectedly verified with PKCS#1 v1.5 padding")
+			t.Fail()
+		}
+	}
+
+	if _, err := Sign(msg, SigningOpts{PrivateKey: *ecKey, Digest: crypto.SHA256, Padding: PaddingPSS}); err == nil {
+		t.Log("expected PSS padding to be rejected for an EC key")
+		t.Fail()
+	}
+	if _, err := Sign(msg, SigningOpts{PrivateKey: *rsaKey, Digest: crypto.SHA256, Padding: "oaep"}); err == nil {
+		t.Log("expected unknown padding to be rejected")
+		t.Fail()
+	}
+}
+
+func TestCreateSessionWithRetries(t *testing.T) {
+	serviceUnavailable := awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "service unavailable", nil), 503, "")
+	throttled := awserr.NewRequestFailure(awserr.New("ThrottlingException", "rate exceeded", nil), 429, "")
+	badRequest := awserr.NewRequestFailure(awserr.New("BadRequest", "bad request", nil), 400, "")
+	connectionReset := awserr.New(request.ErrCodeRequestError, "send request failed", &net.OpError{Op: "read", Err: errors.New("connection reset by peer")})
+	accessDenied := &AccessDeniedException{RespMetadata: protocol.ResponseMetadata{StatusCode: 403}, Message_: aws.String("untrusted certificate")}
+
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond * 2}
+	fixtures := []struct {
+		name     string
+		errs     []error
+		policy   RetryPolicy
+		kind     error
+		attempts int
+	}{
+		{"recovers-after-server-errors", []error{serviceUnavailable, serviceUnavailable}, policy, nil, 3},
+		{"recovers-after-connection-reset", []error{connectionReset}, policy, nil, 2},
+		{"gives-up-after-max-attempts", []error{throttled, throttled, throttled, throttled}, policy, ErrThrottled, 3},
+		{"access-denied-isnt-retried", []error{accessDenied}, policy, ErrAccessDenied, 1},
+		{"validation-isnt-retried", []error{badRequest}, policy, ErrValidation, 1},
+		{"gives-up-past-deadline", []error{serviceUnavailable, serviceUnavailable},
+			RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Hour, MaxBackoff: time.Hour, MaxElapsedTime: time.Millisecond}, ErrServiceFailure, 1},
+	}
+	for _, fixture := range fixtures {
+		t.Run(fixture.name, func(t *testing.T) {
+			attempts := 0
+			_, err := createSessionWithRetries(context.Background(), fixture.policy, func() (*CreateSessionOutput, error) {
+				attempts++
+				if attempts <= len(fixture.errs) {
+					return nil, fixture.errs[attempts-1]
+				}
+				return &CreateSessionOutput{}, nil
+			})
+			if attempts != fixture.attempts {
+				t.Logf("expected %d attempts, got %d", fixture.attempts, attempts)
+				t.Fail()
+			}
+			if fixture.kind == nil {
+				if err != nil {
+					t.Log(err)
+					t.Fail()
+				}
+				return
+			}
+			var sessionErr *CreateSessionError
+			if !errors.Is(err, fixture.kind) || !errors.As(err, &sessionErr) || sessionErr.Attempts != fixture.attempts {
+				t.Logf("expected %q failure after %d attempts, got %v", fixture.kind, fixture.attempts, err)
+				t.Fail()
+			}
+		})
+	}
+
+	// The error returned by the SDK can still be extracted
+	_, err := createSessionWithRetries(context.Background(), policy, func() (*CreateSessionOutput, error) {
+		return nil, accessDenied
+	})
+	var accessDeniedErr *AccessDeniedException
+	if !errors.As(err, &accessDeniedErr) || errors.Is(err, ErrNetwork) {
+		t.Log("expected error to unwrap to the AccessDeniedException")
+		t.Fail()
+	}
+}
+
+func TestCreateSessionWithRetriesCancelled(t *testing.T) {
+	serviceUnavailable := awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "service unavailable", nil), 503, "")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := createSessionWithRetries(ctx, RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Hour, MaxBackoff: time.Hour}, func() (*CreateSessionOutput, error) {
+		return nil, serviceUnavailable
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Logf("expected the context's error, got %v", err)
+		t.Fail()
+	}
+	if time.Since(start) > time.Second {
+		t.Log("expected the backoff to be interrupted by the context")
+		t.Fail()
+	}
+}
+
+func TestGetSigningAlgorithm(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	fixtures := []struct {
+		publicKey crypto.PublicKey
+		algorithm string
+	}{
+		{&rsaKey.PublicKey, "AWS4-X509-RSA-SHA256"},
+		{&ecKey.PublicKey, "AWS4-X509-ECDSA-SHA256"},
+		{nil, ""},
+	}
+	for _, fixture := range fixtures {
+		algorithm, err := getSigningAlgorithm(fixture.publicKey, nil)
+		if fixture.algorithm == "" {
+			if err == nil {
+				t.Logf("expected error, got %s", algorithm)
+				t.Fail()
+			}
+			continue
+		}
+		if err != nil || algorithm != fixture.algorithm {
+			t.Logf("expected %s, got %s (%v)", fixture.algorithm, algorithm, err)
+			t.Fail()
+		}
+	}
+}
+
 func TestCredentialProcess(t *testing.T) {
 	testTable := []struct {
 		name   string
@@ -270,6 +1089,230 @@ func TestCredentialProcess(t *testing.T) {
 	}
 }
 
+func TestSessionDuration(t *testing.T) {
+	testTable := []struct {
+		sessionDuration  int
+		expectedDuration int64
+		expectError      bool
+	}{
+		{0, DefaultSessionDuration, false},
+		{900, 900, false},
+		{43200, 43200, false},
+		{899, 0, true},
+		{43201, 0, true},
+	}
+	for _, tc := range testTable {
+		duration, err := getSessionDuration(&CredentialsOpts{SessionDuration: tc.sessionDuration})
+		if tc.expectError != (err != nil) {
+			t.Logf("unexpected error result for session duration %d: %v", tc.sessionDuration, err)
+			t.Fail()
+		}
+		if duration != tc.expectedDuration {
+			t.Logf("Wrong session duration. Expected %d, got %d", tc.expectedDuration, duration)
+			t.Fail()
+		}
+	}
+}
+
+func TestInstanceProperties(t *testing.T) {
+	opts := CredentialsOpts{
+		InstanceProperties:           map[string]string{"cluster": "build", "hostname": "overridden"},
+		WithSystemInstanceProperties: true,
+	}
+	instanceProperties, err := getInstanceProperties(&opts)
+	if err != nil {
+		t.Log(err)
+		t.Fatal("unable to get instance properties")
+	}
+	if *instanceProperties["cluster"] != "build" {
+		t.Log("expected the provided instance property to be present")
+		t.Fail()
+	}
+	if *instanceProperties[HostnameInstanceProperty] != "overridden" {
+		t.Log("expected provided instance properties to take precedence over system ones")
+		t.Fail()
+	}
+	if _, ok := instanceProperties[OSInstanceProperty]; !ok {
+		t.Log("expected system instance properties to be present")
+		t.Fail()
+	}
+
+	instanceProperties, err = getInstanceProperties(&CredentialsOpts{})
+	if err != nil || instanceProperties != nil {
+		t.Log("expected no instance properties to be sent by default")
+		t.Fail()
+	}
+}
+
+// Returns a function that generates credentials expiring after the given duration,
+// counting how many times it was called
+func getCountingGenerateCredentials(validity time.Duration, calls *int32) func(context.Context, *CredentialsOpts) (CredentialProcessOutput, error) {
+	return func(ctx context.Context, opts *CredentialsOpts) (CredentialProcessOutput, error) {
+		atomic.AddInt32(calls, 1)
+		return CredentialProcessOutput{
+			Version:         1,
+			AccessKeyId:     "accessKeyId",
+			SecretAccessKey: "secretAccessKey",
+			SessionToken:    "sessionToken",
+			Expiration:      time.Now().Add(validity).UTC().Format(time.RFC3339),
+		}, nil
+	}
+}
+
+func TestCredentialsCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rolesanywhere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certificatePem, _ := ioutil.ReadFile("../tst/certs/ec-prime256v1-sha256-cert.pem")
+	privateKeyPem, _ := ioutil.ReadFile("../tst/certs/ec-prime256v1-key.pem")
+	opts := CredentialsOpts{
+		PrivateKeyId:      string(privateKeyPem),
+		CertificateId:     string(certificatePem),
+		RoleArn:           "arn:aws:iam::000000000000:role/ExampleS3WriteRole",
+		ProfileArnStr:     "arn:aws:rolesanywhere:us-east-1:000000000000:profile/41cl0bae-6783-40d4-ab20-65dc5d922e45",
+		TrustAnchorArnStr: "arn:aws:rolesanywhere:us-east-1:000000000000:trust-anchor/41cl0bae-6783-40d4-ab20-65dc5d922e45",
+	}
+	for _, encrypt := range []bool{false, true} {
+		cacheOpts := CredentialsCacheOpts{Dir: filepath.Join(dir, fmt.Sprint(encrypt)), RefreshWindow: time.Minute, Encrypt: encrypt}
+
+		// Credentials are only generated once while they're valid
+		var calls int32
+		generateCredentials := getCountingGenerateCredentials(time.Hour, &calls)
+		for i := 0; i < 2; i++ {
+			credentialProcessOutput, err := generateCredentialsWithCache(context.Background(), &opts, cacheOpts, generateCredentials)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if credentialProcessOutput.AccessKeyId != "accessKeyId" {
+				t.Log("unexpected credentials returned from the cache")
+				t.Fail()
+			}
+		}
+		if calls != 1 {
+			t.Logf("expected credentials to be generated once, got %d", calls)
+			t.Fail()
+		}
+
+		entries, _ := filepath.Glob(filepath.Join(cacheOpts.Dir, "*.json"))
+		if len(entries) != 1 {
+			t.Fatalf("expected a single cache entry, got %d", len(entries))
+		}
+		info, _ := os.Stat(entries[0])
+		if info.Mode().Perm() != 0600 {
+			t.Logf("unexpected cache entry mode %o", info.Mode().Perm())
+			t.Fail()
+		}
+		data, _ := ioutil.ReadFile(entries[0])
+		if strings.Contains(string(data), "secretAccessKey") == encrypt {
+			t.Logf("unexpected cache entry contents (encrypted: %t)", encrypt)
+			t.Fail()
+		}
+
+		// Credentials that expire within the refresh window are refreshed
+		refreshOpts := cacheOpts
+		refreshOpts.RefreshWindow = time.Hour * time.Duration(2)
+		generateCredentialsWithCache(context.Background(), &opts, refreshOpts, generateCredentials)
+		if calls != 2 {
+			t.Logf("expected credentials expiring within the refresh window to be refreshed, got %d calls", calls)
+			t.Fail()
+		}
+
+		// Another role has its own entry
+		otherOpts := opts
+		otherOpts.RoleArn = "arn:aws:iam::000000000000:role/ExampleS3ReadRole"
+		generateCredentialsWithCache(context.Background(), &otherOpts, cacheOpts, getCountingGenerateCredentials(time.Hour, &calls))
+		if entries, _ = filepath.Glob(filepath.Join(cacheOpts.Dir, "*.json")); len(entries) != 2 || calls != 3 {
+			t.Log("expected another role to be cached separately")
+			t.Fail()
+		}
+
+		// So do sessions that only differ by their duration, instance properties or endpoint
+		durationOpts := opts
+		durationOpts.SessionDuration = 43200
+		instancePropertiesOpts := opts
+		instancePropertiesOpts.InstanceProperties = map[string]string{"team": "infra"}
+		endpointOpts := opts
+		endpointOpts.Endpoint = "https://rolesanywhere.eu-west-1.amazonaws.com"
+		for i, otherOpts := range []CredentialsOpts{durationOpts, instancePropertiesOpts, endpointOpts} {
+			generateCredentialsWithCache(context.Background(), &otherOpts, cacheOpts, getCountingGenerateCredentials(time.Hour, &calls))
+			if calls != int32(4+i) {
+				t.Logf("expected session %d to be cached separately", i)
+				t.Fail()
+			}
+		}
+	}
+
+	// Keys that can't be read can't encrypt the cache
+	signerOpts := opts
+	signerOpts.PrivateKeyId = "agent:" + filepath.Join(dir, "missing.sock")
+	var calls int32
+	_, err = generateCredentialsWithCache(context.Background(), &signerOpts, CredentialsCacheOpts{Dir: dir, Encrypt: true}, getCountingGenerateCredentials(time.Hour, &calls))
+	if err == nil || calls != 0 {
+		t.Log("expected cache encryption to fail without a readable private key")
+		t.Fail()
+	}
+}
+
+func TestRolesAnywhereProvider(t *testing.T) {
+	var calls int32
+	provider := NewRolesAnywhereProvider(CredentialsOpts{}, func(p *RolesAnywhereProvider) {
+		p.generateCredentials = getCountingGenerateCredentials(time.Hour, &calls)
+	})
+
+	value, err := provider.Retrieve()
+	if err != nil || value.AccessKeyID != "accessKeyId" || value.ProviderName != RolesAnywhereProviderName {
+		t.Log("unexpected credentials retrieved from provider")
+		t.Fail()
+	}
+	if provider.IsExpired() {
+		t.Log("expected credentials to be valid")
+		t.Fail()
+	}
+
+	// Credentials that expire within the expiry window are considered expired
+	provider.generateCredentials = getCountingGenerateCredentials(time.Minute, &calls)
+	provider.Retrieve()
+	if !provider.IsExpired() {
+		t.Log("expected credentials within the expiry window to be expired")
+		t.Fail()
+	}
+}
+
+func TestRolesAnywhereProviderV2(t *testing.T) {
+	var calls int32
+	provider := NewRolesAnywhereProviderV2(CredentialsOpts{}, func(p *RolesAnywhereProviderV2) {
+		p.generateCredentials = getCountingGenerateCredentials(time.Hour, &calls)
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			creds, err := provider.Retrieve(context.Background())
+			if err != nil || creds.AccessKeyID != "accessKeyId" || !creds.CanExpire {
+				t.Log("unexpected credentials retrieved from provider")
+				t.Fail()
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Logf("expected cached credentials to be reused, but CreateSession was called %d times", calls)
+		t.Fail()
+	}
+
+	provider.ExpiryWindow = 2 * time.Hour
+	provider.Retrieve(context.Background())
+	if calls != 2 {
+		t.Log("expected credentials within the expiry window to be refreshed")
+		t.Fail()
+	}
+}
+
 func TestUpdate(t *testing.T) {
 	testTable := []struct {
 		name                 string
@@ -296,6 +1339,8 @@ test
 aws_access_key_id = accessKeyId
 aws_secret_access_key = secretAccessKey
 aws_session_token = sessionToken
+aws_expiration = 2022-07-27T04:36:55Z
+x_security_token_expires = 2022-07-27T04:36:55Z
 [test]
 aws_secret_access_key = test`,
 		},
@@ -319,6 +1364,8 @@ aws_access_key_id = accessKeyId
 test_key = test
 aws_secret_access_key = secretAccessKey
 aws_session_token = sessionToken
+aws_expiration = 2022-07-27T04:36:55Z
+x_security_token_expires = 2022-07-27T04:36:55Z
 [test]
 aws_secret_access_key = test`,
 		},
@@ -340,11 +1387,13 @@ test
 aws_access_key_id = test
 [test]
 aws_secret_access_key = test
+
 [test profile]
 aws_access_key_id = accessKeyId
 aws_secret_access_key = secretAccessKey
 aws_session_token = sessionToken
-`,
+aws_expiration = 2022-07-27T04:36:55Z
+x_security_token_expires = 2022-07-27T04:36:55Z`,
 		},
 		{
 			name:   "test-profile-does-not-exist",
@@ -360,11 +1409,13 @@ test
 test
 [test]
 aws_secret_access_key = test
+
 [test profile]
 aws_access_key_id = accessKeyId
 aws_secret_access_key = secretAccessKey
 aws_session_token = sessionToken
-`,
+aws_expiration = 2022-07-27T04:36:55Z
+x_security_token_expires = 2022-07-27T04:36:55Z`,
 		},
 		{
 			name:   "test-first-word-in-profile-matches",
@@ -383,9 +1434,11 @@ test
 [test profile]
 aws_access_key_id = test
 [test]
-aws_access_key_id = accessKeyId
 aws_secret_access_key = secretAccessKey
-aws_session_token = sessionToken`,
+aws_access_key_id = accessKeyId
+aws_session_token = sessionToken
+aws_expiration = 2022-07-27T04:36:55Z
+x_security_token_expires = 2022-07-27T04:36:55Z`,
 		},
 		{
 			name:   "test-multiple-profiles-with-same-name",
@@ -408,6 +1461,8 @@ test_key = test
 aws_access_key_id = accessKeyId
 aws_secret_access_key = secretAccessKey
 aws_session_token = sessionToken
+aws_expiration = 2022-07-27T04:36:55Z
+x_security_token_expires = 2022-07-27T04:36:55Z
 [test profile]
 aws_access_key_id = test
 [test]
@@ -441,139 +1496,1120 @@ aws_secret_access_key = test`,
 			defer writeOnlyCredentialsFile.Close()
 			writeOnlyCredentialsFile.WriteString(tc.inputFileContents)
 
-			Update(credentialsOpts, tc.profile, true)
+			Update(credentialsOpts, tc.profile, true)
+
+			fileByteContents, _ := ioutil.ReadFile(TestCredentialsFilePath)
+			fileStringContents := trimLastChar(string(fileByteContents))
+			if fileStringContents != tc.expectedFileContents {
+				t.Log("unexpected file contents")
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestUpdateFilePermissions(t *testing.T) {
+	testTable := []struct {
+		name                 string
+		server               *httptest.Server
+		profile              string
+		expectedFileContents string
+	}{
+		{
+			name:    "test-space-separated-keys",
+			server:  GetMockedCreateSessionResponseServer(),
+			profile: "test profile",
+			expectedFileContents: `[test profile]
+aws_access_key_id = accessKeyId
+aws_secret_access_key = secretAccessKey
+aws_session_token = sessionToken
+aws_expiration = 2022-07-27T04:36:55Z
+x_security_token_expires = 2022-07-27T04:36:55Z`,
+		},
+	}
+	for _, tc := range testTable {
+		credentialsOpts := CredentialsOpts{
+			PrivateKeyId:      "../credential-process-data/client-key.pem",
+			CertificateId:     "../credential-process-data/client-cert.pem",
+			RoleArn:           "arn:aws:iam::000000000000:role/ExampleS3WriteRole",
+			ProfileArnStr:     "arn:aws:rolesanywhere:us-east-1:000000000000:profile/41cl0bae-6783-40d4-ab20-65dc5d922e45",
+			TrustAnchorArnStr: "arn:aws:rolesanywhere:us-east-1:000000000000:trust-anchor/41cl0bae-6783-40d4-ab20-65dc5d922e45",
+			Endpoint:          tc.server.URL,
+			SessionDuration:   900,
+		}
+		t.Run(tc.name, func(t *testing.T) {
+			SetupTests()
+			defer tc.server.Close()
+			os.Setenv(AwsSharedCredentialsFileEnvVarName, TestCredentialsFilePath)
+
+			Update(credentialsOpts, tc.profile, true)
+
+			fileByteContents, _ := ioutil.ReadFile(TestCredentialsFilePath)
+			fileStringContents := trimLastChar(string(fileByteContents))
+			if fileStringContents != tc.expectedFileContents {
+				t.Log("unexpected file contents")
+				t.Fail()
+			}
+
+			info, _ := os.Stat(TestCredentialsFilePath)
+			mode := info.Mode()
+			if mode != ((1 << 8) | (1 << 7)) {
+				t.Log("unexpected file mode")
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestGetNewCredentialsFileContents(t *testing.T) {
+	expiration, _ := time.Parse(time.RFC3339, "2022-07-27T04:36:55Z")
+	cred := TemporaryCredential{AccessKeyId: "accessKeyId", SecretAccessKey: "secretAccessKey", SessionToken: "sessionToken", Expiration: expiration}
+	input := `# Shared credentials
+[ default ]
+aws_access_key_id=old
+; keep this comment
+aws_session_token_expiration = unrelated
+aws_session_token=old
+
+[other]
+aws_access_key_id = other
+`
+	expected := `# Shared credentials
+[ default ]
+aws_access_key_id = accessKeyId
+; keep this comment
+aws_session_token_expiration = unrelated
+aws_session_token = sessionToken
+aws_secret_access_key = secretAccessKey
+aws_expiration = 2022-07-27T04:36:55Z
+x_security_token_expires = 2022-07-27T04:36:55Z
+
+[other]
+aws_access_key_id = other
+`
+	contents := strings.Join(GetNewCredentialsFileContents("default", strings.Split(strings.TrimSuffix(input, "\n"), "\n"), &cred), "")
+	if contents != expected {
+		t.Logf("unexpected credentials file contents %q", contents)
+		t.Fail()
+	}
+}
+
+func TestParseIni(t *testing.T) {
+	input := `[profile build]
+region = us-east-1
+s3 =
+  region = eu-west-1
+  max_concurrent_requests = 20
+output=json`
+	iniFile, err := ParseIni(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	section := iniFile.Section("profile build")
+	if section == nil {
+		t.Fatal("expected the section to be found")
+	}
+	// Nested settings aren't keys of the section
+	if region, _ := section.Get("region"); region != "us-east-1" {
+		t.Logf("unexpected region %s", region)
+		t.Fail()
+	}
+	if output, _ := section.Get("output"); output != "json" {
+		t.Logf("unexpected output %s", output)
+		t.Fail()
+	}
+	section.Set("region", "us-west-2")
+	if strings.Join(iniFile.Lines(), "\n") != strings.Replace(input, "region = us-east-1", "region = us-west-2", 1) {
+		t.Log("expected only the modified key to change")
+		t.Fail()
+	}
+	if iniFile.Section("build") != nil {
+		t.Log("unexpected section")
+		t.Fail()
+	}
+}
+
+// Files with CRLF line endings are written back with them
+func TestParseIniCRLF(t *testing.T) {
+	input := "# written on Windows\r\n[default]\r\naws_access_key_id = old\r\nregion = us-east-1\r\n"
+	iniFile, err := ParseIni(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iniFile.LineEnding() != "\r\n" {
+		t.Logf("unexpected line ending %q", iniFile.LineEnding())
+		t.Fail()
+	}
+	if keyId, _ := iniFile.Section("default").Get("aws_access_key_id"); keyId != "old" {
+		t.Logf("unexpected access key %q", keyId)
+		t.Fail()
+	}
+
+	cred := TemporaryCredential{AccessKeyId: "new", SecretAccessKey: "secret", SessionToken: "token"}
+	// Lines split on LF, as the credentials file is read, keep their carriage return
+	contents := strings.Join(GetNewCredentialsFileContents("default", strings.Split(strings.TrimSuffix(input, "\n"), "\n"), &cred), "")
+	if strings.Count(contents, "\n") != strings.Count(contents, "\r\n") || strings.Count(contents, "\r") != strings.Count(contents, "\r\n") {
+		t.Logf("expected only CRLF line endings in %q", contents)
+		t.Fail()
+	}
+	if !strings.HasPrefix(contents, "# written on Windows\r\n[default]\r\naws_access_key_id = new\r\n") {
+		t.Logf("unexpected credentials file contents %q", contents)
+		t.Fail()
+	}
+
+	iniFile, _ = ParseIni(strings.NewReader("[default]\nregion = us-east-1\n"))
+	if iniFile.LineEnding() != "\n" {
+		t.Logf("unexpected line ending %q", iniFile.LineEnding())
+		t.Fail()
+	}
+}
+
+// Every occurrence of a duplicate key is updated, so that the stale value
+// can't win over the new one
+func TestIniSetDuplicateKey(t *testing.T) {
+	input := `[default]
+aws_access_key_id = first
+region = us-east-1
+aws_access_key_id = second`
+	iniFile, err := ParseIni(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	section := iniFile.Section("default")
+	if keyId, _ := section.Get("aws_access_key_id"); keyId != "second" {
+		t.Logf("expected the last occurrence to win, got %q", keyId)
+		t.Fail()
+	}
+	section.Set("aws_access_key_id", "new")
+	expected := strings.Replace(strings.Replace(input, "first", "new", 1), "second", "new", 1)
+	if strings.Join(iniFile.Lines(), "\n") != expected {
+		t.Logf("unexpected contents %q", strings.Join(iniFile.Lines(), "\n"))
+		t.Fail()
+	}
+}
+
+func TestUpdateCredentialsFileConcurrently(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rolesanywhere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	credentialsPath := filepath.Join(dir, "credentials")
+	os.Setenv(AwsSharedCredentialsFileEnvVarName, credentialsPath)
+	defer os.Unsetenv(AwsSharedCredentialsFileEnvVarName)
+	ioutil.WriteFile(credentialsPath, []byte("# managed by update\n[existing]\naws_access_key_id = existing\n"), 0640)
+
+	// Profiles updated concurrently all make it to the file
+	const profiles = 10
+	var wg sync.WaitGroup
+	for i := 0; i < profiles; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cred := TemporaryCredential{AccessKeyId: fmt.Sprintf("accessKeyId%d", i), SecretAccessKey: "secretAccessKey", SessionToken: "sessionToken"}
+			if err := UpdateCredentialsFile(fmt.Sprintf("profile%d", i), &cred); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	contents, _ := ioutil.ReadFile(credentialsPath)
+	for i := 0; i < profiles; i++ {
+		if !strings.Contains(string(contents), fmt.Sprintf("[profile%d]\naws_access_key_id = accessKeyId%d\n", i, i)) {
+			t.Logf("missing profile%d in credentials file", i)
+			t.Fail()
+		}
+	}
+	if !strings.HasPrefix(string(contents), "# managed by update\n[existing]\naws_access_key_id = existing\n") {
+		t.Log("expected existing contents to be kept")
+		t.Fail()
+	}
+
+	// The file keeps its mode, and no temporary file is left behind
+	info, _ := os.Stat(credentialsPath)
+	if info.Mode().Perm() != 0640 {
+		t.Logf("unexpected credentials file mode %o", info.Mode().Perm())
+		t.Fail()
+	}
+	leftovers, _ := filepath.Glob(filepath.Join(dir, ".credentials.tmp-*"))
+	if len(leftovers) != 0 {
+		t.Logf("unexpected temporary files %v", leftovers)
+		t.Fail()
+	}
+
+	// Reads and writes through the public functions wait for the lock
+	written := make(chan error)
+	withFileLock(credentialsPath+".lock", func() error {
+		go func() {
+			lines, err := GetCredentialsFileContents()
+			if err == nil {
+				err = WriteTo("locked", lines, &TemporaryCredential{AccessKeyId: "lockedAccessKeyId"})
+			}
+			written <- err
+		}()
+		select {
+		case <-written:
+			t.Log("expected the credentials file not to be read or written while locked")
+			t.Fail()
+		case <-time.After(200 * time.Millisecond):
+		}
+		return nil
+	})
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	contents, _ = ioutil.ReadFile(credentialsPath)
+	if !strings.Contains(string(contents), "[locked]\naws_access_key_id = lockedAccessKeyId\n") || !strings.Contains(string(contents), "[profile0]\n") {
+		t.Log("expected the profile to be added to the credentials file once unlocked")
+		t.Fail()
+	}
+}
+
+func TestGenerateLongToken(t *testing.T) {
+	_, err := GenerateToken(150)
+	if err == nil {
+		t.Log("token generation should've failed since token size is too large")
+		t.Fail()
+	}
+}
+
+func TestGenerateToken(t *testing.T) {
+	token1, err := GenerateToken(100)
+	if err != nil {
+		t.Log("unexpected failure in generating token")
+		t.Fail()
+	}
+
+	token2, err := GenerateToken(100)
+	if err != nil {
+		t.Log("unexpected failure in generating token")
+		t.Fail()
+	}
+
+	if token1 == token2 {
+		t.Log("expected two randomly generated tokens to be different")
+		t.Fail()
+	}
+}
+
+func TestStoreValidToken(t *testing.T) {
+	token, err := GenerateToken(100)
+	if err != nil {
+		t.Log("unexpected failure in generating token")
+		t.Fail()
+	}
+
+	err = InsertToken(token, time.Now().Add(time.Second*time.Duration(100)))
+	if err != nil {
+		t.Log("unexpected failure when inserting token")
+		t.Fail()
+	}
+
+	httpRequest, err := http.NewRequest("GET", "http://127.0.0.1", nil)
+	if err != nil {
+		t.Log("unable to create test http request")
+		t.Fail()
+	}
+	httpRequest.Header.Add(EC2_METADATA_TOKEN_HEADER, token)
+
+	err = CheckValidToken(nil, httpRequest)
+	if err != nil {
+		t.Log("expected previously inserted token to be valid")
+		t.Fail()
+	}
+}
+
+func Test(t *testing.T) {
+	httpRequest, err := http.NewRequest("GET", "http://127.0.0.1", nil)
+	if err != nil {
+		t.Log("unable to create test http request")
+		t.Fail()
+	}
+	httpRequest.Header.Add("test-header", "test-header-value")
+
+	headerNames := [4]string{"Test-Header", "test-header", "TEST-HEADER", "tEST-hEadeR"}
+	for _, header := range headerNames {
+		testHeaderValue := httpRequest.Header.Get(header)
+		if testHeaderValue != "test-header-value" {
+			t.Log("header name canonicalization not working as expected")
+			t.Fail()
+		}
+	}
+}
+
+func TestEcsCredentialsHandler(t *testing.T) {
+	var calls int32
+	refresher := NewCredentialsRefresher(CredentialsOpts{})
+	refresher.generateCredentials = getCountingGenerateCredentials(time.Hour, &calls)
+	refresher.Refresh()
+	roleArn := "arn:aws:iam::000000000000:role/ExampleS3WriteRole"
+	serveOpts := ServeOpts{Mode: EcsServeMode, AuthorizationToken: "test-token"}
+	handler := EcsCredentialsHandler(refresher, roleArn, &serveOpts)
+
+	testTable := []struct {
+		name               string
+		authorization      string
+		expectedStatusCode int
+	}{
+		{"valid-token", "test-token", http.StatusOK},
+		{"invalid-token", "wrong-token", http.StatusUnauthorized},
+		{"missing-token", "", http.StatusUnauthorized},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.name, func(t *testing.T) {
+			httpRequest := httptest.NewRequest("GET", ECS_CREDENTIALS_RESOURCE_PATH, nil)
+			if tc.authorization != "" {
+				httpRequest.Header.Set(ECS_AUTHORIZATION_HEADER, tc.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			handler(recorder, httpRequest)
+
+			if recorder.Code != tc.expectedStatusCode {
+				t.Logf("Wrong status code. Expected %d, got %d", tc.expectedStatusCode, recorder.Code)
+				t.Fail()
+			}
+			if tc.expectedStatusCode != http.StatusOK {
+				return
+			}
+
+			var ecsCredentials EcsCredentials
+			err := json.NewDecoder(recorder.Body).Decode(&ecsCredentials)
+			if err != nil || ecsCredentials.AccessKeyId != "accessKeyId" || ecsCredentials.Token != "sessionToken" || ecsCredentials.RoleArn != roleArn {
+				t.Log("unexpected credentials returned by ECS endpoint")
+				t.Fail()
+			}
+		})
+	}
+
+	// Tokens can also be read from a file
+	tokenFile := t.TempDir() + "/token"
+	ioutil.WriteFile(tokenFile, []byte("file-token\n"), 0600)
+	serveOpts = ServeOpts{Mode: EcsServeMode, AuthorizationTokenFile: tokenFile}
+	httpRequest := httptest.NewRequest("GET", ECS_CREDENTIALS_RESOURCE_PATH, nil)
+	httpRequest.Header.Set(ECS_AUTHORIZATION_HEADER, "file-token")
+	recorder := httptest.NewRecorder()
+	handler(recorder, httpRequest)
+	if recorder.Code != http.StatusOK {
+		t.Log("expected token from the authorization token file to be accepted")
+		t.Fail()
+	}
+}
+
+func TestCredentialsRefresher(t *testing.T) {
+	var calls int32
+	refresher := NewCredentialsRefresher(CredentialsOpts{})
+	if _, err := refresher.Credentials(); err == nil {
+		t.Log("expected no credentials to be available before the first refresh")
+		t.Fail()
+	}
+
+	refresher.generateCredentials = getCountingGenerateCredentials(time.Hour, &calls)
+	if err := refresher.Refresh(); err != nil {
+		t.Log(err)
+		t.Fatal("unable to refresh credentials")
+	}
+	cred, err := refresher.Credentials()
+	if err != nil || cred.AccessKeyId != "accessKeyId" || cred.Code != REFRESHABLE_CRED_CODE {
+		t.Log("unexpected credentials returned by refresher")
+		t.Fail()
+	}
+
+	// Failed refreshes keep the previous credentials
+	refresher.generateCredentials = func(ctx context.Context, opts *CredentialsOpts) (CredentialProcessOutput, error) {
+		return CredentialProcessOutput{}, errors.New("connection reset")
+	}
+	if err := refresher.Refresh(); err == nil {
+		t.Log("expected refresh to fail")
+		t.Fail()
+	}
+	if cred, err := refresher.Credentials(); err != nil || cred.AccessKeyId != "accessKeyId" {
+		t.Log("expected previous credentials to be kept after a failed refresh")
+		t.Fail()
+	}
+
+	// Expired credentials are no longer handed out
+	refresher.generateCredentials = getCountingGenerateCredentials(-time.Minute, &calls)
+	refresher.Refresh()
+	if _, err := refresher.Credentials(); err == nil {
+		t.Log("expected expired credentials to be unavailable")
+		t.Fail()
+	}
+}
+
+func TestCredentialsRefresherRun(t *testing.T) {
+	defer func(refreshTime, minRefreshInterval, jitter time.Duration) {
+		RefreshTime, MinRefreshInterval, RefreshJitter = refreshTime, minRefreshInterval, jitter
+	}(RefreshTime, MinRefreshInterval, RefreshJitter)
+	RefreshTime, MinRefreshInterval, RefreshJitter = time.Second, time.Millisecond, 0
 
-			fileByteContents, _ := ioutil.ReadFile(TestCredentialsFilePath)
-			fileStringContents := trimLastChar(string(fileByteContents))
-			if fileStringContents != tc.expectedFileContents {
-				t.Log("unexpected file contents")
-				t.Fail()
-			}
-		})
+	var calls int32
+	refresher := NewCredentialsRefresher(CredentialsOpts{})
+	refresher.generateCredentials = getCountingGenerateCredentials(time.Second+10*time.Millisecond, &calls)
+	refresher.Refresh()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		refresher.Run(ctx)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+
+	if atomic.LoadInt32(&calls) < 2 {
+		t.Log("expected credentials to be refreshed ahead of their expiry")
+		t.Fail()
 	}
 }
 
-func TestUpdateFilePermissions(t *testing.T) {
-	testTable := []struct {
-		name                 string
-		server               *httptest.Server
-		profile              string
-		expectedFileContents string
+func TestCredentialsRefresherRunCancelsRefresh(t *testing.T) {
+	defer func(minRefreshInterval time.Duration) {
+		MinRefreshInterval = minRefreshInterval
+	}(MinRefreshInterval)
+	MinRefreshInterval = time.Millisecond
+
+	// The refresh blocks until its context is cancelled, as a hung endpoint would
+	refreshing := make(chan struct{})
+	refresher := NewCredentialsRefresher(CredentialsOpts{})
+	refresher.generateCredentials = func(ctx context.Context, opts *CredentialsOpts) (CredentialProcessOutput, error) {
+		close(refreshing)
+		<-ctx.Done()
+		return CredentialProcessOutput{}, ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		refresher.Run(ctx)
+		close(done)
+	}()
+	<-refreshing
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the refresh in flight to be cancelled")
+	}
+}
+
+func TestExec(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+	os.Setenv("AWS_ACCESS_KEY_ID", "parentAccessKeyId")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	// A default profile with credentials of its own
+	parentCredentialsFile := filepath.Join(t.TempDir(), "credentials")
+	ioutil.WriteFile(parentCredentialsFile, []byte("[default]\naws_access_key_id = parentAccessKeyId\naws_secret_access_key = parentSecretAccessKey\n"), 0600)
+	for name, value := range map[string]string{
+		"AWS_PROFILE":                 "parent",
+		"AWS_DEFAULT_PROFILE":         "parent",
+		"AWS_SHARED_CREDENTIALS_FILE": parentCredentialsFile,
+		"PARENT_CREDENTIALS_FILE":     parentCredentialsFile,
+	} {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	opts := CredentialsOpts{
+		RoleArn: "arn:aws:iam::000000000000:role/ExampleS3WriteRole",
+		Region:  "us-east-1",
+	}
+	fixtures := []struct {
+		execOpts         ExecOpts
+		script           string
+		expectedExitCode int
 	}{
-		{
-			name:    "test-space-separated-keys",
-			server:  GetMockedCreateSessionResponseServer(),
-			profile: "test profile",
-			expectedFileContents: `[test profile]
-aws_access_key_id = accessKeyId
-aws_secret_access_key = secretAccessKey
-aws_session_token = sessionToken
-`,
-		},
+		// Credentials are passed in the environment, and the exit code is propagated
+		{ExecOpts{}, `test "$AWS_ACCESS_KEY_ID" = accessKeyId && test "$AWS_SESSION_TOKEN" = sessionToken && test "$AWS_REGION" = us-east-1 && exit 3`, 3},
+		// A child terminated by a signal exits with 128 plus the signal number
+		{ExecOpts{}, `kill -TERM $$`, 128 + 15},
+		// With an endpoint, the child is pointed to it instead
+		{ExecOpts{WithMetadataEndpoint: true}, `test -z "$AWS_ACCESS_KEY_ID" && test -n "$AWS_CONTAINER_AUTHORIZATION_TOKEN" && case "$AWS_CONTAINER_CREDENTIALS_FULL_URI" in http://127.0.0.1:*/role-credentials) exit 4;; esac`, 4},
+		// The profile and shared credentials file of the parent aren't
+		// passed on, so that they can't take precedence over the endpoint
+		{ExecOpts{WithMetadataEndpoint: true}, `test -z "$AWS_PROFILE" && test -z "$AWS_DEFAULT_PROFILE" && test "$AWS_SHARED_CREDENTIALS_FILE" != "$PARENT_CREDENTIALS_FILE" && test -f "$AWS_SHARED_CREDENTIALS_FILE" && test ! -s "$AWS_SHARED_CREDENTIALS_FILE" && exit 5`, 5},
+		// Without an endpoint, the credentials in the environment take
+		// precedence anyway
+		{ExecOpts{}, `test "$AWS_PROFILE" = parent && test "$AWS_SHARED_CREDENTIALS_FILE" = "$PARENT_CREDENTIALS_FILE" && exit 6`, 6},
 	}
-	for _, tc := range testTable {
-		credentialsOpts := CredentialsOpts{
-			PrivateKeyId:      "../credential-process-data/client-key.pem",
-			CertificateId:     "../credential-process-data/client-cert.pem",
-			RoleArn:           "arn:aws:iam::000000000000:role/ExampleS3WriteRole",
-			ProfileArnStr:     "arn:aws:rolesanywhere:us-east-1:000000000000:profile/41cl0bae-6783-40d4-ab20-65dc5d922e45",
-			TrustAnchorArnStr: "arn:aws:rolesanywhere:us-east-1:000000000000:trust-anchor/41cl0bae-6783-40d4-ab20-65dc5d922e45",
-			Endpoint:          tc.server.URL,
-			SessionDuration:   900,
+	for _, fixture := range fixtures {
+		var calls int32
+		exitCode, err := execWithCredentials(context.Background(), opts, fixture.execOpts, []string{"/bin/sh", "-c", fixture.script}, getCountingGenerateCredentials(time.Hour, &calls))
+		if err != nil {
+			t.Fatal(err)
 		}
-		t.Run(tc.name, func(t *testing.T) {
-			SetupTests()
-			defer tc.server.Close()
-			os.Setenv(AwsSharedCredentialsFileEnvVarName, TestCredentialsFilePath)
+		if exitCode != fixture.expectedExitCode {
+			t.Logf("unexpected exit code %d for %q", exitCode, fixture.script)
+			t.Fail()
+		}
+	}
 
-			Update(credentialsOpts, tc.profile, true)
+	if _, err := Exec(context.Background(), opts, ExecOpts{}, nil); err == nil {
+		t.Log("expected a missing command to be rejected")
+		t.Fail()
+	}
+}
 
-			fileByteContents, _ := ioutil.ReadFile(TestCredentialsFilePath)
-			fileStringContents := trimLastChar(string(fileByteContents))
-			if fileStringContents != tc.expectedFileContents {
-				t.Log("unexpected file contents")
-				t.Fail()
-			}
+// Signals sent to the helper are forwarded to the child once, and those that
+// the terminal sends to the whole process group aren't forwarded again
+func TestExecSignals(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+	signalsPath := filepath.Join(t.TempDir(), "signals")
+	os.Setenv("SIGNALS_FILE", signalsPath)
+	defer os.Unsetenv("SIGNALS_FILE")
+	script := `trap 'echo INT >> "$SIGNALS_FILE"' INT
+trap 'echo HUP >> "$SIGNALS_FILE"' HUP
+trap 'echo TERM >> "$SIGNALS_FILE"; exit 3' TERM
+echo $$ > "$SIGNALS_FILE"
+while :; do sleep 0.05; done`
 
-			info, _ := os.Stat(TestCredentialsFilePath)
-			mode := info.Mode()
-			if mode != ((1 << 8) | (1 << 7)) {
-				t.Log("unexpected file mode")
-				t.Fail()
+	var calls int32
+	exitCodes := make(chan int, 1)
+	go func() {
+		exitCode, err := execWithCredentials(context.Background(), CredentialsOpts{}, ExecOpts{}, []string{"/bin/sh", "-c", script}, getCountingGenerateCredentials(time.Hour, &calls))
+		if err != nil {
+			t.Error(err)
+		}
+		exitCodes <- exitCode
+	}()
+
+	var childPid int
+	for i := 0; i < 200 && childPid == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		data, _ := ioutil.ReadFile(signalsPath)
+		fmt.Sscanf(string(data), "%d", &childPid)
+	}
+	if childPid == 0 {
+		t.Fatal("child didn't start")
+	}
+	helper, _ := os.FindProcess(os.Getpid())
+	child, _ := os.FindProcess(childPid)
+
+	// Ctrl+C reaches both the helper and the child
+	helper.Signal(syscall.SIGINT)
+	child.Signal(syscall.SIGINT)
+	time.Sleep(300 * time.Millisecond)
+	helper.Signal(syscall.SIGHUP)
+	time.Sleep(300 * time.Millisecond)
+	helper.Signal(syscall.SIGTERM)
+
+	select {
+	case exitCode := <-exitCodes:
+		if exitCode != 3 {
+			t.Logf("unexpected exit code %d", exitCode)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("child didn't exit")
+	}
+	data, _ := ioutil.ReadFile(signalsPath)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if strings.Join(lines[1:], ",") != "INT,HUP,TERM" {
+		t.Logf("expected each signal to reach the child once, got %v", lines[1:])
+		t.Fail()
+	}
+}
+
+func TestExecEndpoint(t *testing.T) {
+	var calls int32
+	refresher := NewCredentialsRefresher(CredentialsOpts{})
+	refresher.generateCredentials = getCountingGenerateCredentials(time.Hour, &calls)
+	if err := refresher.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	env, closeEndpoint, err := startExecEndpoint(refresher, "arn:aws:iam::000000000000:role/ExampleS3WriteRole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeEndpoint()
+
+	vars := make(map[string]string)
+	for _, variable := range env {
+		parts := strings.SplitN(variable, "=", 2)
+		vars[parts[0]] = parts[1]
+	}
+	for _, token := range []string{vars["AWS_CONTAINER_AUTHORIZATION_TOKEN"], "wrong-token"} {
+		req, _ := http.NewRequest("GET", vars["AWS_CONTAINER_CREDENTIALS_FULL_URI"], nil)
+		req.Header.Set(ECS_AUTHORIZATION_HEADER, token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ecsCredentials EcsCredentials
+		json.NewDecoder(resp.Body).Decode(&ecsCredentials)
+		resp.Body.Close()
+		authorized := token != "wrong-token"
+		if authorized && (resp.StatusCode != http.StatusOK || ecsCredentials.AccessKeyId != "accessKeyId") {
+			t.Logf("unexpected response %d from the endpoint", resp.StatusCode)
+			t.Fail()
+		}
+		if !authorized && resp.StatusCode != http.StatusUnauthorized {
+			t.Logf("expected a wrong token to be rejected, got %d", resp.StatusCode)
+			t.Fail()
+		}
+	}
+}
+
+func TestReadRolesConfig(t *testing.T) {
+	rolesConfigPath := t.TempDir() + "/roles.json"
+	ioutil.WriteFile(rolesConfigPath, []byte(`{
+		"roles": [
+			{
+				"roleArn": "arn:aws:iam::000000000000:role/path/BuildRole",
+				"profileArn": "arn:aws:rolesanywhere:us-east-1:000000000000:profile/build",
+				"certificate": "build.pem",
+				"privateKey": "build.key",
+				"instanceProperties": {"cluster": "build"}
+			},
+			{
+				"name": "deploy",
+				"roleArn": "arn:aws:iam::000000000000:role/DeployRole",
+				"profileArn": "arn:aws:rolesanywhere:us-east-1:000000000000:profile/deploy",
+				"trustAnchorArn": "arn:aws:rolesanywhere:us-east-1:000000000000:trust-anchor/deploy",
+				"certificate": "deploy.pem",
+				"privateKey": "deploy.key",
+				"sessionDuration": 900
 			}
-		})
+		]
+	}`), 0600)
+	defaults := CredentialsOpts{
+		TrustAnchorArnStr:  "arn:aws:rolesanywhere:us-east-1:000000000000:trust-anchor/default",
+		SessionDuration:    3600,
+		Region:             "us-east-1",
+		InstanceProperties: map[string]string{"team": "infra"},
+	}
+
+	roles, err := ReadRolesConfig(rolesConfigPath, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 2 {
+		t.Fatalf("expected 2 roles, got %d", len(roles))
+	}
+	build, deploy := roles[0].CredentialsOpts, roles[1].CredentialsOpts
+	if build.TrustAnchorArnStr != defaults.TrustAnchorArnStr || build.SessionDuration != 3600 || build.Region != "us-east-1" {
+		t.Log("expected options missing from a role to be taken from the defaults")
+		t.Fail()
+	}
+	if build.InstanceProperties["cluster"] != "build" || build.InstanceProperties["team"] != "infra" {
+		t.Logf("unexpected instance properties %v", build.InstanceProperties)
+		t.Fail()
+	}
+	if deploy.TrustAnchorArnStr != "arn:aws:rolesanywhere:us-east-1:000000000000:trust-anchor/deploy" || deploy.SessionDuration != 900 {
+		t.Log("expected options of a role to override the defaults")
+		t.Fail()
+	}
+	if len(defaults.InstanceProperties) != 1 {
+		t.Log("expected defaults to be left untouched")
+		t.Fail()
+	}
+
+	buildName, err := getServedRoleName(roles[0])
+	if err != nil || buildName != "BuildRole" {
+		t.Logf("unexpected role name %s", buildName)
+		t.Fail()
+	}
+	deployName, err := getServedRoleName(roles[1])
+	if err != nil || deployName != "deploy" {
+		t.Logf("unexpected role name %s", deployName)
+		t.Fail()
+	}
+
+	ioutil.WriteFile(rolesConfigPath, []byte(`{"roles": [{"roleArn": "arn:aws:iam::000000000000:role/BuildRole"}]}`), 0600)
+	if _, err = ReadRolesConfig(rolesConfigPath, CredentialsOpts{}); err == nil {
+		t.Log("expected incomplete role to be rejected")
+		t.Fail()
 	}
 }
 
-func TestGenerateLongToken(t *testing.T) {
-	_, err := GenerateToken(150)
-	if err == nil {
-		t.Log("token generation should've failed since token size is too large")
+// Roles can also be listed in YAML or TOML, next to the profiles of the
+// configuration file of the command line
+func TestReadRolesConfigFormats(t *testing.T) {
+	dir := t.TempDir()
+	fixtures := map[string]string{
+		"config.yaml": `profiles:
+  default:
+    trust-anchor-arn: arn:aws:rolesanywhere:us-east-1:000000000000:trust-anchor/default
+roles:
+  - roleArn: arn:aws:iam::000000000000:role/BuildRole
+    profileArn: arn:aws:rolesanywhere:us-east-1:000000000000:profile/build
+    certificate: build.pem
+    privateKey: build.key
+    instanceProperties:
+      cluster: build
+  - name: deploy
+    roleArn: arn:aws:iam::000000000000:role/DeployRole
+    profileArn: arn:aws:rolesanywhere:us-east-1:000000000000:profile/deploy
+    pkcs12: deploy.p12
+    sessionDuration: 900
+`,
+		"config.toml": `[profiles.default]
+trust-anchor-arn = "arn:aws:rolesanywhere:us-east-1:000000000000:trust-anchor/default"
+
+[[roles]]
+roleArn = "arn:aws:iam::000000000000:role/BuildRole"
+profileArn = "arn:aws:rolesanywhere:us-east-1:000000000000:profile/build"
+certificate = "build.pem"
+privateKey = "build.key"
+instanceProperties = { cluster = "build" }
+
+[[roles]]
+name = "deploy"
+roleArn = "arn:aws:iam::000000000000:role/DeployRole"
+profileArn = "arn:aws:rolesanywhere:us-east-1:000000000000:profile/deploy"
+pkcs12 = "deploy.p12"
+sessionDuration = 900
+`,
+	}
+	defaults := CredentialsOpts{TrustAnchorArnStr: "arn:aws:rolesanywhere:us-east-1:000000000000:trust-anchor/default"}
+	for name, data := range fixtures {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, []byte(data), 0600)
+		roles, err := ReadRolesConfig(path, defaults)
+		if err != nil {
+			t.Logf("%s: %s", name, err)
+			t.Fail()
+			continue
+		}
+		if len(roles) != 2 {
+			t.Logf("%s: expected 2 roles, got %d", name, len(roles))
+			t.Fail()
+			continue
+		}
+		build, deploy := roles[0].CredentialsOpts, roles[1].CredentialsOpts
+		if build.CertificateId != "build.pem" || build.InstanceProperties["cluster"] != "build" {
+			t.Logf("%s: unexpected options %+v", name, build)
+			t.Fail()
+		}
+		if roles[1].Name != "deploy" || deploy.Pkcs12Id != "deploy.p12" || deploy.SessionDuration != 900 {
+			t.Logf("%s: unexpected options %+v", name, deploy)
+			t.Fail()
+		}
+	}
+
+	// A configuration file of the command line without roles isn't a roles configuration
+	path := filepath.Join(dir, "profiles.yaml")
+	ioutil.WriteFile(path, []byte("profiles:\n  default:\n    region: us-east-1\n"), 0600)
+	if _, err := ReadRolesConfig(path, defaults); err == nil {
+		t.Log("expected a file without roles to be rejected")
 		t.Fail()
 	}
 }
 
-func TestGenerateToken(t *testing.T) {
-	token1, err := GenerateToken(100)
-	if err != nil {
-		t.Log("unexpected failure in generating token")
+func TestUpdateProfiles(t *testing.T) {
+	dir := t.TempDir()
+	credentialsPath := filepath.Join(dir, "credentials")
+	os.Setenv(AwsSharedCredentialsFileEnvVarName, credentialsPath)
+	defer os.Unsetenv(AwsSharedCredentialsFileEnvVarName)
+
+	// Credentials of the build role are refreshed every second, while those
+	// of the deploy role last an hour
+	var buildCalls, deployCalls int32
+	generateBuildCredentials := getCountingGenerateCredentials(UpdateRefreshTime+time.Second+500*time.Millisecond, &buildCalls)
+	generateDeployCredentials := getCountingGenerateCredentials(time.Hour, &deployCalls)
+	generateCredentials := func(ctx context.Context, opts *CredentialsOpts) (CredentialProcessOutput, error) {
+		if opts.RoleArn == "build" {
+			return generateBuildCredentials(ctx, opts)
+		}
+		return generateDeployCredentials(ctx, opts)
+	}
+	profiles := []UpdateProfileOpts{
+		{Profile: "build", CredentialsOpts: CredentialsOpts{RoleArn: "build"}},
+		{Profile: "deploy", CredentialsOpts: CredentialsOpts{RoleArn: "deploy"}},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3500*time.Millisecond)
+	defer cancel()
+	updateProfiles(ctx, profiles, UpdateOpts{}, generateCredentials)
+
+	if atomic.LoadInt32(&buildCalls) < 2 || atomic.LoadInt32(&deployCalls) != 1 {
+		t.Logf("expected each profile to be refreshed on its own schedule, got %d and %d refreshes", buildCalls, deployCalls)
 		t.Fail()
 	}
+	contents, _ := ioutil.ReadFile(credentialsPath)
+	for _, profile := range []string{"build", "deploy"} {
+		if !strings.Contains(string(contents), "["+profile+"]\naws_access_key_id = accessKeyId\n") {
+			t.Logf("missing profile %s in credentials file", profile)
+			t.Fail()
+		}
+	}
+}
 
-	token2, err := GenerateToken(100)
-	if err != nil {
-		t.Log("unexpected failure in generating token")
+func TestUpdateProfilesRetries(t *testing.T) {
+	dir := t.TempDir()
+	credentialsPath := filepath.Join(dir, "credentials")
+	statusPath := filepath.Join(dir, "status.json")
+	os.Setenv(AwsSharedCredentialsFileEnvVarName, credentialsPath)
+	defer os.Unsetenv(AwsSharedCredentialsFileEnvVarName)
+	defer func(initialBackoff time.Duration) {
+		RefreshRetryInitialBackoff = initialBackoff
+	}(RefreshRetryInitialBackoff)
+	RefreshRetryInitialBackoff = 100 * time.Millisecond
+
+	// The first refresh succeeds, the next two fail, and the one after that succeeds
+	var calls int32
+	generateCredentials := func(ctx context.Context, opts *CredentialsOpts) (CredentialProcessOutput, error) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			return CredentialProcessOutput{AccessKeyId: "first", SecretAccessKey: "secretAccessKey", SessionToken: "sessionToken",
+				Expiration: time.Now().Add(UpdateRefreshTime).UTC().Format(time.RFC3339)}, nil
+		case 2, 3:
+			return CredentialProcessOutput{}, errors.New("network unreachable")
+		default:
+			return CredentialProcessOutput{AccessKeyId: "second", SecretAccessKey: "secretAccessKey", SessionToken: "sessionToken",
+				Expiration: time.Now().Add(time.Hour).UTC().Format(time.RFC3339)}, nil
+		}
+	}
+	profiles := []UpdateProfileOpts{{Profile: "default"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		updateProfiles(ctx, profiles, UpdateOpts{StatusFile: statusPath}, generateCredentials)
+		close(done)
+	}()
+
+	// The previous credentials are kept while the refresh fails
+	var status UpdateStatus
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		data, _ := ioutil.ReadFile(statusPath)
+		if json.Unmarshal(data, &status) == nil && status.Profiles["default"].LastFailure != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	contents, _ := ioutil.ReadFile(credentialsPath)
+	if atomic.LoadInt32(&calls) < 4 && !strings.Contains(string(contents), "aws_access_key_id = first\n") {
+		t.Log("expected previous credentials to be kept after a failed refresh")
 		t.Fail()
 	}
 
-	if token1 == token2 {
-		t.Log("expected two randomly generated tokens to be different")
+	for time.Now().Before(deadline) && atomic.LoadInt32(&calls) < 4 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	if calls != 4 {
+		t.Fatalf("expected failed refreshes to be retried, got %d refreshes", calls)
+	}
+	contents, _ = ioutil.ReadFile(credentialsPath)
+	if !strings.Contains(string(contents), "aws_access_key_id = second\n") {
+		t.Log("expected credentials to be updated after a successful retry")
+		t.Fail()
+	}
+	data, _ := ioutil.ReadFile(statusPath)
+	status = UpdateStatus{}
+	if err := json.Unmarshal(data, &status); err != nil {
+		t.Fatal(err)
+	}
+	profileStatus := status.Profiles["default"]
+	if profileStatus.LastSuccess == nil || profileStatus.LastFailure == nil || profileStatus.LastSuccess.Before(*profileStatus.LastFailure) ||
+		profileStatus.LastError != "network unreachable" || profileStatus.Expiration == nil {
+		t.Logf("unexpected status %s", data)
 		t.Fail()
 	}
 }
 
-func TestStoreValidToken(t *testing.T) {
-	token, err := GenerateToken(100)
+func TestReadUpdateProfilesConfig(t *testing.T) {
+	rolesConfigPath := t.TempDir() + "/roles.json"
+	ioutil.WriteFile(rolesConfigPath, []byte(`{
+		"roles": [
+			{"roleArn": "arn:aws:iam::000000000000:role/path/BuildRole", "certificate": "build.pem", "privateKey": "build.key"},
+			{"name": "deploy", "roleArn": "arn:aws:iam::000000000000:role/DeployRole", "certificate": "deploy.pem", "privateKey": "deploy.key"},
+			{"profile": "ops", "roleArn": "arn:aws:iam::000000000000:role/OpsRole", "pkcs12": "ops.p12"}
+		]
+	}`), 0600)
+	defaults := CredentialsOpts{
+		ProfileArnStr:     "arn:aws:rolesanywhere:us-east-1:000000000000:profile/default",
+		TrustAnchorArnStr: "arn:aws:rolesanywhere:us-east-1:000000000000:trust-anchor/default",
+	}
+
+	profiles, err := ReadUpdateProfilesConfig(rolesConfigPath, defaults)
 	if err != nil {
-		t.Log("unexpected failure in generating token")
+		t.Fatal(err)
+	}
+	var names []string
+	for _, profile := range profiles {
+		names = append(names, profile.Profile)
+	}
+	if strings.Join(names, ",") != "BuildRole,deploy,ops" {
+		t.Logf("unexpected profiles %v", names)
+		t.Fail()
+	}
+	if profiles[2].CredentialsOpts.Pkcs12Id != "ops.p12" || profiles[2].CredentialsOpts.ProfileArnStr != defaults.ProfileArnStr {
+		t.Log("expected options missing from a role to be taken from the defaults")
 		t.Fail()
 	}
 
-	err = InsertToken(token, time.Now().Add(time.Second*time.Duration(100)))
-	if err != nil {
-		t.Log("unexpected failure when inserting token")
+	ioutil.WriteFile(rolesConfigPath, []byte(`{
+		"roles": [
+			{"profile": "build", "roleArn": "arn:aws:iam::000000000000:role/BuildRole", "pkcs12": "build.p12"},
+			{"profile": "build", "roleArn": "arn:aws:iam::000000000000:role/DeployRole", "pkcs12": "deploy.p12"}
+		]
+	}`), 0600)
+	if _, err = ReadUpdateProfilesConfig(rolesConfigPath, defaults); err == nil {
+		t.Log("expected duplicate profiles to be rejected")
 		t.Fail()
 	}
+}
 
-	httpRequest, err := http.NewRequest("GET", "http://127.0.0.1", nil)
-	if err != nil {
-		t.Log("unable to create test http request")
+func TestAllRolesHandlers(t *testing.T) {
+	var roles []*ServedRole
+	for _, name := range []string{"BuildRole", "DeployRole"} {
+		var calls int32
+		refresher := NewCredentialsRefresher(CredentialsOpts{})
+		refresher.generateCredentials = getCountingGenerateCredentials(time.Hour, &calls)
+		refresher.Refresh()
+		roles = append(roles, &ServedRole{Name: name, Refresher: refresher})
+	}
+	putTokenHandler, getRoleNameHandler, getCredentialsHandler := AllRolesHandlers(roles)
+
+	recorder := httptest.NewRecorder()
+	putTokenHandler(recorder, httptest.NewRequest("PUT", TOKEN_RESOURCE_PATH, nil))
+	token := recorder.Body.String()
+
+	httpRequest := httptest.NewRequest("GET", SECURITY_CREDENTIALS_RESOURCE_PATH, nil)
+	httpRequest.Header.Set(EC2_METADATA_TOKEN_HEADER, token)
+	recorder = httptest.NewRecorder()
+	getRoleNameHandler(recorder, httpRequest)
+	if recorder.Body.String() != "BuildRole\nDeployRole" {
+		t.Logf("unexpected role names %q", recorder.Body.String())
 		t.Fail()
 	}
-	httpRequest.Header.Add(EC2_METADATA_TOKEN_HEADER, token)
 
-	err = CheckValidToken(nil, httpRequest)
-	if err != nil {
-		t.Log("expected previously inserted token to be valid")
+	testTable := []struct {
+		roleName           string
+		expectedStatusCode int
+	}{
+		{"BuildRole", http.StatusOK},
+		{"DeployRole", http.StatusOK},
+		{"OtherRole", http.StatusNotFound},
+	}
+	for _, tc := range testTable {
+		httpRequest := httptest.NewRequest("GET", SECURITY_CREDENTIALS_RESOURCE_PATH+tc.roleName, nil)
+		httpRequest.Header.Set(EC2_METADATA_TOKEN_HEADER, token)
+		recorder := httptest.NewRecorder()
+		getCredentialsHandler(recorder, httpRequest)
+		if recorder.Code != tc.expectedStatusCode {
+			t.Logf("Wrong status code for %s. Expected %d, got %d", tc.roleName, tc.expectedStatusCode, recorder.Code)
+			t.Fail()
+		}
+	}
+}
+
+// The single-role handlers refresh the credentials they're given when they're
+// about to expire, and keep them up to date
+func TestAllIssuesHandlers(t *testing.T) {
+	var calls int32
+	cred := RefreshableCred{AccessKeyId: "staleAccessKeyId", Expiration: time.Now().Add(time.Minute)}
+	opts := CredentialsOpts{RoleArn: "arn:aws:iam::000000000000:role/ExampleS3WriteRole"}
+	putTokenHandler, _, getCredentialsHandler := allIssuesHandlers(&cred, "ExampleS3WriteRole", &opts, getCountingGenerateCredentials(time.Hour, &calls))
+
+	// A request without a valid token doesn't trigger a refresh
+	httpRequest := httptest.NewRequest("GET", SECURITY_CREDENTIALS_RESOURCE_PATH+"ExampleS3WriteRole", nil)
+	recorder := httptest.NewRecorder()
+	getCredentialsHandler(recorder, httpRequest)
+	if recorder.Code != http.StatusUnauthorized || atomic.LoadInt32(&calls) != 0 {
+		t.Logf("unexpected status code %d after %d refreshes", recorder.Code, calls)
+		t.Fail()
+	}
+
+	recorder = httptest.NewRecorder()
+	putTokenHandler(recorder, httptest.NewRequest("PUT", TOKEN_RESOURCE_PATH, nil))
+	token := recorder.Body.String()
+	for i := 0; i < 2; i++ {
+		httpRequest := httptest.NewRequest("GET", SECURITY_CREDENTIALS_RESOURCE_PATH+"ExampleS3WriteRole", nil)
+		httpRequest.Header.Set(EC2_METADATA_TOKEN_HEADER, token)
+		recorder := httptest.NewRecorder()
+		getCredentialsHandler(recorder, httpRequest)
+		var served RefreshableCred
+		json.NewDecoder(recorder.Body).Decode(&served)
+		if recorder.Code != http.StatusOK || served.AccessKeyId != "accessKeyId" {
+			t.Logf("unexpected response %d with access key %q", recorder.Code, served.AccessKeyId)
+			t.Fail()
+		}
+	}
+	if atomic.LoadInt32(&calls) != 1 || cred.AccessKeyId != "accessKeyId" {
+		t.Logf("expected one refresh that updates the credentials, got %d", calls)
 		t.Fail()
 	}
 }
 
-func Test(t *testing.T) {
-	httpRequest, err := http.NewRequest("GET", "http://127.0.0.1", nil)
+func TestUnixSocketPeerAuthorization(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_PEERCRED is only available on Linux")
+	}
+	dir, err := ioutil.TempDir("", "rolesanywhere")
 	if err != nil {
-		t.Log("unable to create test http request")
-		t.Fail()
+		t.Fatal(err)
 	}
-	httpRequest.Header.Add("test-header", "test-header-value")
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "rolesanywhere.sock")
 
-	headerNames := [4]string{"Test-Header", "test-header", "TEST-HEADER", "tEST-hEadeR"}
-	for _, header := range headerNames {
-		testHeaderValue := httpRequest.Header.Get(header)
-		if testHeaderValue != "test-header-value" {
-			t.Log("header name canonicalization not working as expected")
+	uid := uint32(os.Getuid())
+	fixtures := []struct {
+		allowedUids []uint32
+		allowedGids []uint32
+		statusCode  int
+	}{
+		{nil, nil, http.StatusOK},
+		{[]uint32{uid}, nil, http.StatusOK},
+		{nil, []uint32{uint32(os.Getgid())}, http.StatusOK},
+		{[]uint32{uid + 1}, nil, http.StatusForbidden},
+	}
+	for _, fixture := range fixtures {
+		serveOpts := ServeOpts{
+			Listen:      UNIX_LISTEN_PREFIX + socketPath,
+			SocketMode:  0660,
+			AllowedUids: fixture.allowedUids,
+			AllowedGids: fixture.allowedGids,
+		}
+		listener, err := CreateListener(&serveOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileInfo, err := os.Stat(socketPath)
+		if err != nil || fileInfo.Mode().Perm() != 0660 {
+			t.Log("unexpected socket permissions")
+			t.Fail()
+		}
+
+		server := &http.Server{
+			Handler: AuthorizePeerHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}), &serveOpts),
+			ConnContext: PeerCredentialsConnContext,
+		}
+		go server.Serve(listener)
+
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return net.Dial("unix", socketPath)
+			},
+		}}
+		resp, err := client.Get("http://localhost/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != fixture.statusCode {
+			t.Logf("expected status code %d, got %d", fixture.statusCode, resp.StatusCode)
 			t.Fail()
 		}
+		server.Close()
+	}
+
+	// An allow-list can't be enforced on a TCP listener
+	_, err = CreateListener(&ServeOpts{AllowedUids: []uint32{uid}})
+	if err == nil {
+		t.Log("expected allow-list to be rejected without a unix socket")
+		t.Fail()
 	}
 }
 
@@ -614,3 +2650,42 @@ func GetMockedCreateSessionResponseServer() *httptest.Server {
 		  }`))
 	}))
 }
+
+func TestParsePKCS11URI(t *testing.T) {
+	uri, err := parsePKCS11URI("pkcs11:token=roles%20anywhere;object=rsa-2048;id=%01%02?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-value=1234")
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+
+	expectedPathAttributes := map[string]string{"token": "roles anywhere", "object": "rsa-2048", "id": "\x01\x02"}
+	for name, value := range expectedPathAttributes {
+		if uri.pathAttributes[name] != value {
+			t.Logf("Wrong %s attribute. Expected %q, got %q", name, value, uri.pathAttributes[name])
+			t.Fail()
+		}
+	}
+	if uri.queryAttributes["module-path"] != "/usr/lib/softhsm/libsofthsm2.so" {
+		t.Log("Wrong module-path attribute")
+		t.Fail()
+	}
+	pin, hasPin, err := uri.pin()
+	if err != nil || !hasPin || pin != "1234" {
+		t.Log("Wrong pin-value attribute")
+		t.Fail()
+	}
+
+	invalidURIs := []string{
+		"/path/to/key.pem",
+		"pkcs11:token",
+		"pkcs11:object=a;object=b",
+		"pkcs11:object=%zz",
+	}
+	for _, invalidURI := range invalidURIs {
+		if _, err := parsePKCS11URI(invalidURI); err == nil {
+			t.Logf("Expected %s to be rejected", invalidURI)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package aws_signing_helper
+
+import (
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+func openTPMDevice() (io.ReadWriteCloser, error) {
+	return tpm2.OpenTPM(TPMDevicePath)
+}
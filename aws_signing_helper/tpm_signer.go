@@ -0,0 +1,255 @@
+package aws_signing_helper
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Prefix of private key references to a key persisted in the TPM, for
+// example handle:0x81000001
+const tpmHandlePrefix = "handle:"
+
+// Path of the TPM device. The in-kernel resource manager is used, so that
+// transient objects don't have to be managed here.
+var TPMDevicePath = "/dev/tpmrm0"
+
+// Opens the TPM; replaced in tests to use a simulator
+var openTPM = openTPMDevice
+
+// Object identifier of a loadable key in a TSS2 PEM file
+var oidLoadableKey = asn1.ObjectIdentifier{2, 23, 133, 10, 1, 3}
+
+// Key stored in a TSS2 PEM file ("TSS2 PRIVATE KEY"), as produced by
+// tpm2-tss-engine and tpm2-openssl
+type tss2PrivateKey struct {
+	Type       asn1.ObjectIdentifier
+	EmptyAuth  bool          `asn1:"explicit,tag:0,optional"`
+	Policy     asn1.RawValue `asn1:"explicit,tag:1,optional"`
+	Secret     []byte        `asn1:"explicit,tag:2,optional"`
+	Parent     int64
+	PublicKey  []byte
+	PrivateKey []byte
+}
+
+// Template of the storage root key that TSS2 keys are loaded under when their
+// parent is the owner hierarchy, as in the TCG provisioning guidance
+var srkTemplate = tpm2.Public{
+	Type:       tpm2.AlgECC,
+	NameAlg:    tpm2.AlgSHA256,
+	Attributes: tpm2.FlagStorageDefault | tpm2.FlagNoDA,
+	ECCParameters: &tpm2.ECCParams{
+		Symmetric: &tpm2.SymScheme{
+			Alg:     tpm2.AlgAES,
+			KeyBits: 128,
+			Mode:    tpm2.AlgCFB,
+		},
+		CurveID: tpm2.CurveNISTP256,
+	},
+}
+
+// Signs digests with a key held by a TPM 2.0. The key must be an unrestricted
+// signing key. The signer holds a connection to the TPM, which has to be
+// released with Close.
+type TPMSigner struct {
+	rw        io.ReadWriteCloser
+	handle    tpmutil.Handle
+	transient bool
+	password  string
+	publicKey crypto.PublicKey
+	// Whether the key's scheme restricts it to RSASSA-PSS signatures
+	pssOnlyKey bool
+}
+
+// Checks whether the private key references a key in the TPM, either through
+// a persistent handle or as a TSS2 PEM file
+func isTPMKey(privateKey string) bool {
+	if strings.HasPrefix(privateKey, tpmHandlePrefix) {
+		return true
+	}
+	_, err := parseDERFromPEM(privateKey, "TSS2 PRIVATE KEY")
+	return err == nil
+}
+
+// Checks whether the private key is a TSS2 key that requires a password
+func IsTPMKeyWithAuth(privateKey string) bool {
+	block, err := parseDERFromPEM(privateKey, "TSS2 PRIVATE KEY")
+	if err != nil {
+		return false
+	}
+	var key tss2PrivateKey
+	if _, err = asn1.Unmarshal(block.Bytes, &key); err != nil {
+		return false
+	}
+	return !key.EmptyAuth
+}
+
+// Obtains a signer for a key in the TPM. The key is either a persistent handle
+// (handle:0x81000001) or a TSS2 PEM file, which is loaded under its parent.
+// The password is the authorization value of the key, if it has one.
+func GetTPMSigner(privateKey string, password string) (*TPMSigner, error) {
+	rw, err := openTPM()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open TPM: %w", err)
+	}
+
+	signer := &TPMSigner{rw: rw, password: password}
+	if strings.HasPrefix(privateKey, tpmHandlePrefix) {
+		handle, err := strconv.ParseUint(strings.TrimPrefix(privateKey, tpmHandlePrefix), 0, 32)
+		if err != nil {
+			rw.Close()
+			return nil, errors.New("invalid TPM handle")
+		}
+		signer.handle = tpmutil.Handle(handle)
+	} else {
+		signer.handle, signer.password, err = loadTSS2PrivateKey(rw, privateKey, password)
+		if err != nil {
+			rw.Close()
+			return nil, err
+		}
+		signer.transient = true
+	}
+
+	public, _, _, err := tpm2.ReadPublic(rw, signer.handle)
+	if err != nil {
+		signer.Close()
+		return nil, fmt.Errorf("unable to read TPM key: %w", err)
+	}
+	if public.Attributes&tpm2.FlagSign == 0 || public.Attributes&tpm2.FlagRestricted != 0 {
+		signer.Close()
+		return nil, errors.New("TPM key is not an unrestricted signing key")
+	}
+	signer.publicKey, err = public.Key()
+	if err != nil {
+		signer.Close()
+		return nil, err
+	}
+	// RSA keys created with a fixed signing scheme can't sign with any other
+	if public.RSAParameters != nil && public.RSAParameters.Sign != nil {
+		signer.pssOnlyKey = public.RSAParameters.Sign.Alg == tpm2.AlgRSAPSS
+	}
+	return signer, nil
+}
+
+// Loads a TSS2 key under its parent, and returns the transient handle of the
+// key along with the password to use with it
+func loadTSS2PrivateKey(rw io.ReadWriter, privateKey string, password string) (tpmutil.Handle, string, error) {
+	block, err := parseDERFromPEM(privateKey, "TSS2 PRIVATE KEY")
+	if err != nil {
+		return 0, "", errors.New("could not parse PEM data")
+	}
+	var key tss2PrivateKey
+	if _, err = asn1.Unmarshal(block.Bytes, &key); err != nil {
+		return 0, "", errors.New("could not parse TSS2 private key")
+	}
+	if !key.Type.Equal(oidLoadableKey) {
+		return 0, "", errors.New("unsupported TSS2 key type, only loadable keys are supported")
+	}
+	if len(key.Policy.FullBytes) != 0 {
+		return 0, "", errors.New("TSS2 keys with policies aren't supported")
+	}
+	if key.EmptyAuth {
+		password = ""
+	}
+
+	// The public and private parts are stored as TPM2B structures, whose size
+	// prefix is added back when they're loaded
+	if len(key.PublicKey) < 2 || len(key.PrivateKey) < 2 {
+		return 0, "", errors.New("invalid TSS2 private key")
+	}
+
+	parent := tpmutil.Handle(key.Parent)
+	if parent == tpm2.HandleOwner || parent == 0 {
+		parent, _, err = tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", srkTemplate)
+		if err != nil {
+			return 0, "", fmt.Errorf("unable to create storage root key: %w", err)
+		}
+		defer tpm2.FlushContext(rw, parent)
+	}
+	handle, _, err := tpm2.Load(rw, parent, "", key.PublicKey[2:], key.PrivateKey[2:])
+	if err != nil {
+		return 0, "", fmt.Errorf("unable to load TSS2 private key: %w", err)
+	}
+	return handle, password, nil
+}
+
+func (signer *TPMSigner) Public() crypto.PublicKey {
+	return signer.publicKey
+}
+
+func (signer *TPMSigner) pssOnly() bool {
+	return signer.pssOnlyKey
+}
+
+// Signs the digest on the TPM, with RSASSA-PKCS1-v1_5 (or RSASSA-PSS, if
+// requested) or ECDSA depending on the key. The TPM picks the salt length of
+// PSS signatures (older TPMs use the longest one that fits), so they're
+// verified against the requested salt length before being returned.
+func (signer *TPMSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var hashAlg tpm2.Algorithm
+	switch opts.HashFunc() {
+	case crypto.SHA256:
+		hashAlg = tpm2.AlgSHA256
+	case crypto.SHA384:
+		hashAlg = tpm2.AlgSHA384
+	case crypto.SHA512:
+		hashAlg = tpm2.AlgSHA512
+	default:
+		return nil, errors.New("unsupported digest")
+	}
+
+	var scheme tpm2.SigScheme
+	switch signer.publicKey.(type) {
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			scheme = tpm2.SigScheme{Alg: tpm2.AlgRSAPSS, Hash: hashAlg}
+		} else {
+			scheme = tpm2.SigScheme{Alg: tpm2.AlgRSASSA, Hash: hashAlg}
+		}
+	case *ecdsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return nil, errors.New("PSS padding can only be used with RSA keys")
+		}
+		scheme = tpm2.SigScheme{Alg: tpm2.AlgECDSA, Hash: hashAlg}
+	default:
+		return nil, errors.New("unsupported TPM key type")
+	}
+
+	signature, err := tpm2.Sign(signer.rw, signer.handle, signer.password, digest, nil, &scheme)
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign with TPM key: %w", err)
+	}
+	if signature.RSA != nil {
+		if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+			publicKey := signer.publicKey.(*rsa.PublicKey)
+			if err := rsa.VerifyPSS(publicKey, opts.HashFunc(), digest, signature.RSA.Signature, pssOpts); err != nil {
+				return nil, errors.New("the TPM made a PSS signature with a salt length other than the requested one")
+			}
+		}
+		return signature.RSA.Signature, nil
+	}
+	if signature.ECC != nil {
+		return asn1.Marshal(struct {
+			R, S *big.Int
+		}{signature.ECC.R, signature.ECC.S})
+	}
+	return nil, errors.New("unexpected signature returned by TPM")
+}
+
+// Flushes the key if it was loaded from a TSS2 file, and closes the connection to the TPM
+func (signer *TPMSigner) Close() error {
+	if signer.transient {
+		tpm2.FlushContext(signer.rw, signer.handle)
+	}
+	return signer.rw.Close()
+}
@@ -0,0 +1,14 @@
+//go:build windows
+
+package aws_signing_helper
+
+import (
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// The TPM is reached through TBS on Windows, so TPMDevicePath isn't used
+func openTPMDevice() (io.ReadWriteCloser, error) {
+	return tpm2.OpenTPM()
+}
@@ -2,10 +2,16 @@ package aws_signing_helper
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -13,6 +19,10 @@ const UpdateRefreshTime = time.Minute * time.Duration(5)
 const AwsSharedCredentialsFileEnvVarName = "AWS_SHARED_CREDENTIALS_FILE"
 const BufferSize = 49152
 
+// Interval at which refresh times are checked against the wall clock, which
+// timers don't follow while the system is suspended
+var UpdateCheckInterval = time.Second * time.Duration(30)
+
 // Structure to contain a temporary credential
 type TemporaryCredential struct {
 	AccessKeyId     string
@@ -21,66 +31,317 @@ type TemporaryCredential struct {
 	Expiration      time.Time
 }
 
+// Options of a profile of the credentials file that is kept up to date
+type UpdateProfileOpts struct {
+	// Name of the profile in the credentials file
+	Profile         string
+	CredentialsOpts CredentialsOpts
+}
+
+// Options of UpdateProfilesWithOpts
+type UpdateOpts struct {
+	// Whether the credentials are updated only once
+	Once bool
+	// Path of a JSON file that records the status of each profile after
+	// every refresh, if not empty
+	StatusFile string
+}
+
+// Contents of the status file
+type UpdateStatus struct {
+	Profiles map[string]UpdateProfileStatus `json:"profiles"`
+}
+
+// Status of a profile in the status file
+type UpdateProfileStatus struct {
+	// Time of the last successful refresh
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	// Time of the last failed refresh, and why it failed
+	LastFailure *time.Time `json:"lastFailure,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	// Expiration of the credentials in the credentials file
+	Expiration *time.Time `json:"expiration,omitempty"`
+	// Time of the next refresh, or retry
+	NextRefresh time.Time `json:"nextRefresh"`
+}
+
+// State of the refreshes of a profile
+type updateProfileState struct {
+	// Credentials last written to the credentials file
+	cred            TemporaryCredential
+	nextRefreshTime time.Time
+	retryBackoff    time.Duration
+	status          UpdateProfileStatus
+}
+
 // Updates credentials in the credentials file for the specified profile
 func Update(credentialsOptions CredentialsOpts, profile string, once bool) {
-	var refreshableCred = TemporaryCredential{}
-	var nextRefreshTime time.Time
+	UpdateWithContext(context.Background(), credentialsOptions, profile, once)
+}
+
+// Same as Update, until the context is done, which also cancels a refresh
+// that is in flight
+func UpdateWithContext(ctx context.Context, credentialsOptions CredentialsOpts, profile string, once bool) {
+	UpdateProfilesWithContext(ctx, []UpdateProfileOpts{{Profile: profile, CredentialsOpts: credentialsOptions}}, once)
+}
+
+// Updates credentials in the credentials file for several profiles, each with
+// its own role, profile, trust anchor and certificate. Each profile is
+// refreshed on its own schedule, and the profiles that are refreshed together
+// are written to the file in a single update.
+func UpdateProfiles(profiles []UpdateProfileOpts, once bool) {
+	UpdateProfilesWithContext(context.Background(), profiles, once)
+}
+
+// Same as UpdateProfiles, until the context is done, which also cancels
+// refreshes that are in flight
+func UpdateProfilesWithContext(ctx context.Context, profiles []UpdateProfileOpts, once bool) {
+	UpdateProfilesWithOpts(ctx, profiles, UpdateOpts{Once: once})
+}
+
+// Same as UpdateProfilesWithContext, with additional options. A failed refresh
+// doesn't stop the update (unless Once is set): it's retried with exponential
+// backoff, while the previous credentials are left in the credentials file.
+// Refresh times are checked against the wall clock every UpdateCheckInterval,
+// so that refreshes aren't delayed by a suspended system or a clock change.
+func UpdateProfilesWithOpts(ctx context.Context, profiles []UpdateProfileOpts, updateOpts UpdateOpts) {
+	updateProfiles(ctx, profiles, updateOpts, GenerateCredentialsWithContext)
+}
+
+func updateProfiles(ctx context.Context, profiles []UpdateProfileOpts, updateOpts UpdateOpts, generateCredentials func(context.Context, *CredentialsOpts) (CredentialProcessOutput, error)) {
+	if len(profiles) == 0 {
+		log.Println("no profiles to update")
+		os.Exit(1)
+	}
+	for i, profile := range profiles {
+		for _, other := range profiles[:i] {
+			if other.Profile == profile.Profile {
+				log.Println("duplicate profile:", profile.Profile)
+				os.Exit(1)
+			}
+		}
+	}
+
+	// A zero refresh time means that the profile is due
+	states := make([]updateProfileState, len(profiles))
+	ticker := time.NewTicker(UpdateCheckInterval)
+	defer ticker.Stop()
 	for {
-		credentialProcessOutput, err := GenerateCredentials(&credentialsOptions)
-		if err != nil {
-			log.Fatal(err)
+		var due []int
+		// Times without a monotonic clock reading are compared on the wall clock
+		now := time.Now().Round(0)
+		for i := range profiles {
+			if !states[i].nextRefreshTime.After(now) {
+				due = append(due, i)
+			}
 		}
 
-		// Assign credential values
-		refreshableCred.AccessKeyId = credentialProcessOutput.AccessKeyId
-		refreshableCred.SecretAccessKey = credentialProcessOutput.SecretAccessKey
-		refreshableCred.SessionToken = credentialProcessOutput.SessionToken // nosemgrep
-		refreshableCred.Expiration, _ = time.Parse(time.RFC3339, credentialProcessOutput.Expiration)
-		if (refreshableCred == TemporaryCredential{}) {
-			log.Println("no credentials created")
-			os.Exit(1)
+		if len(due) != 0 {
+			failed := refreshProfiles(ctx, profiles, states, due, updateOpts.Once, generateCredentials)
+			if ctx.Err() != nil {
+				log.Println("Stopped updating credentials")
+				return
+			}
+			if updateOpts.StatusFile != "" {
+				if err := writeUpdateStatus(updateOpts.StatusFile, profiles, states); err != nil {
+					log.Println("unable to write status file:", err)
+				}
+			}
+			if updateOpts.Once {
+				if failed {
+					os.Exit(1)
+				}
+				break
+			}
 		}
 
-		// Get credentials file contents
-		lines, err := GetCredentialsFileContents()
-		if err != nil {
-			log.Println("unable to get credentials file contents")
-			os.Exit(1)
+		timer := time.NewTimer(time.Until(earliestRefreshTime(states)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Println("Stopped updating credentials")
+			return
+		case <-timer.C:
+		case <-ticker.C:
+			timer.Stop()
 		}
+	}
+}
 
-		// Write to credentials file
-		err = WriteTo(profile, lines, &refreshableCred)
-		if err != nil {
-			log.Println("unable to write to AWS credentials file")
-			os.Exit(1)
+// Refreshes the profiles that are due concurrently, so that a slow
+// CreateSession for one of them doesn't hold up the others, and writes those
+// that were refreshed to the credentials file. Profiles that fail are
+// scheduled for a retry, unless the update is done only once. Returns whether
+// any of them failed.
+func refreshProfiles(ctx context.Context, profiles []UpdateProfileOpts, states []updateProfileState, due []int, once bool, generateCredentials func(context.Context, *CredentialsOpts) (CredentialProcessOutput, error)) bool {
+	creds := make([]TemporaryCredential, len(profiles))
+	errs := make([]error, len(profiles))
+	var wg sync.WaitGroup
+	for _, i := range due {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			creds[i], errs[i] = generateTemporaryCredential(ctx, &profiles[i].CredentialsOpts, generateCredentials)
+		}(i)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return true
+	}
+
+	failed := false
+	profileCreds := make(map[string]*TemporaryCredential)
+	var refreshed []int
+	for _, i := range due {
+		if errs[i] != nil {
+			states[i].fail(profiles[i].Profile, errs[i], once)
+			failed = true
+			continue
 		}
+		profileCreds[profiles[i].Profile] = &creds[i]
+		refreshed = append(refreshed, i)
+	}
+	if len(refreshed) == 0 {
+		return failed
+	}
 
+	// Write to credentials file
+	err := UpdateCredentialsFileProfiles(profileCreds)
+	for _, i := range refreshed {
+		if err != nil {
+			states[i].fail(profiles[i].Profile, fmt.Errorf("unable to write to AWS credentials file: %w", err), once)
+			failed = true
+			continue
+		}
+		states[i].succeed(creds[i])
 		if once {
-			break
+			continue
 		}
-		nextRefreshTime = refreshableCred.Expiration.Add(-UpdateRefreshTime)
-		log.Println("Credentials will be refreshed at", nextRefreshTime.String())
-		time.Sleep(time.Until(nextRefreshTime))
+		log.Printf("Credentials of profile %s will be refreshed at %s", profiles[i].Profile, states[i].nextRefreshTime.String())
 	}
+	return failed
 }
 
-// Assume that the credentials file is located in the default path: `~/.aws/credentials`
-func GetCredentialsFileContents() ([]string, error) {
+// Finds the earliest time at which one of the profiles is due
+func earliestRefreshTime(states []updateProfileState) time.Time {
+	nextRefreshTime := states[0].nextRefreshTime
+	for _, state := range states[1:] {
+		if state.nextRefreshTime.Before(nextRefreshTime) {
+			nextRefreshTime = state.nextRefreshTime
+		}
+	}
+	return nextRefreshTime
+}
+
+// Records a successful refresh, and schedules the next one ahead of the
+// expiry of the new credentials
+func (state *updateProfileState) succeed(cred TemporaryCredential) {
+	now := time.Now().Round(0)
+	state.cred = cred
+	state.retryBackoff = 0
+	state.nextRefreshTime = cred.Expiration.Add(-UpdateRefreshTime)
+	state.status.LastSuccess = &now
+	state.status.Expiration = &cred.Expiration
+	state.status.NextRefresh = state.nextRefreshTime
+}
+
+// Records a failed refresh, and schedules a retry with exponential backoff
+// unless the update is done only once. The previous credentials are left in
+// the credentials file in the meantime.
+func (state *updateProfileState) fail(profileName string, err error, once bool) {
+	now := time.Now().Round(0)
+	if state.retryBackoff == 0 {
+		state.retryBackoff = RefreshRetryInitialBackoff
+	} else if state.retryBackoff *= 2; state.retryBackoff > RefreshRetryMaxBackoff {
+		state.retryBackoff = RefreshRetryMaxBackoff
+	}
+	state.nextRefreshTime = now.Add(state.retryBackoff + randomDuration(state.retryBackoff/2))
+	state.status.LastFailure = &now
+	state.status.LastError = err.Error()
+	state.status.NextRefresh = state.nextRefreshTime
+
+	if once {
+		log.Printf("unable to refresh credentials of profile %s: %s", profileName, err)
+	} else if !state.cred.Expiration.IsZero() && !now.Before(state.cred.Expiration) {
+		log.Printf("unable to refresh credentials of profile %s, which have expired, retrying in %s: %s", profileName, state.retryBackoff, err)
+	} else {
+		log.Printf("unable to refresh credentials of profile %s, retrying in %s: %s", profileName, state.retryBackoff, err)
+	}
+}
+
+// Writes the status of each profile to the status file, which is replaced atomically
+func writeUpdateStatus(path string, profiles []UpdateProfileOpts, states []updateProfileState) error {
+	status := UpdateStatus{Profiles: make(map[string]UpdateProfileStatus)}
+	for i, profile := range profiles {
+		status.Profiles[profile.Profile] = states[i].status
+	}
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0644)
+}
+
+// Obtains credentials through a call to CreateSession, in the form they're
+// written to the credentials file
+func generateTemporaryCredential(ctx context.Context, opts *CredentialsOpts, generateCredentials func(context.Context, *CredentialsOpts) (CredentialProcessOutput, error)) (TemporaryCredential, error) {
+	credentialProcessOutput, err := generateCredentials(ctx, opts)
+	if err != nil {
+		return TemporaryCredential{}, err
+	}
+
+	// Assign credential values
+	var refreshableCred TemporaryCredential
+	refreshableCred.AccessKeyId = credentialProcessOutput.AccessKeyId
+	refreshableCred.SecretAccessKey = credentialProcessOutput.SecretAccessKey
+	refreshableCred.SessionToken = credentialProcessOutput.SessionToken // nosemgrep
+	refreshableCred.Expiration, _ = time.Parse(time.RFC3339, credentialProcessOutput.Expiration)
+	if (refreshableCred == TemporaryCredential{}) {
+		return TemporaryCredential{}, errors.New("no credentials created")
+	}
+	return refreshableCred, nil
+}
+
+// Finds the path of the credentials file, which is `~/.aws/credentials`
+// unless AWS_SHARED_CREDENTIALS_FILE is set
+func getCredentialsFilePath() (string, error) {
+	awsCredentialsPath := os.Getenv(AwsSharedCredentialsFileEnvVarName)
+	if awsCredentialsPath != "" {
+		return awsCredentialsPath, nil
+	}
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		log.Println("unable to locate the home directory")
-		return nil, err
+		return "", err
 	}
+	return filepath.Join(homeDir, ".aws", "credentials"), nil
+}
 
-	awsCredentialsPath := os.Getenv(AwsSharedCredentialsFileEnvVarName)
-	if awsCredentialsPath == "" {
-		awsCredentialsPath = filepath.Join(homeDir, ".aws", "credentials")
+// Assume that the credentials file is located in the default path: `~/.aws/credentials`.
+// The file is read under the same lock as UpdateCredentialsFile, so that it's
+// never read in the middle of an update. Lines of a file with CRLF line endings
+// keep their carriage return, so that WriteTo writes them back the same way.
+func GetCredentialsFileContents() ([]string, error) {
+	awsCredentialsPath, err := getCredentialsFilePath()
+	if err != nil {
+		return nil, err
 	}
-	if err = os.MkdirAll(filepath.Dir(awsCredentialsPath), 0600); err != nil {
+	if err = os.MkdirAll(filepath.Dir(awsCredentialsPath), 0700); err != nil {
 		log.Println("unable to create credentials file")
 		return nil, err
 	}
 
+	var lines []string
+	err = withFileLock(awsCredentialsPath+".lock", func() error {
+		lines, err = readCredentialsFile(awsCredentialsPath)
+		return err
+	})
+	return lines, err
+}
+
+// Reads the lines of the credentials file, creating it if it doesn't exist.
+// The caller must hold the lock on the file.
+func readCredentialsFile(awsCredentialsPath string) ([]string, error) {
 	readOnlyCredentialsFile, err := os.OpenFile(awsCredentialsPath, os.O_RDONLY|os.O_CREATE, 0600)
 	if err != nil {
 		log.Println("unable to get or create read-only AWS credentials file")
@@ -91,6 +352,7 @@ func GetCredentialsFileContents() ([]string, error) {
 	// Read in all profiles in the credentials file
 	var lines []string
 	scanner := bufio.NewScanner(readOnlyCredentialsFile)
+	scanner.Split(scanIniLines)
 	for scanner.Scan() {
 		lines = append(lines, scanner.Text())
 	}
@@ -100,99 +362,97 @@ func GetCredentialsFileContents() ([]string, error) {
 // Assume that the credentials file exists already and open it for write operations
 // that will overwrite the existing contents of the file
 func GetWriteOnlyCredentialsFile() (*os.File, error) {
-	homeDir, _ := os.UserHomeDir()
-	awsCredentialsPath := os.Getenv(AwsSharedCredentialsFileEnvVarName)
-	if awsCredentialsPath == "" {
-		awsCredentialsPath = filepath.Join(homeDir, ".aws", "credentials")
+	awsCredentialsPath, err := getCredentialsFilePath()
+	if err != nil {
+		return nil, err
 	}
 	return os.OpenFile(awsCredentialsPath, os.O_WRONLY|os.O_TRUNC, 0200)
 }
 
-// Function that will get the new conents of the credentials file after a 
-// refresh has been done
+// Replaces the credentials of the profile in the credentials file. The file
+// is locked (through a lock file next to it) for the whole read-modify-write,
+// so that processes updating different profiles don't overwrite each other.
+func UpdateCredentialsFile(profileName string, cred *TemporaryCredential) error {
+	return UpdateCredentialsFileProfiles(map[string]*TemporaryCredential{profileName: cred})
+}
+
+// Same as UpdateCredentialsFile, for several profiles at once, which are all
+// replaced in a single update of the file
+func UpdateCredentialsFileProfiles(creds map[string]*TemporaryCredential) error {
+	awsCredentialsPath, err := getCredentialsFilePath()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(awsCredentialsPath), 0700); err != nil {
+		return err
+	}
+	return withFileLock(awsCredentialsPath+".lock", func() error {
+		lines, err := readCredentialsFile(awsCredentialsPath)
+		if err != nil {
+			return err
+		}
+		contents := strings.Join(getNewCredentialsFileContentsForProfiles(lines, creds), "")
+		return replaceFileAtomic(awsCredentialsPath, []byte(contents), 0600)
+	})
+}
+
+// Keys that hold the expiration of the credentials in the credentials file.
+// SDKs ignore them, but other tools read one or the other.
+var credentialsExpirationKeys = []string{"aws_expiration", "x_security_token_expires"}
+
+// Function that will get the new conents of the credentials file after a
+// refresh has been done. Only the credentials (and their expiration) in the
+// first section for the profile are changed; every other line is kept as is.
 func GetNewCredentialsFileContents(profileName string, readLines []string, cred *TemporaryCredential) []string {
-	var profileExist = false
-	var profileSection = "[" + profileName + "]"
-	// A variable that checks whether or not required fields are written to the destination file
-	newCredVisit := map[string]bool{"aws_access_key_id": false, "aws_secret_access_key": false, "aws_session_token": false}
-	accessKey := "aws_access_key_id = " + cred.AccessKeyId + "\n"
-	secretKey := "aws_secret_access_key = " + cred.SecretAccessKey + "\n"
-	sessionToken := "aws_session_token = " + cred.SessionToken + "\n"
-	var writeLines = make([]string, 0)
-	for readLinesIndex := 0; readLinesIndex < len(readLines); readLinesIndex++ {
-		if !profileExist && readLines[readLinesIndex] == profileSection {
-			writeLines = append(writeLines[:], profileSection+"\n")
-			readLinesIndex += 1
-			for ; readLinesIndex < len(readLines); readLinesIndex++ {
-				// If the last line of the credentials file is reached
-				// OR the next profile section is reached
-				if readLinesIndex == len(readLines)-1 || strings.HasPrefix(readLines[readLinesIndex], "[") {
-					if !newCredVisit["aws_access_key_id"] {
-						writeLines = append(writeLines[:], accessKey)
-					}
-					if !newCredVisit["aws_secret_access_key"] {
-						writeLines = append(writeLines[:], secretKey)
-					}
-					if !newCredVisit["aws_session_token"] {
-						writeLines = append(writeLines[:], sessionToken)
-
-					}
-					if readLinesIndex != len(readLines)-1 {
-						readLinesIndex -= 1
-					}
-					profileExist = true
-					break
-				} else if strings.HasPrefix(readLines[readLinesIndex], "aws_access_key_id") {
-					// replace "aws_access_key_id"
-					writeLines = append(writeLines[:], accessKey)
-					newCredVisit["aws_access_key_id"] = true
-				} else if strings.HasPrefix(readLines[readLinesIndex], "aws_secret_access_key") {
-					// replace "aws_secret_access_key"
-					writeLines = append(writeLines[:], secretKey)
-					newCredVisit["aws_secret_access_key"] = true
-				} else if strings.HasPrefix(readLines[readLinesIndex], "aws_session_token") {
-					// replace "aws_session_token"
-					writeLines = append(writeLines[:], sessionToken)
-					newCredVisit["aws_session_token"] = true
-				} else {
-					// write other keys
-					writeLines = append(writeLines[:], readLines[readLinesIndex]+"\n")
-				}
+	return getNewCredentialsFileContentsForProfiles(readLines, map[string]*TemporaryCredential{profileName: cred})
+}
+
+// Same as GetNewCredentialsFileContents, for several profiles at once. Profiles
+// that don't exist yet are added in the order of their names.
+func getNewCredentialsFileContentsForProfiles(readLines []string, creds map[string]*TemporaryCredential) []string {
+	var profileNames []string
+	for profileName := range creds {
+		profileNames = append(profileNames, profileName)
+	}
+	sort.Strings(profileNames)
+
+	credentialsFile := ParseIniLines(readLines)
+	for _, profileName := range profileNames {
+		cred := creds[profileName]
+		profileSection := credentialsFile.GetOrAddSection(profileName)
+		profileSection.Set("aws_access_key_id", cred.AccessKeyId)
+		profileSection.Set("aws_secret_access_key", cred.SecretAccessKey)
+		profileSection.Set("aws_session_token", cred.SessionToken)
+		if !cred.Expiration.IsZero() {
+			for _, key := range credentialsExpirationKeys {
+				profileSection.Set(key, cred.Expiration.UTC().Format(time.RFC3339))
 			}
-		} else {
-			writeLines = append(writeLines[:], readLines[readLinesIndex]+"\n")
 		}
 	}
 
-	// If the chosen profile does not exist
-	if !profileExist {
-		writeCredential := profileSection + "\n" + accessKey + secretKey + sessionToken
-		writeLines = append(writeLines[:], writeCredential+"\n")
+	var writeLines []string
+	for _, line := range credentialsFile.Lines() {
+		writeLines = append(writeLines, line+credentialsFile.LineEnding())
 	}
-
-    return writeLines
+	return writeLines
 }
 
-// Function to write existing credentials and newly-created credentials to a destination file
+// Function to write existing credentials and newly-created credentials to a
+// destination file. The file is replaced atomically, keeping its mode and owner,
+// so that a crash or a concurrent reader never sees it empty or half-written.
+// The write is done under the lock of the file, but since readLines were read
+// before it was taken, profiles updated in the meantime by another process are
+// lost; UpdateCredentialsFile does the whole read-modify-write under the lock.
 func WriteTo(profileName string, readLines []string, cred *TemporaryCredential) error {
-	destFile, err := GetWriteOnlyCredentialsFile()
+	awsCredentialsPath, err := getCredentialsFilePath()
 	if err != nil {
-		log.Println("unable to get write-only AWS credentials file")
-		os.Exit(1)
+		return err
 	}
-	defer destFile.Close()
-
-	// Create buffered writer 
-	destFileWriter := bufio.NewWriterSize(destFile, BufferSize)
-	for _, line := range GetNewCredentialsFileContents(profileName, readLines, cred) {
-		_, err := destFileWriter.WriteString(line)
-		if err != nil {
-			log.Println("unable to write to credentials file")
-			os.Exit(1)
-		}
+	if err = os.MkdirAll(filepath.Dir(awsCredentialsPath), 0700); err != nil {
+		return err
 	}
-
-	// Flush the contents of the buffer
-	destFileWriter.Flush()
-	return nil
+	contents := strings.Join(GetNewCredentialsFileContents(profileName, readLines, cred), "")
+	return withFileLock(awsCredentialsPath+".lock", func() error {
+		return replaceFileAtomic(awsCredentialsPath, []byte(contents), 0600)
+	})
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration file
+//
+// The file holds named profiles of options, so that they don't have to be
+// repeated on every command line. Options are named after the flags they
+// stand for, and the file is either YAML or TOML, depending on its extension.
+//
+// YAML example:
+//
+//	profiles:
+//	  build:
+//	    certificate: /etc/pki/build.pem
+//	    private-key: /etc/pki/build.key
+//	    role-arn: arn:aws:iam::000000000000:role/BuildRole
+//	    profile-arn: arn:aws:rolesanywhere:us-east-1:000000000000:profile/...
+//	    trust-anchor-arn: arn:aws:rolesanywhere:us-east-1:000000000000:trust-anchor/...
+//	    session-duration: 900
+//	    instance-property:
+//	      cluster: build
+//
+// TOML example:
+//
+//	[profiles.build]
+//	certificate = "/etc/pki/build.pem"
+//	private-key = "/etc/pki/build.key"
+//	session-duration = 900
+//
+// Options given on the command line take precedence over those in the file.
+// Other top-level keys are ignored, so that the file can also hold the roles
+// of --roles-config.
+
+// Profile used when --config-profile isn't given
+const defaultConfigProfile = "default"
+
+// Flags whose value is superseded by an environment variable, which takes
+// precedence over the configuration file
+var configEnvOverrides = map[string]string{
+	"pkcs12-password-file":        pkcs12PasswordEnvVar,
+	"private-key-passphrase-file": privateKeyPassphraseEnvVar,
+}
+
+type configFile struct {
+	Profiles map[string]map[string]interface{} `yaml:"profiles" toml:"profiles"`
+}
+
+// Reads the options of a profile from a YAML (.yaml or .yml) or TOML (.toml)
+// configuration file
+func readConfigProfile(path string, profileName string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config configFile
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &config)
+	case ".toml":
+		err = toml.Unmarshal(data, &config)
+	default:
+		return nil, errors.New("configuration file must have a .yaml, .yml or .toml extension")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse configuration file: %w", err)
+	}
+
+	profile, ok := config.Profiles[profileName]
+	if !ok {
+		return nil, fmt.Errorf("profile %s not found in configuration file", profileName)
+	}
+	return profile, nil
+}
+
+// Sets the flags of the flag set from the options of a profile, except those
+// in explicitlySet, which take precedence. Options that are flags of other
+// commands are ignored, so that a profile can be shared between commands.
+// Lists set a flag once per element, and maps once per key=value pair.
+func applyConfigProfile(fs *flag.FlagSet, profile map[string]interface{}, explicitlySet map[string]bool) error {
+	var names []string
+	for name := range profile {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == "config" || name == "config-profile" {
+			return fmt.Errorf("%s can't be set in the configuration file", name)
+		}
+		if fs.Lookup(name) == nil {
+			if !isKnownFlag(name) {
+				return fmt.Errorf("unknown option %s in configuration file", name)
+			}
+			continue
+		}
+		if explicitlySet[name] {
+			continue
+		}
+		if envVar, ok := configEnvOverrides[name]; ok {
+			if _, ok := os.LookupEnv(envVar); ok {
+				continue
+			}
+		}
+
+		var values []string
+		switch value := profile[name].(type) {
+		case []interface{}:
+			for _, element := range value {
+				values = append(values, fmt.Sprint(element))
+			}
+		case map[string]interface{}:
+			for key, element := range value {
+				values = append(values, fmt.Sprintf("%s=%v", key, element))
+			}
+			sort.Strings(values)
+		default:
+			values = []string{fmt.Sprint(value)}
+		}
+		for _, value := range values {
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("invalid value for %s in configuration file: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Checks whether any command has a flag of that name
+func isKnownFlag(name string) bool {
+	for _, fs := range commands {
+		if fs.Lookup(name) != nil {
+			return true
+		}
+	}
+	return false
+}
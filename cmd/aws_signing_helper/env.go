@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Every flag can also be set through an environment variable, named after the
+// flag with the ROLESANYWHERE_ prefix, in upper case and with underscores
+// instead of dashes (for example, ROLESANYWHERE_ROLE_ARN for --role-arn).
+// Flags given on the command line take precedence over environment variables,
+// which take precedence over the configuration file.
+
+// Prefix of the environment variables that flags are read from
+const flagEnvVarPrefix = "ROLESANYWHERE_"
+
+// Appended to usage messages
+const envVarsUsage = `
+
+Options can also be set through environment variables, named after them with
+the ROLESANYWHERE_ prefix (such as ROLESANYWHERE_ROLE_ARN for --role-arn).
+Run the command with -h to list them.`
+
+// Flags that can be given several times, whose environment variable holds a
+// comma-separated list
+var envListFlags = map[string]bool{
+	"instance-property": true,
+}
+
+// Name of the environment variable that a flag is read from
+func flagEnvVar(name string) string {
+	return flagEnvVarPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Mentions the environment variable of each flag in its usage
+func addEnvVarsToUsage(fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		f.Usage = fmt.Sprintf("%s (env %s)", f.Usage, flagEnvVar(f.Name))
+	})
+}
+
+// Sets the flags of the flag set from their environment variables, except
+// those in explicitlySet, which take precedence
+func applyEnvVars(fs *flag.FlagSet, explicitlySet map[string]bool) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicitlySet[f.Name] {
+			return
+		}
+		value, ok := os.LookupEnv(flagEnvVar(f.Name))
+		if !ok {
+			return
+		}
+		values := []string{value}
+		if envListFlags[f.Name] {
+			values = strings.Split(value, ",")
+		}
+		for _, value := range values {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value for %s: %w", flagEnvVar(f.Name), setErr)
+				return
+			}
+		}
+	})
+	return err
+}
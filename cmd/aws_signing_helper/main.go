@@ -2,18 +2,29 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	helper "github.com/aws/rolesanywhere-credential-helper/aws_signing_helper"
+	"golang.org/x/term"
 )
 
 // Common flags that must be contained in all flag sets
@@ -22,10 +33,22 @@ var (
 	certificateId       string
 	certificateBundleId string
 	digestArg           string
+	paddingArg          string
 	roleArnStr          string
 	profileArnStr       string
 	trustAnchorArnStr   string
 	sessionDuration     int
+	roleSessionName     string
+	maxAttempts         int
+	retryDeadline       time.Duration
+	timeout             time.Duration
+
+	privateKeyPassphraseFile string
+	pkcs12Id                 string
+	pkcs12PasswordFile       string
+
+	instanceProperties           = instancePropertiesFlag{}
+	withSystemInstanceProperties bool
 
 	region      string
 	endpoint    string
@@ -34,22 +57,44 @@ var (
 	debug       bool
 	format      string
 
-	profile string
-	once    bool
+	profile    string
+	once       bool
+	statusFile string
+
+	port                   int
+	serveMode              string
+	authorizationToken     string
+	authorizationTokenFile string
+	listen                 string
+	rolesConfig            string
+	socketMode             string
+	allowedUids            = idListFlag{}
+	allowedGids            = idListFlag{}
+	agentSocket            string
+
+	useCache           bool
+	cacheDir           string
+	cacheRefreshWindow time.Duration
+	cacheEncrypt       bool
+
+	configPath    string
+	configProfile string
 
-	port int
+	withMetadataEndpoint bool
 
 	credentialProcessCmd   = flag.NewFlagSet("credential-process", flag.ExitOnError)
 	signStringCmd          = flag.NewFlagSet("sign-string", flag.ExitOnError)
 	readCertificateDataCmd = flag.NewFlagSet("read-certificate-data", flag.ExitOnError)
 	updateCmd              = flag.NewFlagSet("update", flag.ExitOnError)
 	serveCmd               = flag.NewFlagSet("serve", flag.ExitOnError)
+	agentCmd               = flag.NewFlagSet("agent", flag.ExitOnError)
+	execCmd                = flag.NewFlagSet("exec", flag.ExitOnError)
 	versionCmd             = flag.NewFlagSet("version", flag.ExitOnError)
 )
 
 var Version string
 var globalOptSet = map[string]bool{"--region": true, "--endpoint": true}
-var credentialCommands = map[string]struct{}{"credential-process": {}, "update": {}, "serve": {}}
+var credentialCommands = map[string]struct{}{"credential-process": {}, "update": {}, "serve": {}, "exec": {}}
 
 // Maps each command name to a flagset
 var commands = map[string]*flag.FlagSet{
@@ -58,9 +103,130 @@ var commands = map[string]*flag.FlagSet{
 	readCertificateDataCmd.Name(): readCertificateDataCmd,
 	updateCmd.Name():              updateCmd,
 	serveCmd.Name():               serveCmd,
+	agentCmd.Name():               agentCmd,
+	execCmd.Name():                execCmd,
 	versionCmd.Name():             versionCmd,
 }
 
+// Collects repeated --instance-property key=value flags
+type instancePropertiesFlag map[string]string
+
+func (p instancePropertiesFlag) String() string {
+	var properties []string
+	for key, value := range p {
+		properties = append(properties, key+"="+value)
+	}
+	sort.Strings(properties)
+	return strings.Join(properties, ",")
+}
+
+func (p instancePropertiesFlag) Set(property string) error {
+	parts := strings.SplitN(property, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return errors.New("instance properties must be of the form key=value")
+	}
+	if _, ok := p[parts[0]]; ok {
+		return fmt.Errorf("duplicate instance property: %s", parts[0])
+	}
+	p[parts[0]] = parts[1]
+	return nil
+}
+
+// List of numeric user or group IDs, given either comma-separated or by
+// repeating the flag
+type idListFlag struct {
+	ids []uint32
+}
+
+func (l *idListFlag) String() string {
+	var ids []string
+	for _, id := range l.ids {
+		ids = append(ids, strconv.FormatUint(uint64(id), 10))
+	}
+	return strings.Join(ids, ",")
+}
+
+func (l *idListFlag) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(part), 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid ID: %s", part)
+		}
+		l.ids = append(l.ids, uint32(id))
+	}
+	return nil
+}
+
+// Parses the name of a signing digest, one of SHA256, SHA384 and SHA512
+func parseDigest(digest string) (crypto.Hash, error) {
+	switch strings.ToUpper(digest) {
+	case "SHA256":
+		return crypto.SHA256, nil
+	case "SHA384":
+		return crypto.SHA384, nil
+	case "SHA512":
+		return crypto.SHA512, nil
+	}
+	return 0, errors.New("digest must be one of SHA256, SHA384 and SHA512")
+}
+
+// Parses an octal file mode, such as 0660
+func parseSocketMode(mode string) (os.FileMode, error) {
+	parsedMode, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || parsedMode > 0777 {
+		return 0, errors.New("socket mode must be an octal permission, such as 0660")
+	}
+	return os.FileMode(parsedMode), nil
+}
+
+const (
+	// Environment variable that the password of a PKCS#12 file is read from
+	pkcs12PasswordEnvVar = "ROLESANYWHERE_PKCS12_PASSWORD"
+	// Environment variable that the passphrase of an encrypted private key is read from
+	privateKeyPassphraseEnvVar = "ROLESANYWHERE_PRIVATE_KEY_PASSPHRASE"
+)
+
+// Reads a password from a file if one is given, or else from an environment
+// variable if it's set, or else prompts for it on the terminal
+func readPassword(passwordFile string, envVar string, prompt string) (string, error) {
+	if passwordFile != "" {
+		password, err := ioutil.ReadFile(passwordFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(password), "\r\n"), nil
+	}
+	if password, ok := os.LookupEnv(envVar); ok {
+		return password, nil
+	}
+
+	// stdin and stdout may be used by the SDK, so the terminal is used directly
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("no password provided, and unable to prompt for one: %w", err)
+	}
+	defer tty.Close()
+	fmt.Fprint(tty, prompt)
+	password, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	if err != nil {
+		return "", err
+	}
+	return string(password), nil
+}
+
+// Obtains the password of the PKCS#12 file. Files that aren't protected by a
+// password don't cause a prompt.
+func getPKCS12Password() (string, error) {
+	if _, ok := os.LookupEnv(pkcs12PasswordEnvVar); !ok && pkcs12PasswordFile == "" {
+		_, _, _, err := helper.ReadPKCS12Data(pkcs12Id, "")
+		if err != helper.ErrIncorrectPKCS12Password {
+			return "", nil
+		}
+	}
+	return readPassword(pkcs12PasswordFile, pkcs12PasswordEnvVar, fmt.Sprintf("Password for %s: ", pkcs12Id))
+}
+
 // Finds global parameters that can appear in any position
 // Return a map that maps the name of global parameter to its value
 // and a list of remaining arguments
@@ -70,6 +236,11 @@ func findGlobalVar(argList []string) (map[string]string, []string) {
 	parseList := []string{}
 
 	for i := 0; i < len(argList); i++ {
+		// Arguments after -- belong to the command run by exec
+		if argList[i] == "--" {
+			parseList = append(parseList, argList[i:]...)
+			break
+		}
 
 		if globalOptSet[argList[i]] {
 
@@ -93,32 +264,73 @@ func setupFlags() {
 	for command, fs := range commands {
 		// Common flags for all credential-related commands
 		if _, ok := credentialCommands[command]; ok {
-			fs.StringVar(&certificateId, "certificate", "", "Path to certificate file")
-			fs.StringVar(&privateKeyId, "private-key", "", "Path to private key file")
+			fs.StringVar(&certificateId, "certificate", "", "Path to certificate file, or PKCS#11 URI of the certificate")
+			fs.StringVar(&privateKeyId, "private-key", "", "Path to private key file, or PKCS#11 URI or TPM handle (handle:0x81000001) of the private key, or agent:<socket> to sign through a signing agent")
+			fs.StringVar(&privateKeyPassphraseFile, "private-key-passphrase-file", "", "Path to a file containing the passphrase of an encrypted private key, or the authorization value of a TPM key (otherwise read from "+privateKeyPassphraseEnvVar+", or prompted for)")
 			fs.StringVar(&roleArnStr, "role-arn", "", "Target role to assume")
 			fs.StringVar(&profileArnStr, "profile-arn", "", "Profile to to pull policies from")
 			fs.StringVar(&trustAnchorArnStr, "trust-anchor-arn", "", "Trust anchor to to use for authentication")
 			fs.IntVar(&sessionDuration, "session-duration", 3600, "Duration, in seconds, for the resulting session")
+			fs.StringVar(&roleSessionName, "role-session-name", "", "Name of the role session, which appears in CloudTrail logs")
+			fs.Var(instanceProperties, "instance-property", "Instance property to attach to the session, as key=value (can be repeated)")
+			fs.BoolVar(&withSystemInstanceProperties, "with-system-instance-properties", false, "To attach standard instance properties (hostname, os, arch) read from the system")
 			fs.StringVar(&region, "region", "", "Signing region")
 			fs.StringVar(&endpoint, "endpoint", "", "Endpoint to retrieve session from")
 			fs.StringVar(&certificateBundleId, "intermediates", "", "Path to intermediate certificate bundle")
+			fs.StringVar(&pkcs12Id, "pkcs12", "", "Path to a PKCS#12 file holding the private key, certificate and intermediates, instead of --private-key and --certificate")
+			fs.StringVar(&pkcs12PasswordFile, "pkcs12-password-file", "", "Path to a file containing the password of the PKCS#12 file (otherwise read from "+pkcs12PasswordEnvVar+", or prompted for)")
 			fs.BoolVar(&noVerifySSL, "no-verify-ssl", false, "To disable SSL verification")
 			fs.BoolVar(&withProxy, "with-proxy", false, "To use credential-process with a proxy")
 			fs.BoolVar(&debug, "debug", false, "To print debug output when SDK calls are made")
+			fs.IntVar(&maxAttempts, "max-attempts", helper.DefaultRetryPolicy.MaxAttempts, "Maximum number of CreateSession attempts, when it fails with a transient error")
+			fs.DurationVar(&retryDeadline, "retry-deadline", 0, "Time after the first CreateSession attempt past which it isn't retried, such as 30s (unlimited by default)")
+			fs.DurationVar(&timeout, "timeout", time.Minute, "Time after which obtaining credentials from CreateSession, including retries, is abandoned (0 for no timeout)")
+			fs.StringVar(&configPath, "config", "", "Path to a YAML or TOML configuration file holding profiles of options, which flags take precedence over")
+			fs.StringVar(&configProfile, "config-profile", defaultConfigProfile, "Profile of the configuration file to read options from")
 		}
 
-		if command == "read-certificate-data" {
-			fs.StringVar(&certificateId, "certificate", "", "Path to certificate file")
+		if command == "credential-process" {
+			fs.BoolVar(&useCache, "cache", false, "To cache credentials on disk, and return them until they're about to expire")
+			fs.StringVar(&cacheDir, "cache-dir", "", "Directory of the credentials cache (implies --cache)")
+			fs.DurationVar(&cacheRefreshWindow, "cache-refresh-window", helper.DefaultCacheRefreshWindow, "Cached credentials that expire within this window are refreshed, such as 10m")
+			fs.BoolVar(&cacheEncrypt, "cache-encrypt", false, "To encrypt cached credentials with a key derived from the private key (implies --cache)")
+		} else if command == "read-certificate-data" {
+			fs.StringVar(&certificateId, "certificate", "", "Path to certificate file, or PKCS#11 URI of the certificate")
+			fs.StringVar(&pkcs12Id, "pkcs12", "", "Path to a PKCS#12 file holding the certificate, instead of --certificate")
+			fs.StringVar(&pkcs12PasswordFile, "pkcs12-password-file", "", "Path to a file containing the password of the PKCS#12 file (otherwise read from "+pkcs12PasswordEnvVar+", or prompted for)")
 		} else if command == "sign-string" {
-			fs.StringVar(&privateKeyId, "private-key", "", "Path to private key file")
+			fs.StringVar(&privateKeyId, "private-key", "", "Path to private key file, or PKCS#11 URI or TPM handle (handle:0x81000001) of the private key, or agent:<socket> to sign through a signing agent")
+			fs.StringVar(&privateKeyPassphraseFile, "private-key-passphrase-file", "", "Path to a file containing the passphrase of an encrypted private key, or the authorization value of a TPM key (otherwise read from "+privateKeyPassphraseEnvVar+", or prompted for)")
 			fs.StringVar(&format, "format", "json", "Output format. One of json, text, and bin")
 			fs.StringVar(&digestArg, "digest", "SHA256", "One of SHA256, SHA384 and SHA512")
+			fs.StringVar(&paddingArg, "padding", helper.PaddingPKCS1v15, "Padding of RSA signatures. One of pkcs1v15 and pss")
 		} else if command == "update" {
 			fs.StringVar(&profile, "profile", "default", "The aws profile to use (default 'default')")
 			fs.BoolVar(&once, "once", false, "Update the credentials once")
+			fs.StringVar(&statusFile, "status-file", "", "Path to a JSON file recording the times of the last successful and failed refreshes of each profile")
+			fs.StringVar(&rolesConfig, "roles-config", "", "Path to a JSON, YAML or TOML file listing several profiles to update, each with its own role, profile, trust anchor, certificate and private key")
 		} else if command == "serve" {
 			fs.IntVar(&port, "port", helper.DefaultPort, "The port used to run local server (default: 9911)")
+			fs.StringVar(&serveMode, "mode", helper.ImdsServeMode, "Protocol spoken by the local server. One of imds and ecs")
+			fs.StringVar(&authorizationToken, "authorization-token", "", "Token that clients have to present in the Authorization header (ecs mode)")
+			fs.StringVar(&authorizationTokenFile, "authorization-token-file", "", "Path to a file containing the token that clients have to present in the Authorization header (ecs mode)")
+			fs.StringVar(&rolesConfig, "roles-config", "", "Path to a JSON, YAML or TOML file listing several roles to serve, each with its own profile, trust anchor, certificate and private key")
+			fs.StringVar(&listen, "listen", "", "Address to listen on instead of the loopback port, in the form unix:<path>")
+			fs.StringVar(&socketMode, "socket-mode", "0600", "Permissions of the unix socket, in octal")
+			fs.Var(&allowedUids, "allowed-uids", "Comma-separated user IDs allowed to connect to the unix socket (Linux only)")
+			fs.Var(&allowedGids, "allowed-gids", "Comma-separated primary group IDs allowed to connect to the unix socket (Linux only)")
+		} else if command == "exec" {
+			fs.BoolVar(&withMetadataEndpoint, "with-metadata-endpoint", false, "To serve refreshed credentials to the command through a private ECS-compatible endpoint, rather than passing them in its environment")
+		} else if command == "agent" {
+			fs.StringVar(&privateKeyId, "private-key", "", "Path to private key file, or PKCS#11 URI or TPM handle (handle:0x81000001) of the private key")
+			fs.StringVar(&privateKeyPassphraseFile, "private-key-passphrase-file", "", "Path to a file containing the passphrase of an encrypted private key, or the authorization value of a TPM key (otherwise read from "+privateKeyPassphraseEnvVar+", or prompted for)")
+			fs.StringVar(&certificateId, "certificate", "", "Path to the certificate of the private key, or its PKCS#11 URI, which provides the public key when the private key's token doesn't hold it")
+			fs.StringVar(&agentSocket, "socket", "", "Path of the unix socket to serve signing requests on")
+			fs.StringVar(&socketMode, "socket-mode", "0600", "Permissions of the unix socket, in octal")
+			fs.Var(&allowedUids, "allowed-uids", "Comma-separated user IDs allowed to connect to the unix socket (Linux only)")
+			fs.Var(&allowedGids, "allowed-gids", "Comma-separated primary group IDs allowed to connect to the unix socket (Linux only)")
 		}
+		addEnvVarsToUsage(fs)
 	}
 }
 
@@ -144,6 +356,36 @@ func main() {
 
 	commandFs.Parse(parseList[1:])
 
+	// Flags given on the command line take precedence over environment
+	// variables, which take precedence over the configuration file
+	explicitlySet := map[string]bool{"region": regionDetected, "endpoint": endpointDetected}
+	commandFs.Visit(func(f *flag.Flag) {
+		explicitlySet[f.Name] = true
+	})
+	if err := applyEnvVars(commandFs, explicitlySet); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	commandFs.Visit(func(f *flag.Flag) {
+		explicitlySet[f.Name] = true
+	})
+
+	if configPath == "" && configProfile != defaultConfigProfile {
+		log.Println("--config-profile requires --config")
+		os.Exit(1)
+	}
+	if configPath != "" {
+		profile, err := readConfigProfile(configPath, configProfile)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		if err := applyConfigProfile(commandFs, profile, explicitlySet); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	}
+
 	// assign global variables if they have been detected
 	if regionDetected {
 		region = tmpRegion
@@ -152,43 +394,114 @@ func main() {
 		endpoint = tmpEndpoint
 	}
 	credentialsOptions := helper.CredentialsOpts{
-		PrivateKeyId:        privateKeyId,
-		CertificateId:       certificateId,
-		CertificateBundleId: certificateBundleId,
-		RoleArn:             roleArnStr,
-		ProfileArnStr:       profileArnStr,
-		TrustAnchorArnStr:   trustAnchorArnStr,
-		SessionDuration:     sessionDuration,
-		Region:              region,
-		Endpoint:            endpoint,
-		NoVerifySSL:         noVerifySSL,
-		WithProxy:           withProxy,
-		Debug:               debug,
-		Version:             Version,
+		PrivateKeyId:                 privateKeyId,
+		CertificateId:                certificateId,
+		CertificateBundleId:          certificateBundleId,
+		Pkcs12Id:                     pkcs12Id,
+		RoleArn:                      roleArnStr,
+		ProfileArnStr:                profileArnStr,
+		TrustAnchorArnStr:            trustAnchorArnStr,
+		SessionDuration:              sessionDuration,
+		RoleSessionName:              roleSessionName,
+		InstanceProperties:           instanceProperties,
+		WithSystemInstanceProperties: withSystemInstanceProperties,
+		Region:                       region,
+		Endpoint:                     endpoint,
+		NoVerifySSL:                  noVerifySSL,
+		WithProxy:                    withProxy,
+		Debug:                        debug,
+		Version:                      Version,
+		RetryPolicy:                  helper.RetryPolicy{MaxAttempts: maxAttempts, MaxElapsedTime: retryDeadline},
+		Timeout:                      timeout,
+	}
+
+	if pkcs12Id != "" {
+		if privateKeyId != "" || certificateId != "" {
+			log.Println("--pkcs12 can't be combined with --private-key or --certificate")
+			os.Exit(1)
+		}
+		pkcs12Password, err := getPKCS12Password()
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		credentialsOptions.Pkcs12Password = pkcs12Password
+	} else if _, ok := os.LookupEnv(pkcs12PasswordEnvVar); ok || pkcs12PasswordFile != "" {
+		// PKCS#12 files may also be referenced from the roles configuration of serve
+		pkcs12Password, err := readPassword(pkcs12PasswordFile, pkcs12PasswordEnvVar, "")
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		credentialsOptions.Pkcs12Password = pkcs12Password
 	}
 
+	if helper.IsEncryptedPrivateKey(privateKeyId) || helper.IsTPMKeyWithAuth(privateKeyId) {
+		privateKeyPassphrase, err := readPassword(privateKeyPassphraseFile, privateKeyPassphraseEnvVar, "Passphrase for private key: ")
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		credentialsOptions.PrivateKeyPassphrase = privateKeyPassphrase
+	} else if _, ok := os.LookupEnv(privateKeyPassphraseEnvVar); ok || privateKeyPassphraseFile != "" {
+		// Encrypted private keys may also be referenced from the roles configuration of serve
+		privateKeyPassphrase, err := readPassword(privateKeyPassphraseFile, privateKeyPassphraseEnvVar, "")
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		credentialsOptions.PrivateKeyPassphrase = privateKeyPassphrase
+	}
+
+	// Interrupting the process cancels requests that are in flight, and shuts
+	// down the update and serve commands cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	switch command {
 	case "credential-process":
 		// First check whether required arguments are present
-		if privateKeyId == "" || certificateId == "" || profileArnStr == "" ||
+		if (pkcs12Id == "" && (privateKeyId == "" || certificateId == "")) || profileArnStr == "" ||
 			trustAnchorArnStr == "" || roleArnStr == "" {
 			msg := `Usage: aws_signing_helper credential-process
-			--private-key <value> 
+			--private-key <value> [--private-key-passphrase-file <value>]
 			--certificate <value> 
+			| --pkcs12 <value> [--pkcs12-password-file <value>]
 			--profile-arn <value> 
 			--trust-anchor-arn <value>
 			--role-arn <value> 
 			[--endpoint <value>] 
 			[--region <value>] 
 			[--session-duration <value>]
+			[--role-session-name <value>]
+			[--instance-property <key=value> ...]
+			[--with-system-instance-properties]
 			[--with-proxy]
 			[--no-verify-ssl]
+			[--max-attempts <value>]
+			[--retry-deadline <value>]
+			[--timeout <value>]
+			[--config <value> [--config-profile <value>]]
+			[--cache] [--cache-dir <value>]
+			[--cache-refresh-window <value>]
+			[--cache-encrypt]
 			[--debug]
 			[--intermediates <value>]`
-			log.Println(msg)
+			log.Println(msg + envVarsUsage)
 			os.Exit(1)
 		}
-		credentialProcessOutput, err := helper.GenerateCredentials(&credentialsOptions)
+		var credentialProcessOutput helper.CredentialProcessOutput
+		var err error
+		if useCache || cacheDir != "" || cacheEncrypt {
+			cacheOpts := helper.CredentialsCacheOpts{
+				Dir:           cacheDir,
+				RefreshWindow: cacheRefreshWindow,
+				Encrypt:       cacheEncrypt,
+			}
+			credentialProcessOutput, err = helper.GenerateCredentialsWithCache(ctx, &credentialsOptions, cacheOpts)
+		} else {
+			credentialProcessOutput, err = helper.GenerateCredentialsWithContext(ctx, &credentialsOptions)
+		}
 		if err != nil {
 			log.Println(err)
 			os.Exit(1)
@@ -197,19 +510,23 @@ func main() {
 		fmt.Print(string(buf[:]))
 	case "sign-string":
 		stringToSign, _ := ioutil.ReadAll(bufio.NewReader(os.Stdin))
-		privateKey, _ := helper.ReadPrivateKeyData(privateKeyId)
-		var digest crypto.Hash
-		switch strings.ToUpper(digestArg) {
-		case "SHA256":
-			digest = crypto.SHA256
-		case "SHA384":
-			digest = crypto.SHA384
-		case "SHA512":
-			digest = crypto.SHA512
-		default:
+		privateKey, err := helper.ReadPrivateKeyDataWithPassphrase(privateKeyId, credentialsOptions.PrivateKeyPassphrase)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		if closer, ok := privateKey.(io.Closer); ok {
+			defer closer.Close()
+		}
+		digest, err := parseDigest(digestArg)
+		if err != nil {
 			digest = crypto.SHA256
 		}
-		signingResult, _ := helper.Sign(stringToSign, helper.SigningOpts{PrivateKey: privateKey, Digest: digest})
+		signingResult, err := helper.Sign(stringToSign, helper.SigningOpts{PrivateKey: privateKey, Digest: digest, Padding: strings.ToLower(paddingArg)})
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
 		switch strings.ToLower(format) {
 		case "text":
 			fmt.Print(signingResult.Signature)
@@ -223,54 +540,206 @@ func main() {
 			fmt.Print(signingResult.Signature)
 		}
 	case "read-certificate-data":
-		data, _ := helper.ReadCertificateData(certificateId)
+		var data helper.CertificateData
+		if pkcs12Id != "" {
+			data, _ = helper.ReadPKCS12CertificateData(pkcs12Id, credentialsOptions.Pkcs12Password)
+		} else {
+			data, _ = helper.ReadCertificateData(certificateId)
+		}
 		buf, _ := json.Marshal(data)
 		fmt.Print(string(buf[:]))
 	case "version":
 		fmt.Println(Version)
 	case "update":
-		if privateKeyId == "" || certificateId == "" ||
-			profileArnStr == "" || trustAnchorArnStr == "" || roleArnStr == "" {
+		if rolesConfig == "" && ((pkcs12Id == "" && (privateKeyId == "" || certificateId == "")) ||
+			profileArnStr == "" || trustAnchorArnStr == "" || roleArnStr == "") {
 			msg := `Usage: aws_signing_helper update
-			--private-key <value> 
+			--private-key <value> [--private-key-passphrase-file <value>]
 			--certificate <value> 
+			| --pkcs12 <value> [--pkcs12-password-file <value>]
 			--profile-arn <value> 
 			--trust-anchor-arn <value>
 			--role-arn <value> 
+			| --roles-config <value>
 			[--endpoint <value>] 
 			[--region <value>]
 			[--session-duration <value>]
+			[--role-session-name <value>]
+			[--instance-property <key=value> ...]
+			[--with-system-instance-properties]
 			[--with-proxy]
 			[--no-verify-ssl]
+			[--max-attempts <value>]
+			[--retry-deadline <value>]
+			[--timeout <value>]
+			[--config <value> [--config-profile <value>]]
 			[--intermediates <value>]
 			[--profile <value>]
-			[--once]`
-			log.Println(msg)
+			[--once]
+			[--status-file <value>]`
+			log.Println(msg + envVarsUsage)
 			os.Exit(1)
 		}
-		helper.Update(credentialsOptions, profile, once)
+		profiles := []helper.UpdateProfileOpts{{Profile: profile, CredentialsOpts: credentialsOptions}}
+		if rolesConfig != "" {
+			if explicitlySet["profile"] {
+				log.Println("--profile can't be combined with --roles-config, which sets the profile of each role")
+				os.Exit(1)
+			}
+			var err error
+			profiles, err = helper.ReadUpdateProfilesConfig(rolesConfig, credentialsOptions)
+			if err != nil {
+				log.Println(err)
+				os.Exit(1)
+			}
+		}
+		helper.UpdateProfilesWithOpts(ctx, profiles, helper.UpdateOpts{Once: once, StatusFile: statusFile})
 	case "serve":
 		// First check whether required arguments are present
-		if privateKeyId == "" || certificateId == "" || profileArnStr == "" ||
-			trustAnchorArnStr == "" || roleArnStr == "" {
+		if rolesConfig == "" && ((pkcs12Id == "" && (privateKeyId == "" || certificateId == "")) || profileArnStr == "" ||
+			trustAnchorArnStr == "" || roleArnStr == "") {
 			msg := `Usage: aws_signing_helper serve
-			--private-key <value> 
+			--private-key <value> [--private-key-passphrase-file <value>]
 			--certificate <value> 
+			| --pkcs12 <value> [--pkcs12-password-file <value>]
 			--profile-arn <value> 
 			--trust-anchor-arn <value>
 			--role-arn <value> 
+			| --roles-config <value>
 			[--endpoint <value>] 
 			[--region <value>] 
 			[--session-duration <value>]
+			[--role-session-name <value>]
+			[--instance-property <key=value> ...]
+			[--with-system-instance-properties]
 			[--with-proxy]
 			[--no-verify-ssl]
+			[--max-attempts <value>]
+			[--retry-deadline <value>]
+			[--timeout <value>]
+			[--config <value> [--config-profile <value>]]
 			[--debug]
 			[--intermediates <value>]
-			[--port <value>]`
-			log.Println(msg)
+			[--port <value>]
+			[--mode imds|ecs]
+			[--authorization-token <value>]
+			[--authorization-token-file <value>]
+			[--listen unix:<path>]
+			[--socket-mode <value>]
+			[--allowed-uids <value>]
+			[--allowed-gids <value>]`
+			log.Println(msg + envVarsUsage)
+			os.Exit(1)
+		}
+		roles := []helper.RoleServeOpts{{CredentialsOpts: credentialsOptions}}
+		if rolesConfig != "" {
+			var err error
+			roles, err = helper.ReadRolesConfig(rolesConfig, credentialsOptions)
+			if err != nil {
+				log.Println(err)
+				os.Exit(1)
+			}
+		}
+		parsedSocketMode, err := parseSocketMode(socketMode)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		serveOpts := helper.ServeOpts{
+			Port:                   port,
+			Mode:                   serveMode,
+			AuthorizationToken:     authorizationToken,
+			AuthorizationTokenFile: authorizationTokenFile,
+			Listen:                 listen,
+			SocketMode:             parsedSocketMode,
+			AllowedUids:            allowedUids.ids,
+			AllowedGids:            allowedGids.ids,
+		}
+		helper.ServeRolesWithContext(ctx, serveOpts, roles)
+	case "exec":
+		if (pkcs12Id == "" && (privateKeyId == "" || certificateId == "")) ||
+			profileArnStr == "" || trustAnchorArnStr == "" || roleArnStr == "" || commandFs.NArg() == 0 {
+			msg := `Usage: aws_signing_helper exec
+			--private-key <value> [--private-key-passphrase-file <value>]
+			--certificate <value> 
+			| --pkcs12 <value> [--pkcs12-password-file <value>]
+			--profile-arn <value> 
+			--trust-anchor-arn <value>
+			--role-arn <value> 
+			[--endpoint <value>] 
+			[--region <value>]
+			[--session-duration <value>]
+			[--role-session-name <value>]
+			[--instance-property <key=value> ...]
+			[--with-system-instance-properties]
+			[--with-proxy]
+			[--no-verify-ssl]
+			[--max-attempts <value>]
+			[--retry-deadline <value>]
+			[--timeout <value>]
+			[--config <value> [--config-profile <value>]]
+			[--intermediates <value>]
+			[--with-metadata-endpoint]
+			-- <command> [<argument> ...]`
+			log.Println(msg + envVarsUsage)
+			os.Exit(1)
+		}
+		execOpts := helper.ExecOpts{WithMetadataEndpoint: withMetadataEndpoint}
+		exitCode, err := helper.Exec(ctx, credentialsOptions, execOpts, commandFs.Args())
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(exitCode)
+	case "agent":
+		if privateKeyId == "" || agentSocket == "" {
+			msg := `Usage: aws_signing_helper agent
+			--private-key <value> [--private-key-passphrase-file <value>]
+			--socket <value>
+			[--certificate <value>]
+			[--socket-mode <value>]
+			[--allowed-uids <value>]
+			[--allowed-gids <value>]`
+			log.Println(msg + envVarsUsage)
+			os.Exit(1)
+		}
+		privateKey, err := helper.ReadPrivateKeyDataWithPassphrase(privateKeyId, credentialsOptions.PrivateKeyPassphrase)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		if closer, ok := privateKey.(io.Closer); ok {
+			defer closer.Close()
+		}
+		var certificate *x509.Certificate
+		if certificateId != "" {
+			certificateData, err := helper.ReadCertificateData(certificateId)
+			if err != nil {
+				log.Println(err)
+				os.Exit(1)
+			}
+			certificateDerData, _ := base64.StdEncoding.DecodeString(certificateData.CertificateData)
+			certificate, err = x509.ParseCertificate(certificateDerData)
+			if err != nil {
+				log.Println(err)
+				os.Exit(1)
+			}
+		}
+		parsedSocketMode, err := parseSocketMode(socketMode)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		serveOpts := helper.ServeOpts{
+			Listen:      helper.UNIX_LISTEN_PREFIX + agentSocket,
+			SocketMode:  parsedSocketMode,
+			AllowedUids: allowedUids.ids,
+			AllowedGids: allowedGids.ids,
+		}
+		if err = helper.ServeAgentWithCertificate(privateKey, certificate, serveOpts); err != nil {
+			log.Println(err)
 			os.Exit(1)
 		}
-		helper.Serve(port, credentialsOptions)
 	case "":
 		log.Println("No command provided")
 		os.Exit(1)
@@ -1,16 +1,24 @@
 package main
 
 import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 )
 
+// Flags can only be defined once per flag set, so tests share a single setup
+var setupFlagsOnce sync.Once
+
 func TestParseArgs(t *testing.T) {
 	args := []string{
 		"read-certificate-data",
 		"--certificate",
 		"/path/to/cert.pem",
 	}
-	setupFlags()
+	setupFlagsOnce.Do(setupFlags)
 	var command = commands[args[0]]
 	command.Parse(args[1:])
 
@@ -18,3 +26,208 @@ func TestParseArgs(t *testing.T) {
 		t.Errorf("Expected %s, got %s", "/path/to/cert.pem", certificateId)
 	}
 }
+
+func TestParseInstanceProperties(t *testing.T) {
+	args := []string{
+		"credential-process",
+		"--instance-property",
+		"cluster=build",
+		"--instance-property",
+		"build-id=a=b",
+	}
+	setupFlagsOnce.Do(setupFlags)
+	var command = commands[args[0]]
+	err := command.Parse(args[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if instanceProperties["cluster"] != "build" || instanceProperties["build-id"] != "a=b" {
+		t.Errorf("Unexpected instance properties %v", instanceProperties)
+	}
+
+	if instanceProperties.Set("invalid") == nil {
+		t.Errorf("Expected instance property without a value to be rejected")
+	}
+}
+
+func TestParseServeListenFlags(t *testing.T) {
+	args := []string{
+		"serve",
+		"--listen",
+		"unix:/run/rolesanywhere.sock",
+		"--socket-mode",
+		"0660",
+		"--allowed-uids",
+		"0,1000",
+		"--allowed-uids",
+		"1001",
+	}
+	setupFlagsOnce.Do(setupFlags)
+	var command = commands[args[0]]
+	err := command.Parse(args[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if listen != "unix:/run/rolesanywhere.sock" {
+		t.Errorf("Unexpected listen address %s", listen)
+	}
+	if allowedUids.String() != "0,1000,1001" {
+		t.Errorf("Unexpected allowed UIDs %s", allowedUids.String())
+	}
+	mode, err := parseSocketMode(socketMode)
+	if err != nil || mode != 0660 {
+		t.Errorf("Unexpected socket mode %o, %v", mode, err)
+	}
+
+	if allowedGids.Set("staff") == nil {
+		t.Errorf("Expected non-numeric GID to be rejected")
+	}
+	if _, err = parseSocketMode("0999"); err == nil {
+		t.Errorf("Expected non-octal socket mode to be rejected")
+	}
+}
+
+func TestReadPassword(t *testing.T) {
+	passwordFile := t.TempDir() + "/password"
+	ioutil.WriteFile(passwordFile, []byte("file-password\n"), 0600)
+	os.Setenv(pkcs12PasswordEnvVar, "env-password")
+	defer os.Unsetenv(pkcs12PasswordEnvVar)
+
+	password, err := readPassword(passwordFile, pkcs12PasswordEnvVar, "")
+	if err != nil || password != "file-password" {
+		t.Errorf("Expected password to be read from the file, got %q", password)
+	}
+	password, err = readPassword("", pkcs12PasswordEnvVar, "")
+	if err != nil || password != "env-password" {
+		t.Errorf("Expected password to be read from the environment, got %q", password)
+	}
+}
+
+func TestApplyConfigProfile(t *testing.T) {
+	dir := t.TempDir()
+	yamlConfig := dir + "/config.yaml"
+	ioutil.WriteFile(yamlConfig, []byte(`profiles:
+  build:
+    certificate: /etc/pki/build.pem
+    private-key: /etc/pki/build.key
+    role-arn: arn:aws:iam::000000000000:role/FileRole
+    session-duration: 900
+    with-proxy: true
+    port: 9912
+    instance-property:
+      team: build
+`), 0600)
+	tomlConfig := dir + "/config.toml"
+	// The roles of --roles-config can be listed in the same file
+	ioutil.WriteFile(tomlConfig, []byte(`[profiles.default]
+port = 9913
+mode = "ecs"
+
+[[roles]]
+roleArn = "arn:aws:iam::000000000000:role/BuildRole"
+`), 0600)
+
+	setupFlagsOnce.Do(setupFlags)
+	command := commands["update"]
+	err := command.Parse([]string{"--config", yamlConfig, "--config-profile", "build", "--role-arn", "arn:aws:iam::000000000000:role/FlagRole"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	explicitlySet := map[string]bool{}
+	command.Visit(func(f *flag.Flag) {
+		explicitlySet[f.Name] = true
+	})
+	profile, err := readConfigProfile(configPath, configProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// port is a flag of serve only, and is ignored by update
+	if err = applyConfigProfile(command, profile, explicitlySet); err != nil {
+		t.Fatal(err)
+	}
+	if roleArnStr != "arn:aws:iam::000000000000:role/FlagRole" {
+		t.Errorf("Expected the flag to take precedence over the configuration file, got %s", roleArnStr)
+	}
+	if certificateId != "/etc/pki/build.pem" || privateKeyId != "/etc/pki/build.key" || sessionDuration != 900 || !withProxy {
+		t.Errorf("Expected options to be read from the configuration file")
+	}
+	if instanceProperties["team"] != "build" {
+		t.Errorf("Unexpected instance properties %v", instanceProperties)
+	}
+
+	profile, err = readConfigProfile(tomlConfig, defaultConfigProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = applyConfigProfile(commands["serve"], profile, map[string]bool{}); err != nil {
+		t.Fatal(err)
+	}
+	if port != 9913 || serveMode != "ecs" {
+		t.Errorf("Expected serve options to be read from the TOML configuration file")
+	}
+
+	if _, err = readConfigProfile(tomlConfig, "missing"); err == nil {
+		t.Errorf("Expected a missing profile to be rejected")
+	}
+	if err = applyConfigProfile(command, map[string]interface{}{"no-such-flag": "value"}, map[string]bool{}); err == nil {
+		t.Errorf("Expected an unknown option to be rejected")
+	}
+}
+
+func TestApplyEnvVars(t *testing.T) {
+	env := map[string]string{
+		"ROLESANYWHERE_PORT":              "9914",
+		"ROLESANYWHERE_ROLE_SESSION_NAME": "env-session",
+		"ROLESANYWHERE_NO_VERIFY_SSL":     "true",
+		"ROLESANYWHERE_INSTANCE_PROPERTY": "env-a=1,env-b=2",
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	setupFlagsOnce.Do(setupFlags)
+	command := commands["serve"]
+	if err := command.Parse([]string{"--port", "9915"}); err != nil {
+		t.Fatal(err)
+	}
+	explicitlySet := map[string]bool{}
+	command.Visit(func(f *flag.Flag) {
+		explicitlySet[f.Name] = true
+	})
+	if err := applyEnvVars(command, explicitlySet); err != nil {
+		t.Fatal(err)
+	}
+	if port != 9915 {
+		t.Errorf("Expected the flag to take precedence over the environment, got port %d", port)
+	}
+	if roleSessionName != "env-session" || !noVerifySSL {
+		t.Errorf("Expected options to be read from the environment")
+	}
+	if instanceProperties["env-a"] != "1" || instanceProperties["env-b"] != "2" {
+		t.Errorf("Unexpected instance properties %v", instanceProperties)
+	}
+	if !strings.Contains(command.Lookup("role-arn").Usage, "ROLESANYWHERE_ROLE_ARN") {
+		t.Errorf("Expected the usage to list the environment variable")
+	}
+
+	os.Setenv("ROLESANYWHERE_SESSION_DURATION", "not-a-number")
+	defer os.Unsetenv("ROLESANYWHERE_SESSION_DURATION")
+	explicitlySet["instance-property"] = true
+	if err := applyEnvVars(command, explicitlySet); err == nil || !strings.Contains(err.Error(), "ROLESANYWHERE_SESSION_DURATION") {
+		t.Errorf("Expected an invalid value to be rejected, got %v", err)
+	}
+}
+
+func TestFindGlobalVarStopsAtSeparator(t *testing.T) {
+	globalVars, parseList := findGlobalVar([]string{"exec", "--region", "us-east-1", "--", "aws", "s3", "ls", "--region", "eu-west-1"})
+	if globalVars["--region"] != "us-east-1" {
+		t.Errorf("Unexpected region %s", globalVars["--region"])
+	}
+	expected := []string{"exec", "--", "aws", "s3", "ls", "--region", "eu-west-1"}
+	if strings.Join(parseList, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected the arguments of the command to be left alone, got %v", parseList)
+	}
+}
@@ -51,3 +51,37 @@ done;
 # Create certificate bundle
 cp ${basedir}/tst/certs/rsa-2048-sha256-cert.pem ${basedir}/tst/certs/cert-bundle.pem
 cat ${basedir}/tst/certs/ec-prime256v1-sha256-cert.pem >> ${basedir}/tst/certs/cert-bundle.pem
+
+# Create PKCS#12 files, with and without a password. Legacy algorithms are
+# used so that the files can be read regardless of the OpenSSL version.
+openssl pkcs12 -export \
+	-inkey ${basedir}/tst/certs/rsa-2048-key.pem \
+	-in ${basedir}/tst/certs/rsa-2048-sha256-cert.pem \
+	-certfile ${basedir}/tst/certs/ec-prime256v1-sha256-cert.pem \
+	-out ${basedir}/tst/certs/rsa-2048-sha256.p12 \
+	-keypbe PBE-SHA1-3DES -certpbe PBE-SHA1-3DES -macalg sha1 \
+	-passout pass:password
+openssl pkcs12 -export \
+	-inkey ${basedir}/tst/certs/ec-prime256v1-key.pem \
+	-in ${basedir}/tst/certs/ec-prime256v1-sha256-cert.pem \
+	-out ${basedir}/tst/certs/ec-prime256v1-sha256-nopass.p12 \
+	-keypbe PBE-SHA1-3DES -certpbe PBE-SHA1-3DES -macalg sha1 \
+	-passout pass:
+
+# Create encrypted PKCS#8 private keys, with the key derivation functions and
+# ciphers that can be used for PBES2
+openssl pkcs8 -topk8 -inform PEM -outform PEM \
+	-in ${basedir}/tst/certs/rsa-2048-key.pem \
+	-out ${basedir}/tst/certs/rsa-2048-key-pkcs8-aes256.pem \
+	-v2 aes-256-cbc -v2prf hmacWithSHA256 \
+	-passout pass:passphrase
+openssl pkcs8 -topk8 -inform PEM -outform PEM \
+	-in ${basedir}/tst/certs/ec-prime256v1-key.pem \
+	-out ${basedir}/tst/certs/ec-prime256v1-key-pkcs8-des3.pem \
+	-v2 des3 -v2prf hmacWithSHA1 \
+	-passout pass:passphrase
+openssl pkcs8 -topk8 -inform PEM -outform PEM \
+	-in ${basedir}/tst/certs/ec-prime256v1-key.pem \
+	-out ${basedir}/tst/certs/ec-prime256v1-key-pkcs8-scrypt.pem \
+	-scrypt \
+	-passout pass:passphrase
@@ -2,6 +2,20 @@ module github.com/zubeensyed/rolesanywhere-credential-helper
 
 go 1.18
 
-require github.com/aws/aws-sdk-go v1.44.57
+require (
+	github.com/BurntSushi/toml v1.2.1
+	github.com/aws/aws-sdk-go v1.44.57
+	github.com/aws/aws-sdk-go-v2 v1.17.1
+	github.com/google/go-tpm v0.3.3
+	github.com/miekg/pkcs11 v1.1.1
+	golang.org/x/crypto v0.0.0-20220331220935-ae2d96664a29
+	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e
+	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211
+	gopkg.in/yaml.v3 v3.0.1
+	software.sslmate.com/src/go-pkcs12 v0.2.0
+)
 
-require github.com/jmespath/go-jmespath v0.4.0 // indirect
+require (
+	github.com/aws/smithy-go v1.13.4 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+)